@@ -0,0 +1,322 @@
+package main
+
+import (
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/subtle"
+    "encoding/base64"
+    "errors"
+    "flag"
+    "fmt"
+    "net/http"
+    "os"
+    "strings"
+    "time"
+
+    "github.com/golang-jwt/jwt/v5"
+)
+
+// Signaling is authenticated with JWTs, signed with a shared HMAC secret or
+// an RSA or ECDSA key, that name the room the bearer may join (or "*" for
+// any), its identity in the subject and the most it may do there in role.
+// Joining also issues a secret that binds later signaling for the peer to
+// the client that joined.
+//
+// Both are sent in headers, as a Bearer token and in X-Peer-Secret, since
+// URLs end up in access and proxy logs. Only clients that can't set headers
+// put them elsewhere: browsers' WebSockets and HLS players pass the token in
+// ?token=, and a browser attaching a WebSocket to its peer sends the secret
+// in its first message. WHIP and WHEP clients can send nothing but the
+// token, so their session URL is named by the secret, and should be kept out
+// of logs like a token would.
+
+// peerSecretHeader carries a peer's secret on its HTTP signaling routes.
+const peerSecretHeader = "X-Peer-Secret"
+
+var (
+    errNoToken        = errors.New("missing token")
+    errWrongRoom      = errors.New("token is not valid for this room")
+    errRoleNotAllowed = errors.New("token does not allow this role")
+    errNotManager     = errors.New("token does not allow managing the room")
+    errBadPeerSecret  = errors.New("invalid peer secret")
+)
+
+// tokenClaims are the claims of a signaling token. The subject is the
+// bearer's identity. Admin lets the bearer manage the room without joining
+// it as a publisher.
+type tokenClaims struct {
+    Room  string `json:"room"`
+    Role  Role   `json:"role,omitempty"`
+    Admin bool   `json:"admin,omitempty"`
+    jwt.RegisteredClaims
+}
+
+// tokenVerifier holds the keys signaling tokens are checked against. With
+// neither set, signaling is open to anyone.
+type tokenVerifier struct {
+    hmacKey   []byte
+    publicKey crypto.PublicKey
+}
+
+var tokenAuth tokenVerifier
+
+func (v tokenVerifier) enabled() bool {
+    return v.hmacKey != nil || v.publicKey != nil
+}
+
+// key picks the key for a token's signing method, refusing methods no key
+// was configured for.
+func (v tokenVerifier) key(t *jwt.Token) (any, error) {
+    switch t.Method.(type) {
+    case *jwt.SigningMethodHMAC:
+        if v.hmacKey != nil {
+            return v.hmacKey, nil
+        }
+    case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+        if key, ok := v.publicKey.(*rsa.PublicKey); ok {
+            return key, nil
+        }
+    case *jwt.SigningMethodECDSA:
+        if key, ok := v.publicKey.(*ecdsa.PublicKey); ok {
+            return key, nil
+        }
+    }
+    return nil, fmt.Errorf("unexpected signing method %s", t.Method.Alg())
+}
+
+func (v tokenVerifier) parse(raw string) (*tokenClaims, error) {
+    claims := &tokenClaims{}
+    if _, err := jwt.ParseWithClaims(raw, claims, v.key, jwt.WithExpirationRequired()); err != nil {
+        return nil, err
+    }
+    if _, err := parseRole(string(claims.Role)); err != nil {
+        return nil, err
+    }
+    return claims, nil
+}
+
+// loadPublicKey reads an RSA or ECDSA public key, or a certificate holding
+// one, from a PEM file.
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+    pem, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    if key, err := jwt.ParseRSAPublicKeyFromPEM(pem); err == nil {
+        return key, nil
+    }
+    if key, err := jwt.ParseECPublicKeyFromPEM(pem); err == nil {
+        return key, nil
+    }
+    return nil, fmt.Errorf("%s holds no RSA or ECDSA public key", path)
+}
+
+// bearerToken returns the token a request carries, if any.
+func bearerToken(r *http.Request) string {
+    if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+        return strings.TrimSpace(token)
+    }
+    return r.URL.Query().Get("token")
+}
+
+// authorize checks the token of a signaling request against the room it is
+// for, writing a 401 or 403 and returning false if it doesn't pass. The
+// claims are nil when authentication is disabled.
+func authorize(w http.ResponseWriter, r *http.Request) (*tokenClaims, bool) {
+    if !tokenAuth.enabled() {
+        return nil, true
+    }
+    raw := bearerToken(r)
+    if raw == "" {
+        w.Header().Set("WWW-Authenticate", "Bearer")
+        http.Error(w, errNoToken.Error(), http.StatusUnauthorized)
+        return nil, false
+    }
+    claims, err := tokenAuth.parse(raw)
+    if err != nil {
+        w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+        http.Error(w, err.Error(), http.StatusUnauthorized)
+        return nil, false
+    }
+    if claims.Room != "*" && claims.Room != roomID(r) {
+        http.Error(w, errWrongRoom.Error(), http.StatusForbidden)
+        return nil, false
+    }
+    return claims, true
+}
+
+// permits reports whether the token lets its bearer join in a role.
+func (c *tokenClaims) permits(role Role) bool {
+    return c == nil || c.Role == "" || c.Role == RoleBoth || c.Role == role
+}
+
+// manages reports whether the token lets its bearer change the room itself:
+// its settings, recordings and HLS streams. Admins and anyone who may
+// publish there can.
+func (c *tokenClaims) manages() bool {
+    return c == nil || c.Admin || c.permits(RolePublisher)
+}
+
+// authorizeManager is authorize for the routes that change the room rather
+// than one peer, writing a 403 if the token doesn't manage it.
+func authorizeManager(w http.ResponseWriter, r *http.Request) bool {
+    claims, ok := authorize(w, r)
+    if !ok {
+        return false
+    }
+    if !claims.manages() {
+        http.Error(w, errNotManager.Error(), http.StatusForbidden)
+        return false
+    }
+    return true
+}
+
+// role resolves the role a client asked to join with against its token:
+// without a request, it joins with everything the token allows.
+func (c *tokenClaims) role(requested string) (Role, error) {
+    if requested == "" && c != nil && c.Role != "" {
+        return c.Role, nil
+    }
+    role, err := parseRole(requested)
+    if err != nil {
+        return "", err
+    }
+    if !c.permits(role) {
+        return "", errRoleNotAllowed
+    }
+    return role, nil
+}
+
+// identity is the bearer's identity, or empty without a token.
+func (c *tokenClaims) identity() string {
+    if c == nil {
+        return ""
+    }
+    return c.Subject
+}
+
+// newPeerSecret returns a random secret for a joining peer.
+func newPeerSecret() string {
+    return randomString(32)
+}
+
+// randomString returns n cryptographically random bytes, base64url-encoded.
+func randomString(n int) string {
+    b := make([]byte, n)
+    if _, err := rand.Read(b); err != nil {
+        panic(err)
+    }
+    return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// checkSecret reports whether secret is the peer's.
+func (p *Peer) checkSecret(secret string) bool {
+    return subtle.ConstantTimeCompare([]byte(secret), []byte(p.secret)) == 1
+}
+
+// lookupSession is lookupPeer for the routes a peer's own client signals
+// on, which also take the peer's secret in X-Peer-Secret.
+func lookupSession(w http.ResponseWriter, r *http.Request) *Peer {
+    peer := lookupPeer(w, r)
+    if peer == nil {
+        return nil
+    }
+    if !peer.checkSecret(r.Header.Get(peerSecretHeader)) {
+        http.Error(w, errBadPeerSecret.Error(), http.StatusForbidden)
+        return nil
+    }
+    return peer
+}
+
+// lookupResource finds the WHIP or WHEP peer a session URL is for. Those
+// clients can send nothing but the token, so the URL ends in the peer's
+// secret rather than its public ID.
+func lookupResource(w http.ResponseWriter, r *http.Request) *Peer {
+    if _, ok := authorize(w, r); !ok {
+        return nil
+    }
+    peer := rooms.session(r.PathValue("session"))
+    if peer == nil || !peer.offerless || peer.Room.ID != roomID(r) {
+        http.Error(w, "Session not found", http.StatusNotFound)
+        return nil
+    }
+    return peer
+}
+
+// tokenCommand mints a signaling token for testing: sfu token -secret ...
+// or -key private.pem, with the claims given by the other flags.
+func tokenCommand(args []string) error {
+    fs := flag.NewFlagSet("token", flag.ExitOnError)
+    room := fs.String("room", defaultRoom, `Room the token is valid for ("*" for any)`)
+    identity := fs.String("identity", "", "Identity of the bearer")
+    role := fs.String("role", string(RoleBoth), "Most the bearer may do: publisher, subscriber or both")
+    admin := fs.Bool("admin", false, "Let the bearer manage the room's settings, recordings and HLS streams")
+    ttl := fs.Duration("ttl", time.Hour, "How long the token is valid for")
+    secret := fs.String("secret", "", "HMAC secret to sign with (HS256)")
+    keyFile := fs.String("key", "", "RSA or ECDSA private key to sign with, as PEM (RS256 or ES256/384/512)")
+    fs.Parse(args)
+
+    if _, err := parseRole(*role); err != nil {
+        return err
+    }
+    now := time.Now()
+    claims := tokenClaims{
+        Room:  *room,
+        Role:  Role(*role),
+        Admin: *admin,
+        RegisteredClaims: jwt.RegisteredClaims{
+            Subject:   *identity,
+            IssuedAt:  jwt.NewNumericDate(now),
+            ExpiresAt: jwt.NewNumericDate(now.Add(*ttl)),
+        },
+    }
+
+    var method jwt.SigningMethod
+    var key any
+    switch {
+    case *secret != "" && *keyFile != "":
+        return errors.New("use either -secret or -key")
+    case *secret != "":
+        method, key = jwt.SigningMethodHS256, []byte(*secret)
+    case *keyFile != "":
+        pem, err := os.ReadFile(*keyFile)
+        if err != nil {
+            return err
+        }
+        if rsaKey, err := jwt.ParseRSAPrivateKeyFromPEM(pem); err == nil {
+            method, key = jwt.SigningMethodRS256, rsaKey
+        } else if ecKey, err := jwt.ParseECPrivateKeyFromPEM(pem); err == nil {
+            method, key = ecdsaMethod(ecKey.Curve), ecKey
+        } else {
+            return fmt.Errorf("%s holds no RSA or ECDSA private key", *keyFile)
+        }
+        if method == nil {
+            return fmt.Errorf("unsupported curve in %s", *keyFile)
+        }
+    default:
+        return errors.New("-secret or -key is required")
+    }
+
+    token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+    if err != nil {
+        return err
+    }
+    fmt.Println(token)
+    return nil
+}
+
+// ecdsaMethod is the JWT signing method for keys on a curve.
+func ecdsaMethod(curve elliptic.Curve) jwt.SigningMethod {
+    switch curve {
+    case elliptic.P256():
+        return jwt.SigningMethodES256
+    case elliptic.P384():
+        return jwt.SigningMethodES384
+    case elliptic.P521():
+        return jwt.SigningMethodES512
+    }
+    return nil
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/x509"
+    "encoding/pem"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/golang-jwt/jwt/v5"
+)
+
+// useTokenAuth verifies tokens with v for the rest of the test.
+func useTokenAuth(t *testing.T, v tokenVerifier) {
+    saved := tokenAuth
+    tokenAuth = v
+    t.Cleanup(func() { tokenAuth = saved })
+}
+
+// claimsFor returns claims for room and role that expire in an hour.
+func claimsFor(room string, role Role) tokenClaims {
+    return tokenClaims{
+        Room: room,
+        Role: role,
+        RegisteredClaims: jwt.RegisteredClaims{
+            Subject:   "alice",
+            ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+        },
+    }
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, key any, claims tokenClaims) string {
+    t.Helper()
+    token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return token
+}
+
+func TestTokenVerifierParse(t *testing.T) {
+    hmacKey := []byte("test secret")
+    rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    otherRSAKey, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // An attacker who knows the public key may sign with it as an HMAC
+    // secret, hoping it is verified as one.
+    rsaPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+    hmacOnly := tokenVerifier{hmacKey: hmacKey}
+    rsaOnly := tokenVerifier{publicKey: &rsaKey.PublicKey}
+    ecOnly := tokenVerifier{publicKey: &ecKey.PublicKey}
+    hmacAndRSA := tokenVerifier{hmacKey: hmacKey, publicKey: &rsaKey.PublicKey}
+
+    valid := claimsFor("demo", RoleBoth)
+    noExp := valid
+    noExp.ExpiresAt = nil
+    expired := valid
+    expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+    badRole := claimsFor("demo", "admin")
+
+    tests := []struct {
+        name     string
+        verifier tokenVerifier
+        token    string
+        ok       bool
+    }{
+        {"HS256", hmacOnly, signToken(t, jwt.SigningMethodHS256, hmacKey, valid), true},
+        {"HS512", hmacAndRSA, signToken(t, jwt.SigningMethodHS512, hmacKey, valid), true},
+        {"RS256", rsaOnly, signToken(t, jwt.SigningMethodRS256, rsaKey, valid), true},
+        {"PS256", hmacAndRSA, signToken(t, jwt.SigningMethodPS256, rsaKey, valid), true},
+        {"ES256", ecOnly, signToken(t, jwt.SigningMethodES256, ecKey, valid), true},
+        {"wrong HMAC secret", hmacOnly, signToken(t, jwt.SigningMethodHS256, []byte("guess"), valid), false},
+        {"other RSA key", rsaOnly, signToken(t, jwt.SigningMethodRS256, otherRSAKey, valid), false},
+        {"HS256 with the RSA public key", rsaOnly, signToken(t, jwt.SigningMethodHS256, rsaPEM, valid), false},
+        {"HS256 with the RSA public key and an HMAC secret set", hmacAndRSA, signToken(t, jwt.SigningMethodHS256, rsaPEM, valid), false},
+        {"RS256 without an RSA key", hmacOnly, signToken(t, jwt.SigningMethodRS256, rsaKey, valid), false},
+        {"ES256 with an RSA key", rsaOnly, signToken(t, jwt.SigningMethodES256, ecKey, valid), false},
+        {"RS256 with an ECDSA key", ecOnly, signToken(t, jwt.SigningMethodRS256, rsaKey, valid), false},
+        {"unsigned", hmacAndRSA, signToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, valid), false},
+        {"missing exp", hmacOnly, signToken(t, jwt.SigningMethodHS256, hmacKey, noExp), false},
+        {"expired", hmacOnly, signToken(t, jwt.SigningMethodHS256, hmacKey, expired), false},
+        {"unknown role", hmacOnly, signToken(t, jwt.SigningMethodHS256, hmacKey, badRole), false},
+        {"garbage", hmacOnly, "not.a.token", false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            claims, err := tt.verifier.parse(tt.token)
+            if tt.ok && err != nil {
+                t.Fatalf("parse = %v, want a valid token", err)
+            }
+            if !tt.ok && err == nil {
+                t.Fatalf("parse accepted the token with claims %+v", claims)
+            }
+            if tt.ok && (claims.Room != "demo" || claims.Subject != "alice") {
+                t.Errorf("claims = room %q, subject %q; want demo, alice", claims.Room, claims.Subject)
+            }
+        })
+    }
+}
+
+func TestAuthorize(t *testing.T) {
+    key := []byte("test secret")
+    useTokenAuth(t, tokenVerifier{hmacKey: key})
+    token := func(room string) string {
+        return signToken(t, jwt.SigningMethodHS256, key, claimsFor(room, RoleBoth))
+    }
+
+    tests := []struct {
+        name   string
+        room   string // path value; empty for the routes that predate rooms
+        header string
+        query  string
+        status int
+    }{
+        {"no token", "demo", "", "", http.StatusUnauthorized},
+        {"not a bearer token", "demo", "Basic " + token("demo"), "", http.StatusUnauthorized},
+        {"invalid token", "demo", "Bearer nope", "", http.StatusUnauthorized},
+        {"token for another key", "demo", "Bearer " + signToken(t, jwt.SigningMethodHS256, []byte("other"), claimsFor("demo", RoleBoth)), "", http.StatusUnauthorized},
+        {"same room", "demo", "Bearer " + token("demo"), "", http.StatusOK},
+        {"same room in the query", "demo", "", token("demo"), http.StatusOK},
+        {"wrong room", "other", "Bearer " + token("demo"), "", http.StatusForbidden},
+        {"default room", "", "Bearer " + token(defaultRoom), "", http.StatusOK},
+        {"room token on the default room", "", "Bearer " + token("demo"), "", http.StatusForbidden},
+        {"any room", "other", "Bearer " + token("*"), "", http.StatusOK},
+        {"any room on the default room", "", "Bearer " + token("*"), "", http.StatusOK},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest(http.MethodPost, "/offer?token="+tt.query, nil)
+            r.SetPathValue("room", tt.room)
+            if tt.header != "" {
+                r.Header.Set("Authorization", tt.header)
+            }
+            w := httptest.NewRecorder()
+            claims, ok := authorize(w, r)
+            if ok != (tt.status == http.StatusOK) || w.Code != tt.status {
+                t.Fatalf("authorize = %v with status %d, want status %d", ok, w.Code, tt.status)
+            }
+            if ok && claims.identity() != "alice" {
+                t.Errorf("identity = %q, want alice", claims.identity())
+            }
+            if tt.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+                t.Error("401 without WWW-Authenticate")
+            }
+        })
+    }
+}
+
+func TestAuthorizeDisabled(t *testing.T) {
+    useTokenAuth(t, tokenVerifier{})
+    w := httptest.NewRecorder()
+    claims, ok := authorize(w, httptest.NewRequest(http.MethodPost, "/offer", nil))
+    if !ok || claims != nil {
+        t.Errorf("authorize = %v, %v; want nil claims and true", claims, ok)
+    }
+}
+
+func TestTokenClaimsRole(t *testing.T) {
+    withRole := func(role Role) *tokenClaims {
+        claims := claimsFor("demo", role)
+        return &claims
+    }
+
+    tests := []struct {
+        name      string
+        claims    *tokenClaims
+        requested string
+        want      Role
+        err       bool
+    }{
+        {"no token", nil, "", RoleBoth, false},
+        {"no token, publisher", nil, string(RolePublisher), RolePublisher, false},
+        {"no ceiling", withRole(""), string(RoleSubscriber), RoleSubscriber, false},
+        {"no ceiling, no request", withRole(""), "", RoleBoth, false},
+        {"both allows publisher", withRole(RoleBoth), string(RolePublisher), RolePublisher, false},
+        {"subscriber by default", withRole(RoleSubscriber), "", RoleSubscriber, false},
+        {"subscriber", withRole(RoleSubscriber), string(RoleSubscriber), RoleSubscriber, false},
+        {"subscriber asks to publish", withRole(RoleSubscriber), string(RolePublisher), "", true},
+        {"subscriber asks for both", withRole(RoleSubscriber), string(RoleBoth), "", true},
+        {"publisher asks to subscribe", withRole(RolePublisher), string(RoleSubscriber), "", true},
+        {"unknown role", withRole(RoleBoth), "admin", "", true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            role, err := tt.claims.role(tt.requested)
+            if (err != nil) != tt.err {
+                t.Fatalf("role(%q) error = %v, want error %v", tt.requested, err, tt.err)
+            }
+            if role != tt.want {
+                t.Errorf("role(%q) = %q, want %q", tt.requested, role, tt.want)
+            }
+        })
+    }
+    if _, err := withRole(RoleSubscriber).role(string(RolePublisher)); !errors.Is(err, errRoleNotAllowed) {
+        t.Errorf("role above the ceiling = %v, want %v", err, errRoleNotAllowed)
+    }
+}
+
+func TestTokenClaimsManages(t *testing.T) {
+    admin := claimsFor("demo", RoleSubscriber)
+    admin.Admin = true
+    tests := []struct {
+        name   string
+        claims tokenClaims
+        want   bool
+    }{
+        {"no ceiling", claimsFor("demo", ""), true},
+        {"both", claimsFor("demo", RoleBoth), true},
+        {"publisher", claimsFor("demo", RolePublisher), true},
+        {"subscriber", claimsFor("demo", RoleSubscriber), false},
+        {"subscriber admin", admin, true},
+    }
+    for _, tt := range tests {
+        if got := tt.claims.manages(); got != tt.want {
+            t.Errorf("%s: manages = %v, want %v", tt.name, got, tt.want)
+        }
+    }
+    if !(*tokenClaims)(nil).manages() {
+        t.Error("manages without authentication = false, want true")
+    }
+}
+
+func TestAuthorizeManager(t *testing.T) {
+    key := []byte("test secret")
+    useTokenAuth(t, tokenVerifier{hmacKey: key})
+    for _, tt := range []struct {
+        role   Role
+        status int
+    }{
+        {RolePublisher, http.StatusOK},
+        {RoleSubscriber, http.StatusForbidden},
+    } {
+        r := httptest.NewRequest(http.MethodPost, "/rooms/demo/recording/start", nil)
+        r.SetPathValue("room", "demo")
+        r.Header.Set("Authorization", "Bearer "+signToken(t, jwt.SigningMethodHS256, key, claimsFor("demo", tt.role)))
+        w := httptest.NewRecorder()
+        if ok := authorizeManager(w, r); ok != (tt.status == http.StatusOK) || w.Code != tt.status {
+            t.Errorf("%s: authorizeManager = %v with status %d, want status %d", tt.role, ok, w.Code, tt.status)
+        }
+    }
+}
+
+func TestRoomRoutesRequireToken(t *testing.T) {
+    useTokenAuth(t, tokenVerifier{hmacKey: []byte("test secret")})
+    peer := registerTestPeer(t, "routes-test")
+
+    handlers := map[string]http.HandlerFunc{
+        "GET room":        roomHandler,
+        "PATCH room":      roomHandler,
+        "tracks":          tracksHandler,
+        "speaker":         speakerHandler,
+        "recordings":      recordingsHandler,
+        "recording start": recordingHandler(true),
+        "HLS start":       hlsHandler(true),
+        "HLS file":        hlsFileHandler,
+        "stats":           statsHandler,
+        "bandwidth":       bandwidthHandler,
+        "subscriptions":   subscriptionsHandler(true),
+        "last-n":          lastNHandler,
+        "layer":           layerHandler,
+        "delete peer":     deletePeerHandler,
+    }
+    for name, handler := range handlers {
+        r := httptest.NewRequest(http.MethodGet, "/", nil)
+        if name == "PATCH room" {
+            r.Method = http.MethodPatch
+        }
+        r.SetPathValue("room", "routes-test")
+        r.SetPathValue("peer", peer.ID)
+        w := httptest.NewRecorder()
+        handler(w, r)
+        if w.Code != http.StatusUnauthorized {
+            t.Errorf("%s without a token: status %d, want %d", name, w.Code, http.StatusUnauthorized)
+        }
+    }
+}
+
+// registerTestPeer adds a peer without a connection to a room for the rest
+// of the test.
+func registerTestPeer(t *testing.T, roomID string) *Peer {
+    room := rooms.acquire(roomID)
+    peer := &Peer{Room: room, Role: RoleBoth}
+    rooms.register(peer)
+    room.mu.Lock()
+    room.peers[peer.ID] = peer
+    room.mu.Unlock()
+    t.Cleanup(func() {
+        room.mu.Lock()
+        delete(room.peers, peer.ID)
+        room.mu.Unlock()
+        rooms.unregister(peer)
+        rooms.release(room)
+    })
+    return peer
+}
+
+func TestLookupSession(t *testing.T) {
+    useTokenAuth(t, tokenVerifier{})
+    peer := registerTestPeer(t, "session-test")
+    other := registerTestPeer(t, "session-test")
+
+    tests := []struct {
+        name   string
+        room   string
+        id     string
+        secret string
+        status int
+    }{
+        {"own secret", "session-test", peer.ID, peer.secret, http.StatusOK},
+        {"missing secret", "session-test", peer.ID, "", http.StatusForbidden},
+        {"wrong secret", "session-test", peer.ID, "guess", http.StatusForbidden},
+        {"another peer's secret", "session-test", peer.ID, other.secret, http.StatusForbidden},
+        {"unknown peer", "session-test", "peer-nobody", peer.secret, http.StatusNotFound},
+        {"secret in place of the ID", "session-test", peer.secret, peer.secret, http.StatusNotFound},
+        {"secret in place of the ID without the header", "session-test", peer.secret, "", http.StatusNotFound},
+        {"wrong room", "other", peer.ID, peer.secret, http.StatusNotFound},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest(http.MethodPost, "/answer", nil)
+            r.SetPathValue("room", tt.room)
+            r.SetPathValue("peer", tt.id)
+            if tt.secret != "" {
+                r.Header.Set(peerSecretHeader, tt.secret)
+            }
+            w := httptest.NewRecorder()
+            got := lookupSession(w, r)
+            if tt.status == http.StatusOK {
+                if got != peer {
+                    t.Fatalf("lookupSession = %v with status %d, want the peer", got, w.Code)
+                }
+                return
+            }
+            if got != nil || w.Code != tt.status {
+                t.Errorf("lookupSession = %v with status %d, want nil with status %d", got, w.Code, tt.status)
+            }
+        })
+    }
+}
+
+func TestLookupResource(t *testing.T) {
+    useTokenAuth(t, tokenVerifier{})
+    whip := registerTestPeer(t, "resource-test")
+    whip.offerless = true
+    signaled := registerTestPeer(t, "resource-test")
+
+    tests := []struct {
+        name    string
+        room    string
+        session string
+        status  int
+    }{
+        {"secret", "resource-test", whip.secret, http.StatusOK},
+        {"public ID", "resource-test", whip.ID, http.StatusNotFound},
+        {"wrong room", "other", whip.secret, http.StatusNotFound},
+        {"peer with JSON signaling", "resource-test", signaled.secret, http.StatusNotFound},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest(http.MethodDelete, "/whip/"+tt.session, nil)
+            r.SetPathValue("room", tt.room)
+            r.SetPathValue("session", tt.session)
+            w := httptest.NewRecorder()
+            got := lookupResource(w, r)
+            if tt.status == http.StatusOK {
+                if got != whip {
+                    t.Fatalf("lookupResource = %v with status %d, want the WHIP peer", got, w.Code)
+                }
+                return
+            }
+            if got != nil || w.Code != tt.status {
+                t.Errorf("lookupResource = %v with status %d, want nil with status %d", got, w.Code, tt.status)
+            }
+        })
+    }
+}
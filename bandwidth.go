@@ -0,0 +1,346 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+    "sort"
+    "time"
+
+    "github.com/pion/interceptor"
+    "github.com/pion/interceptor/pkg/cc"
+    "github.com/pion/interceptor/pkg/gcc"
+    "github.com/pion/rtcp"
+    "github.com/pion/webrtc/v3"
+)
+
+// bweInitialBitrate is the estimate, in bits per second, a subscriber starts
+// with before its TWCC feedback refines it. Set by -bwe-initial-bitrate.
+var bweInitialBitrate = 1_000_000
+
+const (
+    bweMinBitrate = 50_000
+    bweMaxBitrate = 20_000_000
+
+    // allocationInterval is how often each subscriber's estimate is
+    // shared out across its forwarded tracks.
+    allocationInterval = time.Second
+
+    // rembTimeout and lossTimeout bound how long a REMB or a lossy
+    // receiver report keeps affecting the allocation.
+    rembTimeout = 5 * time.Second
+    lossTimeout = 2 * time.Second
+)
+
+// registerBandwidthEstimator adds a send-side GCC estimator, fed by the
+// subscriber's TWCC feedback, and the transport-wide sequence numbers that
+// feedback refers to. The estimator of each PeerConnection is passed to the
+// factory's OnNewPeerConnection callback.
+func registerBandwidthEstimator(m *webrtc.MediaEngine, i *interceptor.Registry) (*cc.InterceptorFactory, error) {
+    congestion, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+        // Forwarding is not paced; the estimate only drives allocation.
+        return gcc.NewSendSideBWE(
+            gcc.SendSideBWEInitialBitrate(bweInitialBitrate),
+            gcc.SendSideBWEMinBitrate(bweMinBitrate),
+            gcc.SendSideBWEMaxBitrate(bweMaxBitrate),
+            gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+        )
+    })
+    if err != nil {
+        return nil, err
+    }
+    i.Add(congestion)
+
+    // Added after the estimator so that its sequence numbers are already
+    // set when the estimator records a packet as sent.
+    if err := webrtc.ConfigureTWCCHeaderExtensionSender(m, i); err != nil {
+        return nil, err
+    }
+    return congestion, nil
+}
+
+// bandwidthState is what a subscriber has told us about its downlink, plus
+// the result of the last allocation. Guarded by the subscriber's mu.
+type bandwidthState struct {
+    remb          uint64
+    rembAt        time.Time
+    loss          uint8
+    lossAt        time.Time
+    lastDowngrade time.Time
+    allocated     uint64
+}
+
+// onRTCP records the REMB and receiver report loss a subscriber sends.
+// Callers must hold the subscriber's mu.
+func (bw *bandwidthState) onRTCP(pkt rtcp.Packet) {
+    switch pkt := pkt.(type) {
+    case *rtcp.ReceiverEstimatedMaximumBitrate:
+        bw.remb = uint64(pkt.Bitrate)
+        bw.rembAt = time.Now()
+
+    case *rtcp.ReceiverReport:
+        for _, report := range pkt.Reports {
+            if time.Since(bw.lossAt) > lossTimeout || report.FractionLost > bw.loss {
+                bw.loss = report.FractionLost
+                bw.lossAt = time.Now()
+            }
+        }
+    }
+}
+
+// estimate returns p's available downlink in bits per second: the TWCC
+// estimate, capped by a recent REMB. Callers must hold p.mu.
+func (p *Peer) estimate() (estimate, twcc, remb uint64) {
+    estimate = uint64(bweInitialBitrate)
+    if p.estimator != nil {
+        estimate = uint64(p.estimator.GetTargetBitrate())
+    }
+    twcc = estimate
+    if time.Since(p.bandwidth.rembAt) < rembTimeout {
+        remb = p.bandwidth.remb
+        estimate = min(estimate, remb)
+    }
+    return estimate, twcc, remb
+}
+
+// congested reports whether p's downlink is overloaded: the TWCC estimator
+// is backing off, the subscriber reports loss, or more is being sent than
+// its REMB allows. Callers must hold p.mu.
+func (p *Peer) congested(sending uint64) bool {
+    if p.estimator != nil {
+        stats := p.estimator.GetStats()
+        if stats["state"] == "decrease" {
+            return true
+        }
+        if loss, ok := stats["averageLoss"].(float64); ok && loss*256 > layerLossDown {
+            return true
+        }
+    }
+    if time.Since(p.bandwidth.lossAt) < lossTimeout && p.bandwidth.loss > layerLossDown {
+        return true
+    }
+    _, _, remb := p.estimate()
+    return remb > 0 && sending > remb
+}
+
+// allocateLoop reallocates p's bandwidth until p is closed.
+func (p *Peer) allocateLoop() {
+    ticker := time.NewTicker(allocationInterval)
+    defer ticker.Stop()
+    for range ticker.C {
+        if p.closed.Load() {
+            return
+        }
+        p.allocateBandwidth()
+    }
+}
+
+// allocateBandwidth shares p's estimate out across the tracks forwarded to
+// it. Audio is always forwarded and served first, then video in the order
+// of sortVideoByPriority. Video held back by Last-N is left out.
+//
+// The estimate only grows with what is actually sent, so it is enforced
+// when the downlink is congested: video is downgraded, or paused if even
+// its lowest layer does not fit. Otherwise tracks below the layer they want
+// move up when it fits, or one track is probed one layer up, at most once
+// per layerUpHoldoff after a downgrade.
+func (p *Peer) allocateBandwidth() {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    var audio, video []*ForwardedTrack
+    var sending uint64
+    for _, out := range p.OutTracks {
+        if out.Published.Remote.Kind() == webrtc.RTPCodecTypeAudio {
+            audio = append(audio, out)
+        } else if !out.lastNPaused {
+            video = append(video, out)
+        }
+        sending += out.bitrate()
+    }
+    sortVideoByPriority(video, p.pinnedPeers, p.Room.speakers.ranking())
+
+    estimate, _, _ := p.estimate()
+    congested := p.congested(sending)
+    canUpgrade := !congested && time.Since(p.bandwidth.lastDowngrade) > layerUpHoldoff
+
+    budget := int64(estimate)
+    for _, out := range audio {
+        budget -= int64(out.bitrate())
+    }
+
+    probed := false
+    for _, out := range video {
+        layers := out.Published.Layers()
+        if len(layers) == 0 {
+            continue
+        }
+        index := func(rid string) int {
+            for i, layer := range layers {
+                if layer.RID == rid {
+                    return i
+                }
+            }
+            return -1
+        }
+
+        want := len(layers) - 1
+        if out.pinnedLayer {
+            if i := index(out.requestedLayer); i >= 0 {
+                want = i
+            }
+        }
+        fit := -1
+        for i := want; i >= 0; i-- {
+            if int64(layers[i].bitrate.Load()) <= budget {
+                fit = i
+                break
+            }
+        }
+        current := -1
+        if !out.paused {
+            current = max(min(index(out.targetLayer), want), 0)
+        }
+
+        pick := current
+        switch {
+        case congested && fit < current:
+            pick = fit
+            p.bandwidth.lastDowngrade = time.Now()
+        case canUpgrade && fit > current:
+            pick = fit
+        case canUpgrade && current < want && !probed:
+            pick = current + 1
+            probed = true
+        }
+
+        if pick < 0 {
+            if !out.paused {
+                out.paused = true
+                out.syncFilter()
+                log.Printf("⏸️ %s: paused for %s (estimate %d bps)", out.Key, p.ID, estimate)
+            }
+            continue
+        }
+        if out.paused {
+            out.resume(layers[pick].RID)
+            log.Printf("▶️ %s: resumed for %s", out.Key, p.ID)
+        } else {
+            out.setTargetLayer(layers[pick].RID)
+        }
+        budget -= int64(layers[pick].bitrate.Load())
+    }
+
+    p.bandwidth.allocated = uint64(max(int64(estimate)-budget, 0))
+}
+
+// sortVideoByPriority orders video tracks for allocation: those of pinned
+// publishers first, then the others by the room's speaker ranking, most
+// recently active first, and tracks already flowing before paused ones.
+func sortVideoByPriority(video []*ForwardedTrack, pinned map[string]bool, ranking []string) {
+    rank := make(map[string]int, len(ranking))
+    for i, id := range ranking {
+        rank[id] = i
+    }
+    position := func(out *ForwardedTrack) int {
+        if pinned[out.PublisherID] {
+            return -1
+        }
+        if i, ok := rank[out.PublisherID]; ok {
+            return i
+        }
+        return len(ranking)
+    }
+    sort.Slice(video, func(i, j int) bool {
+        a, b := video[i], video[j]
+        if pa, pb := position(a), position(b); pa != pb {
+            return pa < pb
+        }
+        if a.paused != b.paused {
+            return !a.paused
+        }
+        return a.Key < b.Key
+    })
+}
+
+// bitrate is the incoming bitrate of the layer p is receiving, or zero if
+// the track is paused. Callers must hold the subscriber's mu.
+func (out *ForwardedTrack) bitrate() uint64 {
+    if out.paused || out.lastNPaused {
+        return 0
+    }
+    if layer := out.Published.layer(out.targetLayer); layer != nil {
+        return layer.bitrate.Load()
+    }
+    return 0
+}
+
+// resume forwards a paused track again from layer rid. Like a layer switch,
+// it waits for a keyframe and hides the gap from the subscriber. Callers
+// must hold the subscriber's mu.
+func (out *ForwardedTrack) resume(rid string) {
+    out.paused = false
+    out.resuming = true
+    out.targetLayer = rid
+    out.syncFilter()
+    out.Published.requestKeyframe(rid, false)
+}
+
+// TrackAllocation is one forwarded track's share of a subscriber's
+// bandwidth.
+type TrackAllocation struct {
+    Track   string `json:"track"`
+    Kind    string `json:"kind"`
+    Layer   string `json:"layer,omitempty"`
+    Pinned  bool   `json:"pinned"`
+    Paused  bool   `json:"paused"`
+    LastN   bool   `json:"out_of_last_n"`
+    Bitrate uint64 `json:"bitrate_bps"`
+}
+
+// BandwidthInfo is returned by GET /peer/{peer}/bandwidth. EstimateBps is
+// what allocation uses; TWCCBps and REMBBps are its inputs, the latter zero
+// without a recent REMB.
+type BandwidthInfo struct {
+    PeerID       string            `json:"peer_id"`
+    EstimateBps  uint64            `json:"estimate_bps"`
+    TWCCBps      uint64            `json:"twcc_bps"`
+    REMBBps      uint64            `json:"remb_bps"`
+    AllocatedBps uint64            `json:"allocated_bps"`
+    Congested    bool              `json:"congested"`
+    Tracks       []TrackAllocation `json:"tracks"`
+}
+
+// Bandwidth reports p's current estimate and how it is allocated.
+func (p *Peer) Bandwidth() BandwidthInfo {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    info := BandwidthInfo{PeerID: p.ID, AllocatedBps: p.bandwidth.allocated, Tracks: []TrackAllocation{}}
+    info.EstimateBps, info.TWCCBps, info.REMBBps = p.estimate()
+
+    var sending uint64
+    for _, out := range p.OutTracks {
+        sending += out.bitrate()
+        info.Tracks = append(info.Tracks, TrackAllocation{
+            Track:   out.Key,
+            Kind:    out.Published.Remote.Kind().String(),
+            Layer:   out.targetLayer,
+            Pinned:  out.pinnedLayer,
+            Paused:  out.paused,
+            LastN:   out.lastNPaused,
+            Bitrate: out.bitrate(),
+        })
+    }
+    info.Congested = p.congested(sending)
+    sort.Slice(info.Tracks, func(i, j int) bool {
+        return info.Tracks[i].Track < info.Tracks[j].Track
+    })
+    return info
+}
+
+func bandwidthHandler(w http.ResponseWriter, r *http.Request) {
+    if peer := lookupPeer(w, r); peer != nil {
+        json.NewEncoder(w).Encode(peer.Bandwidth())
+    }
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestSortVideoByPriority(t *testing.T) {
+    track := func(publisher string, paused bool) *ForwardedTrack {
+        return &ForwardedTrack{Key: publisher + "/video", PublisherID: publisher, paused: paused}
+    }
+
+    tests := []struct {
+        name    string
+        video   []*ForwardedTrack
+        pinned  map[string]bool
+        ranking []string
+        want    []string
+    }{
+        {
+            name:    "speaker ranking",
+            video:   []*ForwardedTrack{track("a", false), track("b", false), track("c", false)},
+            ranking: []string{"c", "a", "b"},
+            want:    []string{"c", "a", "b"},
+        },
+        {
+            name:    "pinned first",
+            video:   []*ForwardedTrack{track("a", false), track("b", false), track("c", false)},
+            pinned:  map[string]bool{"b": true},
+            ranking: []string{"c", "a", "b"},
+            want:    []string{"b", "c", "a"},
+        },
+        {
+            name:    "unranked last",
+            video:   []*ForwardedTrack{track("a", false), track("b", false), track("c", false)},
+            ranking: []string{"b"},
+            want:    []string{"b", "a", "c"},
+        },
+        {
+            name:  "flowing before paused",
+            video: []*ForwardedTrack{track("a", true), track("b", false), track("c", true)},
+            want:  []string{"b", "a", "c"},
+        },
+        {
+            name:    "ranking before flowing",
+            video:   []*ForwardedTrack{track("a", false), track("b", true)},
+            ranking: []string{"b", "a"},
+            want:    []string{"b", "a"},
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            sortVideoByPriority(tt.video, tt.pinned, tt.ranking)
+            var got []string
+            for _, out := range tt.video {
+                got = append(got, out.PublisherID)
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("order = %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+    "sync"
+    "sync/atomic"
+
+    "github.com/pion/rtp"
+)
+
+// packetBufferSize fits any RTP packet that arrives in one UDP datagram on
+// a typical path MTU.
+const packetBufferSize = 1500
+
+// packetBuffer is one RTP packet, read once from a publisher and shared by
+// the send queues of all its subscribers. It is reference counted and goes
+// back to packetPool when the last holder releases it; nobody may modify it
+// while it is shared.
+type packetBuffer struct {
+    data []byte
+    n    int
+    pkt  rtp.Packet
+    refs atomic.Int32
+}
+
+var packetPool = sync.Pool{
+    New: func() any {
+        return &packetBuffer{data: make([]byte, packetBufferSize)}
+    },
+}
+
+// getPacketBuffer returns an empty buffer holding one reference.
+func getPacketBuffer() *packetBuffer {
+    b := packetPool.Get().(*packetBuffer)
+    b.n = 0
+    b.refs.Store(1)
+    return b
+}
+
+// unmarshal parses the first n bytes of the buffer into its packet, whose
+// payload then points into the buffer.
+func (b *packetBuffer) unmarshal(n int) error {
+    b.n = n
+    return b.pkt.Unmarshal(b.data[:n])
+}
+
+// raw returns the packet as it was read.
+func (b *packetBuffer) raw() []byte {
+    return b.data[:b.n]
+}
+
+func (b *packetBuffer) retain() {
+    b.refs.Add(1)
+}
+
+// release drops a reference, recycling the buffer when none are left. The
+// packet's slices are kept so the next unmarshal can reuse them.
+func (b *packetBuffer) release() {
+    if b.refs.Add(-1) == 0 {
+        packetPool.Put(b)
+    }
+}
@@ -165,36 +165,85 @@
 package main
 
 import (
-    "bytes"
-    "encoding/json"
     "fmt"
-    "io/ioutil"
     "log"
     "math/rand"
     "flag"
     "net/http"
+    "net/url"
+    "sync"
+    "sync/atomic"
     "time"
 
+    "github.com/gorilla/websocket"
+    "github.com/pion/interceptor"
     "github.com/pion/rtp"
+    "github.com/pion/sdp/v3"
     "github.com/pion/webrtc/v3"
 )
 
-func sendFakeVideo(track *webrtc.TrackLocalStaticRTP) {
+// signalMessage mirrors the server's SignalMessage envelope on /ws.
+type signalMessage struct {
+    Type      string                     `json:"type"`
+    PeerID    string                     `json:"peer_id,omitempty"`
+    Secret    string                     `json:"secret,omitempty"`
+    SDP       *webrtc.SessionDescription `json:"sdp,omitempty"`
+    Candidate *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
+    Tracks    []trackInfo                `json:"tracks,omitempty"`
+    TrackIDs  []string                   `json:"track_ids,omitempty"`
+    Error     string                     `json:"error,omitempty"`
+}
+
+// trackInfo mirrors the server's description of a published track.
+type trackInfo struct {
+    ID          string `json:"id"`
+    PublisherID string `json:"publisher_id"`
+    Kind        string `json:"kind"`
+    StreamID    string `json:"stream_id"`
+}
+
+// signaler serializes writes to the signaling socket.
+type signaler struct {
+    conn *websocket.Conn
+    mu   sync.Mutex
+}
+
+func (s *signaler) send(msg signalMessage) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.conn.WriteJSON(msg)
+}
+
+// sendFakeVideo sends ~30fps of fake VP8 frames of frameSize bytes, with a
+// keyframe every second so the SFU can switch simulcast layers.
+func sendFakeVideo(track *webrtc.TrackLocalStaticRTP, frameSize int, tag func(*rtp.Header)) {
     go func() {
         ticker := time.NewTicker(33 * time.Millisecond)
         defer ticker.Stop()
         var seq uint16
         var timestamp uint32
         for range ticker.C {
+            // VP8 payload descriptor with S=1, then a payload header
+            // whose low bit is 0 for keyframes. Each frame fits in one
+            // packet, so every packet carries the marker bit.
+            payload := make([]byte, frameSize)
+            payload[0] = 0x10
+            if seq%30 != 0 {
+                payload[1] = 0x01
+            }
             pkt := &rtp.Packet{
                 Header: rtp.Header{
                     Version:        2,
                     PayloadType:    96,
+                    Marker:         true,
                     SequenceNumber: seq,
                     Timestamp:      timestamp,
                     SSRC:           12345678,
                 },
-                Payload: []byte{0x00},
+                Payload: payload,
+            }
+            if tag != nil {
+                tag(&pkt.Header)
             }
             err := track.WriteRTP(pkt)
             if err != nil {
@@ -207,147 +256,410 @@ func sendFakeVideo(track *webrtc.TrackLocalStaticRTP) {
     }()
 }
 
+// Opus frames sent by sendFakeAudio. Both are 20ms CELT fullband mono frames
+// (TOC byte 0xF8); the silence frame is the one encoders emit for digital
+// silence.
+var (
+    opusSilenceFrame = []byte{0xF8, 0xFF, 0xFE}
+    opusToneFrameSize = 80
+)
+
+// sendFakeAudio sends an Opus frame every 20ms, stamped with the audio level
+// header extension so the SFU can tell who is speaking. level is in -dBov:
+// 127 sends silence frames, anything lower "tone" frames of
+// opusToneFrameSize bytes at that level. The tone frames carry a fixed
+// filler pattern rather than encoded audio, so they decode as noise.
+func sendFakeAudio(track *webrtc.TrackLocalStaticRTP, sender *webrtc.RTPSender, level uint8) {
+    payload := opusSilenceFrame
+    if level < 127 {
+        payload = make([]byte, opusToneFrameSize)
+        payload[0] = 0xF8
+        for i := 1; i < len(payload); i++ {
+            payload[i] = byte(i * 37)
+        }
+    }
+    audioLevel, err := rtp.AudioLevelExtension{Level: level, Voice: level < 127}.Marshal()
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    go func() {
+        ticker := time.NewTicker(20 * time.Millisecond)
+        defer ticker.Stop()
+        var seq uint16
+        var timestamp uint32
+        for range ticker.C {
+            pkt := &rtp.Packet{
+                Header: rtp.Header{
+                    Version:        2,
+                    PayloadType:    111,
+                    SequenceNumber: seq,
+                    Timestamp:      timestamp,
+                    SSRC:           87654321,
+                },
+                Payload: payload,
+            }
+            for _, ext := range sender.GetParameters().HeaderExtensions {
+                if ext.URI == sdp.AudioLevelURI {
+                    pkt.Header.SetExtension(uint8(ext.ID), audioLevel)
+                }
+            }
+            if err := track.WriteRTP(pkt); err != nil {
+                log.Printf("❌ Error writing RTP: %v", err)
+                return
+            }
+            seq++
+            timestamp += 960
+        }
+    }()
+}
+
+// kindStats counts the media received of one kind, across all tracks.
+type kindStats struct {
+    packets atomic.Int64
+    bytes   atomic.Int64
+}
+
+// reportStats logs the packet and bit rates received per media kind every
+// second.
+func reportStats(stats map[webrtc.RTPCodecType]*kindStats) {
+    go func() {
+        ticker := time.NewTicker(1 * time.Second)
+        last := make(map[webrtc.RTPCodecType][2]int64)
+        for range ticker.C {
+            line := "📈"
+            for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+                packets, bytes := stats[kind].packets.Load(), stats[kind].bytes.Load()
+                pps := packets - last[kind][0]
+                bps := bytes - last[kind][1]
+                last[kind] = [2]int64{packets, bytes}
+                line += fmt.Sprintf(" %s: %d pkt/s, %.2f kbps |", kind, pps, float64(bps*8)/1000.0)
+            }
+            log.Print(line[:len(line)-2])
+        }
+    }()
+}
+
+// drainRTCP reads the RTCP the SFU sends for one encoding of a sender.
+// Nothing is done with it here, but reading is what lets the sender's
+// interceptors answer NACKs.
+func drainRTCP(sender *webrtc.RTPSender, rid string) {
+    go func() {
+        buf := make([]byte, 1500)
+        for {
+            var err error
+            if rid == "" {
+                _, _, err = sender.Read(buf)
+            } else {
+                _, _, err = sender.ReadSimulcast(buf, rid)
+            }
+            if err != nil {
+                return
+            }
+        }
+    }()
+}
+
+// simulcastTagger returns a function that stamps packets with the MID and RID
+// header extensions. Pion does not add them on send, but the SFU needs them
+// to tell the layers of a simulcast sender apart.
+func simulcastTagger(pc *webrtc.PeerConnection, sender *webrtc.RTPSender, rid string) func(*rtp.Header) {
+    return func(h *rtp.Header) {
+        var mid string
+        for _, t := range pc.GetTransceivers() {
+            if t.Sender() == sender {
+                mid = t.Mid()
+            }
+        }
+        if mid == "" {
+            return
+        }
+        for _, ext := range sender.GetParameters().HeaderExtensions {
+            switch ext.URI {
+            case sdp.SDESMidURI:
+                h.SetExtension(uint8(ext.ID), []byte(mid))
+            case sdp.SDESRTPStreamIDURI:
+                h.SetExtension(uint8(ext.ID), []byte(rid))
+            }
+        }
+    }
+}
+
 func main() {
     duration := flag.Int("duration", 30, "How long to stay connected before exiting (in seconds)")
+    room := flag.String("room", "default", "Room to join on the SFU")
+    media := flag.String("media", "both", "What to publish: audio, video or both")
+    simulcast := flag.Bool("simulcast", false, "Publish video as three simulcast layers (q, h, f)")
+    audioLevel := flag.Int("audio-level", 30, "Level of the published audio in -dBov (0 loudest, 127 sends silence)")
+    subscribeAll := flag.Bool("subscribe", false, "Explicitly subscribe to every track in the room (for rooms without auto-subscribe)")
+    token := flag.String("token", "", "Signaling token, for SFUs that require one (see sfu token)")
     flag.Parse()
     rand.Seed(time.Now().UnixNano())
+
+    sendAudio := *media == "audio" || *media == "both"
+    sendVideo := *media == "video" || *media == "both"
+    if !sendAudio && !sendVideo {
+        log.Fatalf("Unknown -media %q: use audio, video or both", *media)
+    }
+    if *audioLevel < 0 || *audioLevel > 127 {
+        log.Fatalf("-audio-level must be between 0 and 127")
+    }
+
+    // Time to First RTP is measured from here so that it covers signaling
+    // and ICE setup, not just the gap between OnTrack and the first packet.
+    connectStart := time.Now()
     config := webrtc.Configuration{
         ICEServers: []webrtc.ICEServer{
             {URLs: []string{"stun:stun.l.google.com:19302"}},
         },
     }
 
-    pc, err := webrtc.NewPeerConnection(config)
+    // Same as webrtc.NewPeerConnection, plus the MID/RID header extensions
+    // needed to send simulcast and the audio level one the SFU uses for
+    // speaker detection.
+    m := &webrtc.MediaEngine{}
+    if err := m.RegisterDefaultCodecs(); err != nil {
+        log.Fatal(err)
+    }
+    if err := webrtc.ConfigureSimulcastExtensionHeaders(m); err != nil {
+        log.Fatal(err)
+    }
+    if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI}, webrtc.RTPCodecTypeAudio); err != nil {
+        log.Fatal(err)
+    }
+    i := &interceptor.Registry{}
+    if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+        log.Fatal(err)
+    }
+    api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i))
+
+    pc, err := api.NewPeerConnection(config)
     if err != nil {
         log.Fatal(err)
     }
 
+    received := map[webrtc.RTPCodecType]*kindStats{
+        webrtc.RTPCodecTypeAudio: {},
+        webrtc.RTPCodecTypeVideo: {},
+    }
+    reportStats(received)
+
     pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-        log.Printf("Received track from SFU | Kind: %s", track.Kind())
-        go func() {
-            buf := make([]byte, 1500)
-            firstRTP := true
-            firstRTPStart := time.Now()
-    
-            var packetCount int
-            var byteCount int
-    
-            go func() {
-                ticker := time.NewTicker(1 * time.Second)
-                lastPackets := 0
-                lastBytes := 0
-                for range ticker.C {
-                    pps := packetCount - lastPackets
-                    bps := byteCount - lastBytes
-                    lastPackets = packetCount
-                    lastBytes = byteCount
-    
-                    log.Printf("📈 Packets: %d/s | Bitrate: %.2f kbps", pps, float64(bps*8)/1000.0)
-                }
-            }()
-    
-            for {
-                n, _, err := track.Read(buf)
-                if err != nil {
-                    log.Printf("❌ RTP read error: %v", err)
-                    return
-                }
-    
-                if firstRTP {
-                    log.Printf("📦 Time to First RTP: %.2fms", time.Since(firstRTPStart).Seconds()*1000)
-                    firstRTP = false
-                }
-    
-                packetCount++
-                byteCount += n
-            }
-        }()
+        log.Printf("Received track from SFU | Kind: %s | Stream: %s | Codec: %s (PT %d)",
+            track.Kind(), track.StreamID(), track.Codec().MimeType, track.PayloadType())
+        stats := received[track.Kind()]
+
         buf := make([]byte, 1500)
+        firstRTP := true
         for {
             n, _, err := track.Read(buf)
             if err != nil {
-                log.Printf("Track read error: %v", err)
+                log.Printf("❌ RTP read error: %v", err)
                 return
             }
-            log.Printf("RTP packet received: %d bytes", n)
+
+            if firstRTP {
+                log.Printf("📦 [%s] Time to First RTP: %.2fms", track.Kind(), time.Since(connectStart).Seconds()*1000)
+                firstRTP = false
+            }
+            stats.packets.Add(1)
+            stats.bytes.Add(int64(n))
         }
     })
 
-    videoTrack, err := webrtc.NewTrackLocalStaticRTP(
-        webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "pion-client")
-    if err != nil {
-        log.Fatal(err)
+    // A per-client stream ID lets receivers tell participants apart.
+    streamID := fmt.Sprintf("pion-client-%d", rand.Intn(1000000))
+    if sendAudio {
+        audioTrack, err := webrtc.NewTrackLocalStaticRTP(
+            webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", streamID)
+        if err != nil {
+            log.Fatal(err)
+        }
+        sender, err := pc.AddTrack(audioTrack)
+        if err != nil {
+            log.Fatal(err)
+        }
+        drainRTCP(sender, "")
+
+        sendFakeAudio(audioTrack, sender, uint8(*audioLevel))
     }
-    _, err = pc.AddTrack(videoTrack)
-    if err != nil {
-        log.Fatal(err)
+    if sendVideo && *simulcast {
+        // One encoding per RID on a single sender, lowest quality first.
+        var sender *webrtc.RTPSender
+        for n, layer := range []struct {
+            rid  string
+            size int
+        }{{"q", 50}, {"h", 200}, {"f", 800}} {
+            track, err := webrtc.NewTrackLocalStaticRTP(
+                webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", streamID, webrtc.WithRTPStreamID(layer.rid))
+            if err != nil {
+                log.Fatal(err)
+            }
+            if n == 0 {
+                sender, err = pc.AddTrack(track)
+            } else {
+                err = sender.AddEncoding(track)
+            }
+            if err != nil {
+                log.Fatal(err)
+            }
+            drainRTCP(sender, layer.rid)
+            sendFakeVideo(track, layer.size, simulcastTagger(pc, sender, layer.rid))
+        }
+    } else if sendVideo {
+        videoTrack, err := webrtc.NewTrackLocalStaticRTP(
+            webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", streamID)
+        if err != nil {
+            log.Fatal(err)
+        }
+        sender, err := pc.AddTrack(videoTrack)
+        if err != nil {
+            log.Fatal(err)
+        }
+        drainRTCP(sender, "")
+
+        sendFakeVideo(videoTrack, 2, nil)
     }
 
-    sendFakeVideo(videoTrack)
+    wsURL := fmt.Sprintf("ws://localhost:8080/rooms/%s/ws", url.PathEscape(*room))
+    header := http.Header{}
+    if *token != "" {
+        header.Set("Authorization", "Bearer "+*token)
+    }
+    conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+    if err != nil {
+        log.Fatalf("Failed to open signaling socket: %v", err)
+    }
+    defer conn.Close()
+    sig := &signaler{conn: conn}
+
+    // Trickle our candidates to the server as they are gathered instead of
+    // waiting for gathering to complete.
+    pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+        if c == nil {
+            return
+        }
+        candidate := c.ToJSON()
+        if err := sig.send(signalMessage{Type: "candidate", Candidate: &candidate}); err != nil {
+            log.Printf("Failed to send candidate: %v", err)
+        }
+    })
 
     offer, err := pc.CreateOffer(nil)
     if err != nil {
         log.Fatal(err)
     }
-    if err := pc.SetLocalDescription(offer); err != nil {
-        log.Fatal(err)
-    }
 
-    <-webrtc.GatheringCompletePromise(pc)
-
-    offerBuf, _ := json.Marshal(pc.LocalDescription())
-    resp, err := http.Post("http://localhost:8080/offer", "application/json", bytes.NewReader(offerBuf))
-    if err != nil {
+    // Send the offer before SetLocalDescription starts gathering, so the
+    // server always sees it ahead of our first candidate.
+    if err := sig.send(signalMessage{Type: "offer", SDP: &offer}); err != nil {
         log.Fatalf("Failed to send offer: %v", err)
     }
-
-    var respData struct {
-        SDP    webrtc.SessionDescription `json:"sdp"`
-        PeerID string                    `json:"peer_id"`
-    }
-    body, _ := ioutil.ReadAll(resp.Body)
-    json.Unmarshal(body, &respData)
-
-    err = pc.SetRemoteDescription(respData.SDP)
-    if err != nil {
-        log.Fatalf("Failed to set remote description: %v", err)
+    if err := pc.SetLocalDescription(offer); err != nil {
+        log.Fatal(err)
     }
 
-    peerID := respData.PeerID
-    log.Printf("Connected as %s", peerID)
+    // The peer assigned by the server, used to leave cleanly on exit.
+    joined := make(chan signalMessage, 1)
 
     go func() {
+        // Server candidates received before the answer is applied.
+        var pendingCandidates []webrtc.ICECandidateInit
+        var peerID string
+
         for {
-            time.Sleep(1 * time.Second)
-            renegotiateURL := fmt.Sprintf("http://localhost:8080/renegotiate/%s", peerID)
-            res, err := http.Get(renegotiateURL)
-            if err != nil || res.StatusCode != 200 {
-                continue
+            var msg signalMessage
+            if err := conn.ReadJSON(&msg); err != nil {
+                log.Printf("Signaling socket closed: %v", err)
+                return
             }
 
-            var offer webrtc.SessionDescription
-            json.NewDecoder(res.Body).Decode(&offer)
-            log.Println("📡 Received renegotiation offer")
+            switch msg.Type {
+            case "answer":
+                if err := pc.SetRemoteDescription(*msg.SDP); err != nil {
+                    log.Fatalf("Failed to set remote description: %v", err)
+                }
+                log.Printf("Connected as %s", msg.PeerID)
+                peerID = msg.PeerID
+                joined <- msg
+
+                for _, candidate := range pendingCandidates {
+                    if err := pc.AddICECandidate(candidate); err != nil {
+                        log.Printf("Failed to add candidate: %v", err)
+                    }
+                }
+                pendingCandidates = nil
 
-            if err := pc.SetRemoteDescription(offer); err != nil {
-                log.Printf("Failed to set remote SDP: %v", err)
-                continue
-            }
+            case "candidate":
+                if pc.RemoteDescription() == nil {
+                    pendingCandidates = append(pendingCandidates, *msg.Candidate)
+                    continue
+                }
+                if err := pc.AddICECandidate(*msg.Candidate); err != nil {
+                    log.Printf("Failed to add candidate: %v", err)
+                }
 
-            answer, err := pc.CreateAnswer(nil)
-            if err != nil {
-                log.Printf("Failed to create answer: %v", err)
-                continue
-            }
-            pc.SetLocalDescription(answer)
+            case "offer":
+                log.Println("📡 Received renegotiation offer")
+                if err := pc.SetRemoteDescription(*msg.SDP); err != nil {
+                    log.Printf("Failed to set remote SDP: %v", err)
+                    continue
+                }
+
+                answer, err := pc.CreateAnswer(nil)
+                if err != nil {
+                    log.Printf("Failed to create answer: %v", err)
+                    continue
+                }
+                pc.SetLocalDescription(answer)
+
+                if err := sig.send(signalMessage{Type: "answer", SDP: &answer}); err != nil {
+                    log.Printf("Failed to send answer: %v", err)
+                    continue
+                }
+                log.Println("Sent renegotiation answer")
 
-            answerBuf, _ := json.Marshal(answer)
-            http.Post(fmt.Sprintf("http://localhost:8080/answer/%s", peerID), "application/json", bytes.NewReader(answerBuf))
-            log.Println("Sent renegotiation answer")
+            case "tracks":
+                log.Printf("📋 %d tracks published in room", len(msg.Tracks))
+                if !*subscribeAll {
+                    continue
+                }
+                var ids []string
+                for _, t := range msg.Tracks {
+                    if t.PublisherID != peerID {
+                        ids = append(ids, t.ID)
+                    }
+                }
+                if len(ids) > 0 {
+                    if err := sig.send(signalMessage{Type: "subscribe", TrackIDs: ids}); err != nil {
+                        log.Printf("Failed to subscribe: %v", err)
+                    }
+                }
+
+            case "subscriptions":
+                log.Printf("📋 Subscribed to %d tracks", len(msg.TrackIDs))
+
+            case "error":
+                log.Printf("❌ Signaling error: %s", msg.Error)
+            }
         }
     }()
 
     log.Printf("🕒 Client will exit after %d seconds\n", *duration)
     time.Sleep(time.Duration(*duration) * time.Second)
+
+    select {
+    case answer := <-joined:
+        leaveURL := fmt.Sprintf("http://localhost:8080/rooms/%s/peer/%s", url.PathEscape(*room), answer.PeerID)
+        req, _ := http.NewRequest(http.MethodDelete, leaveURL, nil)
+        req.Header = header.Clone()
+        req.Header.Set("X-Peer-Secret", answer.Secret)
+        if res, err := http.DefaultClient.Do(req); err != nil {
+            log.Printf("Failed to leave: %v", err)
+        } else {
+            res.Body.Close()
+        }
+    default:
+    }
     log.Println("👋 Client exiting after duration.")
 }
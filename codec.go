@@ -0,0 +1,418 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+
+    "github.com/pion/sdp/v3"
+    "github.com/pion/webrtc/v3"
+)
+
+// codecPolicy decides which codecs the SFU negotiates, in order of
+// preference. Every PeerConnection gets the same codecs with the same
+// payload types, so a published track can be forwarded to any subscriber
+// that accepts its codec.
+type codecPolicy struct {
+    // Codecs are names from codecNames, most preferred first.
+    Codecs []string `json:"codecs"`
+
+    // H264Profiles are names from h264ProfileIDs, most preferred first,
+    // and H264Level the highest level (level_idc, e.g. 31 for 3.1) a
+    // publisher may send.
+    H264Profiles []string `json:"h264_profiles"`
+    H264Level    uint8    `json:"h264_level"`
+}
+
+// codecConfig is the policy applied to every PeerConnection, set from the
+// -codecs, -h264-profiles and -h264-level flags. VP9 and AV1 are opt-in.
+var codecConfig = codecPolicy{
+    Codecs:       []string{"opus", "vp8", "h264"},
+    H264Profiles: []string{"constrained-baseline", "baseline", "main", "high"},
+    H264Level:    31,
+}
+
+// codecNames maps the names used by the policy to MIME types.
+var codecNames = map[string]string{
+    "opus": webrtc.MimeTypeOpus,
+    "g722": webrtc.MimeTypeG722,
+    "pcmu": webrtc.MimeTypePCMU,
+    "pcma": webrtc.MimeTypePCMA,
+    "vp8":  webrtc.MimeTypeVP8,
+    "vp9":  webrtc.MimeTypeVP9,
+    "av1":  webrtc.MimeTypeAV1,
+    "h264": webrtc.MimeTypeH264,
+}
+
+// h264ProfileIDs maps H.264 profile names to the profile_idc and
+// profile-iop bytes of a profile-level-id, in hex.
+var h264ProfileIDs = map[string]string{
+    "constrained-baseline": "42e0",
+    "baseline":             "4200",
+    "main":                 "4d00",
+    "high":                 "6400",
+}
+
+// Payload types, the same Pion registers by default so that clients see
+// familiar numbers. H.264 has one per profile and packetization mode.
+var (
+    codecPayloadTypes = map[string]webrtc.PayloadType{
+        "opus": 111,
+        "g722": 9,
+        "pcmu": 0,
+        "pcma": 8,
+        "vp8":  96,
+        "vp9":  98,
+        "av1":  45,
+    }
+    h264PayloadTypes = map[string][2]webrtc.PayloadType{
+        "constrained-baseline": {106, 108},
+        "baseline":             {102, 104},
+        "main":                 {127, 39},
+        "high":                 {112, 114},
+    }
+)
+
+// errNoAllowedCodec rejects a publisher offering no codec the policy allows.
+var errNoAllowedCodec = errors.New("no allowed codec")
+
+// parseCodecPolicy builds a policy from comma-separated codec and H.264
+// profile names and an H.264 level such as "3.1".
+func parseCodecPolicy(codecList, profileList, level string) (codecPolicy, error) {
+    var policy codecPolicy
+    for _, name := range strings.Split(codecList, ",") {
+        name = strings.ToLower(strings.TrimSpace(name))
+        if _, ok := codecNames[name]; !ok {
+            return policy, fmt.Errorf("unknown codec %q", name)
+        }
+        policy.Codecs = append(policy.Codecs, name)
+    }
+    for _, name := range strings.Split(profileList, ",") {
+        name = strings.ToLower(strings.TrimSpace(name))
+        if _, ok := h264ProfileIDs[name]; !ok {
+            return policy, fmt.Errorf("unknown H.264 profile %q", name)
+        }
+        policy.H264Profiles = append(policy.H264Profiles, name)
+    }
+
+    major, minor, _ := strings.Cut(level, ".")
+    m, err := strconv.Atoi(major)
+    if err != nil {
+        return policy, fmt.Errorf("invalid H.264 level %q", level)
+    }
+    n := 0
+    if minor != "" {
+        if n, err = strconv.Atoi(minor); err != nil {
+            return policy, fmt.Errorf("invalid H.264 level %q", level)
+        }
+    }
+    if m < 1 || m > 6 || n < 0 || n > 9 {
+        return policy, fmt.Errorf("invalid H.264 level %q", level)
+    }
+    policy.H264Level = uint8(m*10 + n)
+    return policy, nil
+}
+
+// parameters returns the codecs the policy registers, most preferred first.
+// No RTX is registered: publishers resend NACKed packets on the original
+// SSRC, which the SFU forwards like any other, and it answers subscriber
+// NACKs the same way.
+func (policy codecPolicy) parameters() []webrtc.RTPCodecParameters {
+    videoFeedback := []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}}
+
+    var params []webrtc.RTPCodecParameters
+    for _, name := range policy.Codecs {
+        mimeType := codecNames[name]
+        switch name {
+        case "opus":
+            params = append(params, webrtc.RTPCodecParameters{
+                RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeType, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"},
+                PayloadType:        codecPayloadTypes[name],
+            })
+        case "g722", "pcmu", "pcma":
+            params = append(params, webrtc.RTPCodecParameters{
+                RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeType, ClockRate: 8000},
+                PayloadType:        codecPayloadTypes[name],
+            })
+        case "vp8", "av1":
+            params = append(params, webrtc.RTPCodecParameters{
+                RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeType, ClockRate: 90000, RTCPFeedback: videoFeedback},
+                PayloadType:        codecPayloadTypes[name],
+            })
+        case "vp9":
+            params = append(params, webrtc.RTPCodecParameters{
+                RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeType, ClockRate: 90000, SDPFmtpLine: "profile-id=0", RTCPFeedback: videoFeedback},
+                PayloadType:        codecPayloadTypes[name],
+            })
+        case "h264":
+            // The level in our profile-level-id is the highest one we
+            // accept. It only reaches our own offers, though: answers take
+            // the offerer's profile-level-id, so checkOffer strips the
+            // payload types offered above it.
+            for _, profile := range policy.H264Profiles {
+                profileLevelID := fmt.Sprintf("%s%02x", h264ProfileIDs[profile], policy.H264Level)
+                for mode, pt := range h264PayloadTypes[profile] {
+                    params = append(params, webrtc.RTPCodecParameters{
+                        RTPCodecCapability: webrtc.RTPCodecCapability{
+                            MimeType:     mimeType,
+                            ClockRate:    90000,
+                            SDPFmtpLine:  fmt.Sprintf("level-asymmetry-allowed=1;packetization-mode=%d;profile-level-id=%s", 1-mode, profileLevelID),
+                            RTCPFeedback: videoFeedback,
+                        },
+                        PayloadType: pt,
+                    })
+                }
+            }
+        }
+    }
+    return params
+}
+
+// registerCodecs registers the policy's codecs with a MediaEngine in place of
+// webrtc.RegisterDefaultCodecs.
+func (policy codecPolicy) registerCodecs(m *webrtc.MediaEngine) error {
+    for _, codec := range policy.parameters() {
+        kind := webrtc.RTPCodecTypeVideo
+        if strings.HasPrefix(strings.ToLower(codec.MimeType), "audio/") {
+            kind = webrtc.RTPCodecTypeAudio
+        }
+        if err := m.RegisterCodec(codec, kind); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// offeredCodec is one payload type listed in an m-line.
+type offeredCodec struct {
+    payloadType string
+    mimeType    string
+    fmtp        map[string]string
+}
+
+// parseCodec describes a codec by its MIME type and fmtp line.
+func parseCodec(mimeType, fmtpLine string) offeredCodec {
+    codec := offeredCodec{mimeType: mimeType, fmtp: make(map[string]string)}
+    for _, param := range strings.Split(fmtpLine, ";") {
+        if key, value, ok := strings.Cut(strings.TrimSpace(param), "="); ok {
+            codec.fmtp[strings.ToLower(key)] = strings.ToLower(value)
+        }
+    }
+    return codec
+}
+
+// mediaCodecs returns the codecs an m-line lists, ignoring the ones that
+// only carry other payloads, such as RTX and FEC.
+func mediaCodecs(md *sdp.MediaDescription) []offeredCodec {
+    var codecs []offeredCodec
+    for _, format := range md.MediaName.Formats {
+        pt, err := strconv.ParseUint(format, 10, 8)
+        if err != nil {
+            continue
+        }
+        codec, err := (&sdp.SessionDescription{MediaDescriptions: []*sdp.MediaDescription{md}}).GetCodecForPayloadType(uint8(pt))
+        if err != nil {
+            continue
+        }
+        switch strings.ToLower(codec.Name) {
+        case "rtx", "red", "ulpfec", "flexfec-03", "telephone-event", "cn":
+            continue
+        }
+        offered := parseCodec(md.MediaName.Media+"/"+codec.Name, codec.Fmtp)
+        offered.payloadType = format
+        codecs = append(codecs, offered)
+    }
+    return codecs
+}
+
+// allows reports whether the policy accepts a codec. For H.264 the profile
+// must be allowed and the level no higher than the policy's.
+func (policy codecPolicy) allows(codec offeredCodec) bool {
+    for _, name := range policy.Codecs {
+        if !strings.EqualFold(codecNames[name], codec.mimeType) {
+            continue
+        }
+        if name != "h264" {
+            return true
+        }
+        id := codec.fmtp["profile-level-id"]
+        if len(id) != 6 {
+            return false
+        }
+        if level, err := strconv.ParseUint(id[4:], 16, 8); err != nil || uint8(level) > policy.H264Level {
+            return false
+        }
+        for _, profile := range policy.H264Profiles {
+            if h264ProfileIDs[profile] == id[:4] {
+                return true
+            }
+        }
+        return false
+    }
+    return false
+}
+
+// checkOffer rejects an offer that would publish media in a codec the
+// policy does not allow: every audio or video m-line the client sends on
+// must list at least one allowed codec. The offer to apply is returned with
+// the payload types of codecs the policy does not allow stripped from those
+// m-lines, along with their RTX, so the answer can't accept them; Pion
+// matches H.264 by profile alone and would take any level.
+func (policy codecPolicy) checkOffer(offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+    parsed, err := offer.Unmarshal()
+    if err != nil {
+        return offer, err
+    }
+    stripped := false
+    for _, md := range parsed.MediaDescriptions {
+        kind := md.MediaName.Media
+        if kind != "audio" && kind != "video" || md.MediaName.Port.Value == 0 {
+            continue
+        }
+        if _, recvonly := md.Attribute(sdp.AttrKeyRecvOnly); recvonly {
+            continue
+        }
+        if _, inactive := md.Attribute(sdp.AttrKeyInactive); inactive {
+            continue
+        }
+
+        var offered []string
+        dropped := map[string]bool{}
+        for _, codec := range mediaCodecs(md) {
+            offered = append(offered, codec.mimeType)
+            if !policy.allows(codec) {
+                dropped[codec.payloadType] = true
+            }
+        }
+        if len(dropped) == len(offered) {
+            return offer, fmt.Errorf("%w for %s (offered: %s; allowed: %s)", errNoAllowedCodec, kind, strings.Join(offered, ", "), strings.Join(policy.Codecs, ", "))
+        }
+        if len(dropped) > 0 {
+            stripPayloadTypes(md, dropped)
+            stripped = true
+        }
+    }
+    if !stripped {
+        return offer, nil
+    }
+    raw, err := parsed.Marshal()
+    if err != nil {
+        return offer, err
+    }
+    return webrtc.SessionDescription{Type: offer.Type, SDP: string(raw)}, nil
+}
+
+// stripPayloadTypes removes payload types, and the RTX for them, from an
+// m-line's formats and their rtpmap, fmtp and rtcp-fb attributes.
+func stripPayloadTypes(md *sdp.MediaDescription, dropped map[string]bool) {
+    for _, attr := range md.Attributes {
+        if attr.Key != "fmtp" {
+            continue
+        }
+        pt, params, _ := strings.Cut(attr.Value, " ")
+        if dropped[parseCodec("", params).fmtp["apt"]] {
+            dropped[pt] = true
+        }
+    }
+
+    var formats []string
+    for _, format := range md.MediaName.Formats {
+        if !dropped[format] {
+            formats = append(formats, format)
+        }
+    }
+    var attrs []sdp.Attribute
+    for _, attr := range md.Attributes {
+        switch attr.Key {
+        case "rtpmap", "fmtp", "rtcp-fb":
+            if pt, _, _ := strings.Cut(attr.Value, " "); dropped[pt] {
+                continue
+            }
+        }
+        attrs = append(attrs, attr)
+    }
+    md.MediaName.Formats = formats
+    md.Attributes = attrs
+}
+
+// canReceive reports whether p can receive a codec, judging by the codecs
+// its last remote description lists for that kind of media. Without any
+// m-line of that kind there is nothing to go by, and negotiation decides.
+func (p *Peer) canReceive(codec webrtc.RTPCodecParameters) bool {
+    return describesCodec(p.PC.RemoteDescription(), codec)
+}
+
+// describesCodec is canReceive for a given remote description.
+func describesCodec(remote *webrtc.SessionDescription, codec webrtc.RTPCodecParameters) bool {
+    if remote == nil {
+        return true
+    }
+    parsed, err := remote.Unmarshal()
+    if err != nil {
+        return true
+    }
+    kind, _, _ := strings.Cut(strings.ToLower(codec.MimeType), "/")
+    want := parseCodec(codec.MimeType, codec.SDPFmtpLine)
+
+    seen := false
+    for _, md := range parsed.MediaDescriptions {
+        if md.MediaName.Media != kind {
+            continue
+        }
+        seen = true
+        for _, have := range mediaCodecs(md) {
+            if sameCodec(want, have) {
+                return true
+            }
+        }
+    }
+    return !seen
+}
+
+// sameCodec reports whether two codecs are interchangeable: the same MIME
+// type and, for H.264, the same profile and packetization mode.
+func sameCodec(a, b offeredCodec) bool {
+    if !strings.EqualFold(a.mimeType, b.mimeType) {
+        return false
+    }
+    if !strings.EqualFold(a.mimeType, webrtc.MimeTypeH264) {
+        return true
+    }
+    mode := func(c offeredCodec) string {
+        if m, ok := c.fmtp["packetization-mode"]; ok {
+            return m
+        }
+        return "0"
+    }
+    aID, bID := a.fmtp["profile-level-id"], b.fmtp["profile-level-id"]
+    return mode(a) == mode(b) && len(aID) == 6 && len(bID) == 6 && aID[:4] == bID[:4]
+}
+
+// CodecInfo is one codec registered on every PeerConnection.
+type CodecInfo struct {
+    MimeType    string `json:"mime_type"`
+    PayloadType uint8  `json:"payload_type"`
+    ClockRate   uint32 `json:"clock_rate"`
+    Fmtp        string `json:"fmtp,omitempty"`
+}
+
+// codecsHandler reports the codec policy and the codecs it registers, in
+// order of preference.
+func codecsHandler(w http.ResponseWriter, r *http.Request) {
+    registered := []CodecInfo{}
+    for _, codec := range codecConfig.parameters() {
+        registered = append(registered, CodecInfo{
+            MimeType:    codec.MimeType,
+            PayloadType: uint8(codec.PayloadType),
+            ClockRate:   codec.ClockRate,
+            Fmtp:        codec.SDPFmtpLine,
+        })
+    }
+    json.NewEncoder(w).Encode(struct {
+        Policy     codecPolicy `json:"policy"`
+        Registered []CodecInfo `json:"registered"`
+    }{codecConfig, registered})
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+    "errors"
+    "reflect"
+    "slices"
+    "strings"
+    "testing"
+
+    "github.com/pion/webrtc/v3"
+)
+
+// publisherOffer returns the offer of a client sending video in the given
+// codecs, most preferred first.
+func publisherOffer(t *testing.T, codecs ...webrtc.RTPCodecParameters) webrtc.SessionDescription {
+    t.Helper()
+
+    m := &webrtc.MediaEngine{}
+    for _, codec := range codecs {
+        if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+            t.Fatal(err)
+        }
+    }
+    client, err := webrtc.NewAPI(webrtc.WithMediaEngine(m)).NewPeerConnection(webrtc.Configuration{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+    if _, err := client.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+        t.Fatal(err)
+    }
+    offer, err := client.CreateOffer(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return offer
+}
+
+// h264At is H.264 with a profile-level-id and payload type.
+func h264At(profileLevelID string, pt webrtc.PayloadType) webrtc.RTPCodecParameters {
+    return webrtc.RTPCodecParameters{
+        RTPCodecCapability: webrtc.RTPCodecCapability{
+            MimeType:    webrtc.MimeTypeH264,
+            ClockRate:   90000,
+            SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + profileLevelID,
+        },
+        PayloadType: pt,
+    }
+}
+
+// answerCodecs applies an offer checked by the default policy and returns
+// the fmtp lines of the video codecs the SFU answers with.
+func answerCodecs(t *testing.T, offer webrtc.SessionDescription) []string {
+    t.Helper()
+
+    offer, err := codecConfig.checkOffer(offer)
+    if err != nil {
+        t.Fatal(err)
+    }
+    server, _, err := newPeerConnection()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer server.Close()
+    if err := server.SetRemoteDescription(offer); err != nil {
+        t.Fatal(err)
+    }
+    answer, err := server.CreateAnswer(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    parsed, err := answer.Unmarshal()
+    if err != nil {
+        t.Fatal(err)
+    }
+    var fmtps []string
+    for _, md := range parsed.MediaDescriptions {
+        for _, codec := range mediaCodecs(md) {
+            fmtps = append(fmtps, codec.fmtp["profile-level-id"])
+        }
+    }
+    return fmtps
+}
+
+func TestCheckOfferRejectsH264AboveLevel(t *testing.T) {
+    _, err := codecConfig.checkOffer(publisherOffer(t, h264At("42e034", 102)))
+    if !errors.Is(err, errNoAllowedCodec) {
+        t.Errorf("checkOffer of level 5.2 against level %d = %v, want %v", codecConfig.H264Level, err, errNoAllowedCodec)
+    }
+}
+
+func TestCheckOfferStripsH264AboveLevel(t *testing.T) {
+    offer := publisherOffer(t, h264At("42e034", 102), h264At("42e01f", 106))
+    got := answerCodecs(t, offer)
+    if len(got) != 1 || got[0] != "42e01f" {
+        t.Errorf("answered H.264 profile-level-ids %v, want only 42e01f", got)
+    }
+    if stripped, _ := codecConfig.checkOffer(offer); strings.Contains(stripped.SDP, "42e034") {
+        t.Errorf("checked offer still lists level 5.2:\n%s", stripped.SDP)
+    }
+}
+
+func TestParseCodecPolicy(t *testing.T) {
+    tests := []struct {
+        name     string
+        codecs   string
+        profiles string
+        level    string
+        want     codecPolicy
+        wantErr  bool
+    }{
+        {
+            name:     "defaults",
+            codecs:   "opus,vp8,h264",
+            profiles: "constrained-baseline,baseline,main,high",
+            level:    "3.1",
+            want:     codecConfig,
+        },
+        {
+            name:     "spaces and case",
+            codecs:   " VP9 , Opus",
+            profiles: "High",
+            level:    "4",
+            want:     codecPolicy{Codecs: []string{"vp9", "opus"}, H264Profiles: []string{"high"}, H264Level: 40},
+        },
+        {
+            name:     "highest level",
+            codecs:   "h264",
+            profiles: "main",
+            level:    "6.2",
+            want:     codecPolicy{Codecs: []string{"h264"}, H264Profiles: []string{"main"}, H264Level: 62},
+        },
+        {name: "unknown codec", codecs: "opus,h265", profiles: "main", level: "3.1", wantErr: true},
+        {name: "empty codec", codecs: "opus,,vp8", profiles: "main", level: "3.1", wantErr: true},
+        {name: "unknown profile", codecs: "h264", profiles: "extended", level: "3.1", wantErr: true},
+        {name: "level not a number", codecs: "h264", profiles: "main", level: "high", wantErr: true},
+        {name: "bad minor level", codecs: "h264", profiles: "main", level: "3.x", wantErr: true},
+        {name: "level too low", codecs: "h264", profiles: "main", level: "0.9", wantErr: true},
+        {name: "level too high", codecs: "h264", profiles: "main", level: "7", wantErr: true},
+        {name: "minor level too high", codecs: "h264", profiles: "main", level: "3.10", wantErr: true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := parseCodecPolicy(tt.codecs, tt.profiles, tt.level)
+            if tt.wantErr {
+                if err == nil {
+                    t.Errorf("parseCodecPolicy() = %+v, want an error", got)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("parseCodecPolicy() = %+v, want %+v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestCodecPolicyAllows(t *testing.T) {
+    policy := codecPolicy{Codecs: []string{"opus", "vp8", "h264"}, H264Profiles: []string{"constrained-baseline", "main"}, H264Level: 31}
+
+    tests := []struct {
+        name     string
+        mimeType string
+        fmtp     string
+        want     bool
+    }{
+        {name: "opus", mimeType: "audio/opus", fmtp: "minptime=10;useinbandfec=1", want: true},
+        {name: "mime type case", mimeType: "video/vp8", want: true},
+        {name: "codec not in policy", mimeType: webrtc.MimeTypeVP9, fmtp: "profile-id=0"},
+        {name: "audio codec not in policy", mimeType: webrtc.MimeTypePCMU},
+        {name: "h264 at level", mimeType: webrtc.MimeTypeH264, fmtp: "packetization-mode=1;profile-level-id=42e01f", want: true},
+        {name: "h264 below level", mimeType: webrtc.MimeTypeH264, fmtp: "profile-level-id=4d0015", want: true},
+        {name: "h264 hex case", mimeType: webrtc.MimeTypeH264, fmtp: "profile-level-id=42E01F", want: true},
+        {name: "h264 above level", mimeType: webrtc.MimeTypeH264, fmtp: "packetization-mode=1;profile-level-id=42e020"},
+        {name: "h264 profile not in policy", mimeType: webrtc.MimeTypeH264, fmtp: "profile-level-id=64001f"},
+        {name: "h264 without profile-level-id", mimeType: webrtc.MimeTypeH264, fmtp: "packetization-mode=1"},
+        {name: "h264 short profile-level-id", mimeType: webrtc.MimeTypeH264, fmtp: "profile-level-id=42e0"},
+        {name: "h264 level not hex", mimeType: webrtc.MimeTypeH264, fmtp: "profile-level-id=42e0zz"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := policy.allows(parseCodec(tt.mimeType, tt.fmtp)); got != tt.want {
+                t.Errorf("allows(%s %s) = %v, want %v", tt.mimeType, tt.fmtp, got, tt.want)
+            }
+        })
+    }
+}
+
+// offerSDP returns an offer made of the given media sections.
+func offerSDP(media ...string) webrtc.SessionDescription {
+    lines := []string{"v=0", "o=- 1 2 IN IP4 127.0.0.1", "s=-", "t=0 0"}
+    for _, m := range media {
+        lines = append(lines, strings.Split(m, "\n")...)
+    }
+    return webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: strings.Join(lines, "\r\n") + "\r\n"}
+}
+
+func TestCheckOffer(t *testing.T) {
+    policy := codecPolicy{Codecs: []string{"opus", "vp8", "h264"}, H264Profiles: []string{"constrained-baseline"}, H264Level: 31}
+
+    opus := "m=audio 9 UDP/TLS/RTP/SAVPF 111\na=rtpmap:111 opus/48000/2\na=sendrecv"
+    pcmu := "m=audio 9 UDP/TLS/RTP/SAVPF 0\na=rtpmap:0 PCMU/8000\na=sendrecv"
+    vp8 := "m=video 9 UDP/TLS/RTP/SAVPF 96\na=rtpmap:96 VP8/90000\na=sendonly"
+    vp9 := "m=video 9 UDP/TLS/RTP/SAVPF 98\na=rtpmap:98 VP9/90000\na=sendonly"
+    mixed := strings.Join([]string{
+        "m=video 9 UDP/TLS/RTP/SAVPF 98 99 102 103 96 97",
+        "a=sendonly",
+        "a=rtpmap:98 VP9/90000",
+        "a=rtcp-fb:98 nack",
+        "a=fmtp:98 profile-id=0",
+        "a=rtpmap:99 rtx/90000",
+        "a=fmtp:99 apt=98",
+        "a=rtpmap:102 H264/90000",
+        "a=rtcp-fb:102 nack",
+        "a=fmtp:102 packetization-mode=1;profile-level-id=42e034",
+        "a=rtpmap:103 rtx/90000",
+        "a=fmtp:103 apt=102",
+        "a=rtpmap:96 VP8/90000",
+        "a=rtcp-fb:96 nack",
+        "a=rtpmap:97 rtx/90000",
+        "a=fmtp:97 apt=96",
+    }, "\n")
+
+    tests := []struct {
+        name     string
+        offer    webrtc.SessionDescription
+        want     [][]string
+        stripped bool
+        wantErr  error
+    }{
+        {name: "allowed", offer: offerSDP(opus, vp8), want: [][]string{{"111"}, {"96"}}},
+        {name: "audio not allowed", offer: offerSDP(pcmu, vp8), wantErr: errNoAllowedCodec},
+        {name: "video not allowed", offer: offerSDP(opus, vp9), wantErr: errNoAllowedCodec},
+        {name: "recvonly not checked", offer: offerSDP(strings.Replace(vp9, "sendonly", "recvonly", 1)), want: [][]string{{"98"}}},
+        {name: "inactive not checked", offer: offerSDP(strings.Replace(vp9, "sendonly", "inactive", 1)), want: [][]string{{"98"}}},
+        {name: "rejected m-line not checked", offer: offerSDP(strings.Replace(pcmu, " 9 ", " 0 ", 1)), want: [][]string{{"0"}}},
+        {name: "disallowed stripped with their RTX", offer: offerSDP(opus, mixed), want: [][]string{{"111"}, {"96", "97"}}, stripped: true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := policy.checkOffer(tt.offer)
+            if !errors.Is(err, tt.wantErr) {
+                t.Fatalf("checkOffer() error = %v, want %v", err, tt.wantErr)
+            }
+            if err != nil {
+                return
+            }
+            if !tt.stripped && got.SDP != tt.offer.SDP {
+                t.Errorf("checkOffer() changed an offer with nothing to strip:\n%s", got.SDP)
+            }
+            parsed, err := got.Unmarshal()
+            if err != nil {
+                t.Fatal(err)
+            }
+            var formats [][]string
+            for _, md := range parsed.MediaDescriptions {
+                formats = append(formats, md.MediaName.Formats)
+                for _, attr := range md.Attributes {
+                    switch attr.Key {
+                    case "rtpmap", "fmtp", "rtcp-fb":
+                        if pt, _, _ := strings.Cut(attr.Value, " "); !slices.Contains(md.MediaName.Formats, pt) {
+                            t.Errorf("a=%s:%s left for a stripped payload type", attr.Key, attr.Value)
+                        }
+                    }
+                }
+            }
+            if !reflect.DeepEqual(formats, tt.want) {
+                t.Errorf("checked offer formats = %v, want %v", formats, tt.want)
+            }
+        })
+    }
+}
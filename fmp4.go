@@ -0,0 +1,348 @@
+package main
+
+import (
+    "encoding/binary"
+    "errors"
+
+    "github.com/pion/webrtc/v3"
+)
+
+// Fragmented MP4 (ISO/IEC 14496-12) is written by hand, like WebM: an init
+// segment describing the tracks, then fragments of samples, each a moof box
+// followed by the mdat box holding their data.
+
+// mp4Track is one track of a fragmented MP4 stream.
+type mp4Track struct {
+    id        uint32
+    kind      webrtc.RTPCodecType
+    timescale uint32
+
+    // H.264 tracks are described by their SPS and PPS, from which the
+    // picture size is also read.
+    sps, pps      []byte
+    width, height uint16
+
+    channels uint16
+}
+
+// mp4Sample is one frame of a track, with H.264 NAL units prefixed by
+// their 4-byte length.
+type mp4Sample struct {
+    data     []byte
+    duration uint32
+    keyframe bool
+}
+
+// mp4Run is the samples of one track in a fragment, starting at baseTime
+// in the track's timescale.
+type mp4Run struct {
+    track    *mp4Track
+    baseTime uint64
+    samples  []mp4Sample
+}
+
+func mp4Box(typ string, payload ...[]byte) []byte {
+    size := 8
+    for _, p := range payload {
+        size += len(p)
+    }
+    b := binary.BigEndian.AppendUint32(make([]byte, 0, size), uint32(size))
+    b = append(b, typ...)
+    for _, p := range payload {
+        b = append(b, p...)
+    }
+    return b
+}
+
+func mp4FullBox(typ string, version byte, flags uint32, payload ...[]byte) []byte {
+    header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+    return mp4Box(typ, append([][]byte{header}, payload...)...)
+}
+
+// be builds big-endian fields of a box from 8, 16, 32 and 64-bit values.
+func be(values ...any) []byte {
+    var b []byte
+    for _, v := range values {
+        switch v := v.(type) {
+        case uint8:
+            b = append(b, v)
+        case uint16:
+            b = binary.BigEndian.AppendUint16(b, v)
+        case uint32:
+            b = binary.BigEndian.AppendUint32(b, v)
+        case uint64:
+            b = binary.BigEndian.AppendUint64(b, v)
+        case []byte:
+            b = append(b, v...)
+        case string:
+            b = append(b, v...)
+        }
+    }
+    return b
+}
+
+// mp4Matrix is the identity transformation matrix of mvhd and tkhd.
+var mp4Matrix = be(uint32(0x00010000), uint32(0), uint32(0), uint32(0), uint32(0x00010000), uint32(0), uint32(0), uint32(0), uint32(0x40000000))
+
+// mp4Init returns the init segment of a stream of tracks.
+func mp4Init(tracks []*mp4Track) []byte {
+    ftyp := mp4Box("ftyp", be("iso5", uint32(512), "iso5", "iso6", "mp41"))
+
+    moov := [][]byte{mp4FullBox("mvhd", 0, 0, be(
+        uint32(0), uint32(0), // creation and modification time
+        uint32(1000), uint32(0), // timescale and duration
+        uint32(0x00010000), uint16(0x0100), make([]byte, 10), // rate, volume, reserved
+        mp4Matrix, make([]byte, 24),
+        uint32(len(tracks)+1), // next track ID
+    ))}
+    var trex [][]byte
+    for _, track := range tracks {
+        moov = append(moov, mp4Trak(track))
+        trex = append(trex, mp4FullBox("trex", 0, 0, be(track.id, uint32(1), uint32(0), uint32(0), uint32(0))))
+    }
+    moov = append(moov, mp4Box("mvex", trex...))
+    return append(ftyp, mp4Box("moov", moov...)...)
+}
+
+func mp4Trak(track *mp4Track) []byte {
+    video := track.kind == webrtc.RTPCodecTypeVideo
+    volume, handler, name := uint16(0x0100), "soun", "SoundHandler"
+    header := mp4FullBox("smhd", 0, 0, be(uint16(0), uint16(0)))
+    if video {
+        volume, handler, name = 0, "vide", "VideoHandler"
+        header = mp4FullBox("vmhd", 0, 1, make([]byte, 8))
+    }
+
+    tkhd := mp4FullBox("tkhd", 0, 3, be(
+        uint32(0), uint32(0), track.id, uint32(0), uint32(0), // times, track ID, reserved, duration
+        make([]byte, 8), uint16(0), uint16(0), volume, uint16(0), // reserved, layer, group, volume, reserved
+        mp4Matrix, uint32(track.width)<<16, uint32(track.height)<<16,
+    ))
+    mdhd := mp4FullBox("mdhd", 0, 0, be(uint32(0), uint32(0), track.timescale, uint32(0), uint16(0x55C4), uint16(0))) // language "und"
+    hdlr := mp4FullBox("hdlr", 0, 0, be(uint32(0), handler, make([]byte, 12), name, uint8(0)))
+    dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, be(uint32(1)), mp4FullBox("url ", 0, 1)))
+    stbl := mp4Box("stbl",
+        mp4FullBox("stsd", 0, 0, be(uint32(1)), mp4SampleEntry(track)),
+        mp4FullBox("stts", 0, 0, be(uint32(0))),
+        mp4FullBox("stsc", 0, 0, be(uint32(0))),
+        mp4FullBox("stsz", 0, 0, be(uint32(0), uint32(0))),
+        mp4FullBox("stco", 0, 0, be(uint32(0))),
+    )
+    return mp4Box("trak", tkhd, mp4Box("mdia", mdhd, hdlr, mp4Box("minf", header, dinf, stbl)))
+}
+
+// mp4SampleEntry describes the codec of a track: avc1 for H.264 and Opus
+// for Opus.
+func mp4SampleEntry(track *mp4Track) []byte {
+    if track.kind == webrtc.RTPCodecTypeVideo {
+        avcC := mp4Box("avcC", be(
+            uint8(1), track.sps[1], track.sps[2], track.sps[3], // version, profile, compatibility, level
+            uint8(0xFF), uint8(0xE1), // 4-byte lengths, one SPS
+            uint16(len(track.sps)), track.sps,
+            uint8(1), uint16(len(track.pps)), track.pps,
+        ))
+        return mp4Box("avc1", be(
+            make([]byte, 6), uint16(1), // reserved, data reference index
+            make([]byte, 16), track.width, track.height,
+            uint32(0x00480000), uint32(0x00480000), uint32(0), uint16(1), // resolution, reserved, frame count
+            make([]byte, 32), uint16(0x0018), uint16(0xFFFF), // compressor name, depth
+        ), avcC)
+    }
+
+    // Opus in ISO BMFF, section 4.3.2.
+    dOps := mp4Box("dOps", be(uint8(0), uint8(track.channels), uint16(opusPreSkip), uint32(48000), uint16(0), uint8(0)))
+    return mp4Box("Opus", be(
+        make([]byte, 6), uint16(1), // reserved, data reference index
+        make([]byte, 8), track.channels, uint16(16), uint32(0), // reserved, channels, sample size
+        uint32(48000)<<16,
+    ), dOps)
+}
+
+// Sample flags of trun: keyframes depend on no other sample, other frames
+// do and are not sync samples.
+const (
+    mp4SyncSample    = 0x02000000
+    mp4NonSyncSample = 0x01010000
+)
+
+// mp4Fragment returns a fragment holding runs of samples of one or more
+// tracks.
+func mp4Fragment(sequence uint32, runs []mp4Run) []byte {
+    // Sample data offsets are relative to the start of the moof box, so
+    // work out its size first: 16 bytes of mfhd and, for each track, 64
+    // bytes of boxes plus 12 for each sample.
+    moofSize := 8 + 16
+    for _, run := range runs {
+        moofSize += 64 + 12*len(run.samples)
+    }
+
+    moof := [][]byte{mp4FullBox("mfhd", 0, 0, be(sequence))}
+    var mdat [][]byte
+    offset := moofSize + 8
+    for _, run := range runs {
+        trun := be(uint32(len(run.samples)), uint32(offset))
+        for _, sample := range run.samples {
+            flags := uint32(mp4SyncSample)
+            if !sample.keyframe {
+                flags = mp4NonSyncSample
+            }
+            trun = append(trun, be(sample.duration, uint32(len(sample.data)), flags)...)
+            mdat = append(mdat, sample.data)
+            offset += len(sample.data)
+        }
+        moof = append(moof, mp4Box("traf",
+            mp4FullBox("tfhd", 0, 0x020000, be(run.track.id)), // default-base-is-moof
+            mp4FullBox("tfdt", 1, 0, be(run.baseTime)),
+            mp4FullBox("trun", 0, 0x000701, trun), // data offset, sample durations, sizes and flags
+        ))
+    }
+    return append(mp4Box("moof", moof...), mp4Box("mdat", mdat...)...)
+}
+
+var errBadSPS = errors.New("invalid H.264 SPS")
+
+// h264PictureSize reads the picture size from an H.264 SPS NAL unit (ITU-T
+// H.264 section 7.3.2.1.1).
+func h264PictureSize(sps []byte) (width, height uint16, err error) {
+    if len(sps) < 4 {
+        return 0, 0, errBadSPS
+    }
+    // Drop the emulation prevention bytes that follow each 00 00.
+    rbsp := make([]byte, 0, len(sps))
+    zeros := 0
+    for _, c := range sps[1:] {
+        if zeros >= 2 && c == 3 {
+            zeros = 0
+            continue
+        }
+        if c == 0 {
+            zeros++
+        } else {
+            zeros = 0
+        }
+        rbsp = append(rbsp, c)
+    }
+
+    r := &bitReader{data: rbsp}
+    profile := r.bits(8)
+    r.bits(16) // constraint flags and level
+    r.ue()     // seq_parameter_set_id
+
+    chromaFormat := uint32(1)
+    switch profile {
+    case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+        chromaFormat = r.ue()
+        if chromaFormat == 3 {
+            r.bits(1) // separate_colour_plane_flag
+        }
+        r.ue()    // bit_depth_luma_minus8
+        r.ue()    // bit_depth_chroma_minus8
+        r.bits(1) // qpprime_y_zero_transform_bypass_flag
+        if r.bits(1) == 1 {
+            lists := 8
+            if chromaFormat == 3 {
+                lists = 12
+            }
+            for i := 0; i < lists; i++ {
+                if r.bits(1) == 0 {
+                    continue
+                }
+                size := 16
+                if i >= 6 {
+                    size = 64
+                }
+                last, next := int32(8), int32(8)
+                for j := 0; j < size; j++ {
+                    if next != 0 {
+                        next = (last + r.se() + 256) % 256
+                    }
+                    if next != 0 {
+                        last = next
+                    }
+                }
+            }
+        }
+    }
+
+    r.ue() // log2_max_frame_num_minus4
+    switch r.ue() { // pic_order_cnt_type
+    case 0:
+        r.ue() // log2_max_pic_order_cnt_lsb_minus4
+    case 1:
+        r.bits(1) // delta_pic_order_always_zero_flag
+        r.se()    // offset_for_non_ref_pic
+        r.se()    // offset_for_top_to_bottom_field
+        for n := r.ue(); n > 0 && !r.failed; n-- {
+            r.se()
+        }
+    }
+    r.ue()    // max_num_ref_frames
+    r.bits(1) // gaps_in_frame_num_value_allowed_flag
+    widthMBs := r.ue() + 1
+    heightMapUnits := r.ue() + 1
+    frameMBsOnly := r.bits(1)
+    if frameMBsOnly == 0 {
+        r.bits(1) // mb_adaptive_frame_field_flag
+    }
+    r.bits(1) // direct_8x8_inference_flag
+
+    w := widthMBs * 16
+    h := (2 - frameMBsOnly) * heightMapUnits * 16
+    if r.bits(1) == 1 {
+        left, right, top, bottom := r.ue(), r.ue(), r.ue(), r.ue()
+        cropX, cropY := uint32(1), 2-frameMBsOnly
+        if chromaFormat == 1 || chromaFormat == 2 {
+            cropX = 2
+        }
+        if chromaFormat == 1 {
+            cropY *= 2
+        }
+        w -= (left + right) * cropX
+        h -= (top + bottom) * cropY
+    }
+    if r.failed || w == 0 || h == 0 || w > 0xFFFF || h > 0xFFFF {
+        return 0, 0, errBadSPS
+    }
+    return uint16(w), uint16(h), nil
+}
+
+// bitReader reads the bits and Exp-Golomb codes of an H.264 RBSP. Reading
+// past the end sets failed and returns zeros.
+type bitReader struct {
+    data   []byte
+    pos    int
+    failed bool
+}
+
+func (r *bitReader) bits(n int) uint32 {
+    var v uint32
+    for ; n > 0; n-- {
+        if r.pos >= len(r.data)*8 {
+            r.failed = true
+            return 0
+        }
+        v = v<<1 | uint32(r.data[r.pos/8]>>(7-r.pos%8))&1
+        r.pos++
+    }
+    return v
+}
+
+func (r *bitReader) ue() uint32 {
+    zeros := 0
+    for r.bits(1) == 0 {
+        if r.failed || zeros == 31 {
+            r.failed = true
+            return 0
+        }
+        zeros++
+    }
+    return 1<<zeros - 1 + r.bits(zeros)
+}
+
+func (r *bitReader) se() int32 {
+    v := r.ue()
+    if v&1 == 1 {
+        return int32(v+1) / 2
+    }
+    return -int32(v / 2)
+}
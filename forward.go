@@ -0,0 +1,135 @@
+package main
+
+import (
+    "log"
+    "strings"
+    "time"
+
+    "github.com/pion/webrtc/v3"
+)
+
+// trackKey identifies a published track within a room. Publishers commonly
+// reuse track IDs such as "video", so the publisher and stream IDs are part
+// of the key.
+func trackKey(publisherID string, track *webrtc.TrackRemote) string {
+    return publisherID + "/" + track.StreamID() + "/" + track.ID()
+}
+
+// forwardLayer reads RTP from one layer of p's published track and fans it
+// out to the track's subscribers and recorders. When the track's last layer
+// ends the track is unpublished, which removes it from its subscribers.
+func (p *Peer) forwardLayer(pt *PublishedTrack, layer *simulcastLayer) {
+    mimeType := pt.Remote.Codec().MimeType
+    audio := pt.Remote.Kind() == webrtc.RTPCodecTypeAudio
+    opus := strings.EqualFold(mimeType, webrtc.MimeTypeOpus)
+    audioLevelID := pt.audioLevelExtensionID()
+
+    var windowBytes uint64
+    windowStart := time.Now()
+
+    for {
+        // Each packet is read into a pooled buffer that is shared by every
+        // send queue it ends up in, since it may sit in the queues of slow
+        // subscribers while the next one is read.
+        buf := getPacketBuffer()
+        n, _, err := layer.Remote.Read(buf.data)
+        if err != nil {
+            buf.release()
+            log.Printf("[%s] RTP read error: %v", p.ID, err)
+            break
+        }
+        if err := buf.unmarshal(n); err != nil {
+            buf.release()
+            continue
+        }
+        layer.history.push(buf.pkt.SequenceNumber, buf.raw())
+        keyframe := isKeyframe(mimeType, buf.pkt.Payload)
+        if audio {
+            p.observeAudio(&buf.pkt, audioLevelID, opus)
+        }
+
+        windowBytes += uint64(n)
+        if elapsed := time.Since(windowStart); elapsed >= time.Second {
+            layer.bitrate.Store(uint64(float64(windowBytes*8) / elapsed.Seconds()))
+            windowBytes = 0
+            windowStart = time.Now()
+        }
+
+        pt.fanOut(layer.RID, buf, keyframe)
+        pt.record(layer.RID, buf, keyframe)
+        buf.release()
+    }
+
+    if pt.removeLayer(layer) > 0 {
+        return
+    }
+
+    p.mu.Lock()
+    delete(p.InTracks, pt.Key)
+    p.mu.Unlock()
+
+    p.Room.unpublish(pt)
+}
+
+// fanOut queues a packet from one layer of pt for every subscriber that
+// wants that layer, each queue holding its own reference to buf. It never
+// blocks on a write or takes a subscriber's lock, so a slow or busy
+// subscriber cannot hold up the publisher's read loop.
+func (pt *PublishedTrack) fanOut(rid string, buf *packetBuffer, keyframe bool) {
+    hasKeyframes := pt.Remote.Kind() == webrtc.RTPCodecTypeVideo
+    for _, out := range pt.subscriberList() {
+        if !out.wants(rid) {
+            continue
+        }
+
+        buf.retain()
+        if out.queue.push(queuedPacket{rid: rid, buf: buf, keyframe: keyframe}, hasKeyframes) {
+            pt.requestKeyframe(rid, false)
+        }
+    }
+}
+
+// addForwardedTrack creates p's outbound copy of a published track and
+// triggers renegotiation. The original stream ID is kept so clients can tell
+// which participant a track belongs to, and packets are sent with the
+// payload types and header extension IDs p negotiated. Callers must hold
+// p.mu.
+func (p *Peer) addForwardedTrack(pt *PublishedTrack) (*ForwardedTrack, error) {
+    local := newForwardTrack(pt.Remote.Codec().RTPCodecCapability, pt.Receiver.GetParameters(), pt.Remote.ID(), pt.Remote.StreamID(), pt.Remote.Kind())
+
+    // AddTrack would reuse the subscriber's own receiving transceiver, whose
+    // m-line may describe its simulcast layers; a sendonly transceiver of
+    // our own keeps the forwarded SSRC declared in the offer.
+    transceiver, err := p.PC.AddTransceiverFromTrack(local, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+    if err != nil {
+        return nil, err
+    }
+    sender := transceiver.Sender()
+
+    out := &ForwardedTrack{
+        Key:         pt.Key,
+        PublisherID: pt.Publisher.ID,
+        Published:   pt,
+        Subscriber:  p,
+        Track:       local,
+        Sender:      sender,
+        queue:       newSendQueue(sendQueueSize, sendQueuePolicy),
+    }
+    out.syncFilter()
+    p.OutTracks[pt.Key] = out
+    pt.addSubscriber(out)
+    go p.readRTCP(out)
+    go p.writeLoop(out)
+
+    // Start on the best layer available; automatic selection steps down
+    // from there if the subscriber can't keep up.
+    if layers := pt.Layers(); len(layers) > 0 {
+        out.setTargetLayer(layers[len(layers)-1].RID)
+    }
+    p.applyLastN(p.Room.speakers.ranking())
+    log.Printf("➕ Forwarding %s to %s", pt.Key, p.ID)
+
+    // Trigger renegotiation
+    go p.renegotiate()
+    return out, nil
+}
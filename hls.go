@@ -0,0 +1,860 @@
+package main
+
+import (
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "math"
+    "net/http"
+    "net/url"
+    "path"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/pion/rtp"
+    "github.com/pion/rtp/codecs"
+    "github.com/pion/webrtc/v3"
+    "github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+// An HLS stream repackages one publisher's H.264 video and Opus audio as
+// fMP4 segments for viewers that can't use WebRTC, with LL-HLS parts so they
+// can follow closely. Segments are kept in memory for the playlist's
+// sliding window and served from the HTTP server. Like a recording, the
+// stream taps the publisher's tracks through queues of its own, so WebRTC
+// subscribers never wait for it; it only asks the publisher for a keyframe
+// when a segment is due, since WebRTC encoders don't send them unasked.
+
+// Defaults of HLS streams, set from the -hls-* flags. A start request may
+// override each of them.
+var (
+    hlsSegmentDuration = 2 * time.Second
+    hlsPartDuration    = 500 * time.Millisecond
+    hlsWindow          = 6
+)
+
+var (
+    errHLSActive    = errors.New("already streaming over HLS")
+    errNotStreaming = errors.New("not streaming over HLS")
+    errNoHLSTracks  = errors.New("publisher has no H.264 or Opus track")
+
+    errHLSNotStarted   = errors.New("HLS stream not started yet")
+    errSegmentNotFound = errors.New("segment not found")
+    errPartNotFound    = errors.New("part not found")
+    errHLSFileNotFound = errors.New("no such HLS file")
+)
+
+const hlsPlaylistType = "application/vnd.apple.mpegurl"
+
+// hlsRequest is the optional body of a request starting an HLS stream.
+// PartMS 0 turns LL-HLS parts off.
+type hlsRequest struct {
+    SegmentMS int `json:"segment_ms"`
+    PartMS    int `json:"part_ms"`
+    Window    int `json:"window"`
+}
+
+func defaultHLSRequest() hlsRequest {
+    return hlsRequest{
+        SegmentMS: int(hlsSegmentDuration / time.Millisecond),
+        PartMS:    int(hlsPartDuration / time.Millisecond),
+        Window:    hlsWindow,
+    }
+}
+
+func (req hlsRequest) validate() error {
+    switch {
+    case req.SegmentMS <= 0:
+        return errors.New("HLS segment duration must be positive")
+    case req.PartMS < 0 || req.PartMS >= req.SegmentMS:
+        return errors.New("HLS part duration must be shorter than the segment duration")
+    case req.Window < 1:
+        return errors.New("HLS window must hold at least one segment")
+    }
+    return nil
+}
+
+// HLSInfo describes an HLS stream, as returned by the routes starting and
+// stopping it.
+type HLSInfo struct {
+    PublisherID string   `json:"publisher_id"`
+    Playlist    string   `json:"playlist"`
+    SegmentMS   int      `json:"segment_ms"`
+    PartMS      int      `json:"part_ms"`
+    Window      int      `json:"window"`
+    Tracks      []string `json:"tracks"`
+}
+
+// hlsStream is the HLS stream of one publisher.
+type hlsStream struct {
+    Room        *Room
+    PublisherID string
+
+    segmentDuration time.Duration
+    partDuration    time.Duration
+    window          int
+
+    mu     sync.Mutex
+    tracks []*hlsTrack
+    taps   map[string]*trackRecorder
+    clock  senderClock
+    ended  bool
+
+    // The stream starts at the first video keyframe, or the first audio
+    // frame if there is no video; zero is that frame's wall-clock time.
+    started bool
+    zero    time.Time
+    init    []byte
+
+    fragments  uint32
+    segments   []*hlsSegment
+    current    *hlsSegment
+    partStart  time.Duration
+    maxSegment time.Duration
+
+    keyframeRequested bool
+
+    // updated is closed and replaced whenever a part is added, waking
+    // the requests blocked waiting for it.
+    updated chan struct{}
+}
+
+// hlsTrack is a track of the stream. Like a WebM track, it carries on from
+// a published track replaced by renegotiation.
+type hlsTrack struct {
+    mp4Track
+    sources int
+
+    // source is the source the track's timeline is following, and dts the
+    // decode time of its pending frame, in the track's timescale.
+    source  *hlsSource
+    started bool
+    lastTS  uint32
+    dts     int64
+
+    // A frame's duration is only known once the next one arrives, so the
+    // newest frame waits in pending; samples are those ready for the next
+    // part, starting at runStart.
+    pending  *mp4Sample
+    samples  []mp4Sample
+    runStart int64
+    interval time.Duration
+}
+
+// hlsSegment is a segment of the stream, made of one fragment per part.
+type hlsSegment struct {
+    seq      uint64
+    start    time.Duration
+    duration time.Duration
+    parts    []hlsPart
+    data     []byte
+}
+
+type hlsPart struct {
+    data        []byte
+    duration    time.Duration
+    independent bool
+}
+
+// hlsSource is one published track feeding an hlsStream, as the writer of
+// the track's tap.
+type hlsSource struct {
+    s       *hlsStream
+    track   *hlsTrack
+    pt      *PublishedTrack
+    layer   *simulcastLayer
+    clock   uint32
+    builder *samplebuilder.SampleBuilder
+
+    base   time.Time
+    baseTS uint32
+    based  bool
+}
+
+// startHLS starts streaming a publisher's tracks over HLS, including
+// tracks it publishes later to replace them.
+func (room *Room) startHLS(publisherID string, req hlsRequest) (*hlsStream, error) {
+    s := &hlsStream{
+        Room:            room,
+        PublisherID:     publisherID,
+        segmentDuration: time.Duration(req.SegmentMS) * time.Millisecond,
+        partDuration:    time.Duration(req.PartMS) * time.Millisecond,
+        window:          req.Window,
+        taps:            make(map[string]*trackRecorder),
+        updated:         make(chan struct{}),
+    }
+
+    room.mu.Lock()
+    if room.peers[publisherID] == nil {
+        room.mu.Unlock()
+        return nil, errPeerNotFound
+    }
+    if room.hls[publisherID] != nil {
+        room.mu.Unlock()
+        return nil, errHLSActive
+    }
+    room.hls[publisherID] = s
+    published := room.publishedTracks()
+    room.mu.Unlock()
+
+    for _, pt := range published {
+        s.add(pt)
+    }
+    if len(s.Info("").Tracks) == 0 {
+        room.stopHLS(publisherID)
+        return nil, errNoHLSTracks
+    }
+    log.Printf("📺 HLS stream of %s started", publisherID)
+    return s, nil
+}
+
+// stopHLS stops a publisher's HLS stream.
+func (room *Room) stopHLS(publisherID string) (*hlsStream, error) {
+    room.mu.Lock()
+    s := room.hls[publisherID]
+    delete(room.hls, publisherID)
+    room.mu.Unlock()
+
+    if s == nil {
+        return nil, errNotStreaming
+    }
+    s.stop()
+    return s, nil
+}
+
+// hlsStream returns a publisher's HLS stream, or nil if it has none.
+func (room *Room) hlsStream(publisherID string) *hlsStream {
+    room.mu.RLock()
+    defer room.mu.RUnlock()
+    return room.hls[publisherID]
+}
+
+// streamTrack adds a newly published track to its publisher's HLS stream.
+func (room *Room) streamTrack(pt *PublishedTrack) {
+    if s := room.hlsStream(pt.Publisher.ID); s != nil {
+        s.add(pt)
+    }
+}
+
+// stopStreamingTrack removes an unpublished track from its publisher's HLS
+// stream.
+func (room *Room) stopStreamingTrack(pt *PublishedTrack) {
+    if s := room.hlsStream(pt.Publisher.ID); s != nil {
+        s.remove(pt)
+    }
+}
+
+// add starts streaming a published track of the stream's publisher, unless
+// it can't go in the stream: the stream has one H.264 video and one Opus
+// audio track, fixed once it has started.
+func (s *hlsStream) add(pt *PublishedTrack) {
+    if pt.Publisher.ID != s.PublisherID {
+        return
+    }
+    codec := pt.Remote.Codec()
+    kind := pt.Remote.Kind()
+    switch strings.ToLower(codec.MimeType) {
+    case strings.ToLower(webrtc.MimeTypeH264), strings.ToLower(webrtc.MimeTypeOpus):
+    default:
+        log.Printf("⚠️ HLS %s: can't stream %s in %s", s.PublisherID, pt.Key, codec.MimeType)
+        return
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if s.ended || s.taps[pt.Key] != nil || pt.ended.Load() {
+        return
+    }
+    var track *hlsTrack
+    for _, t := range s.tracks {
+        if t.kind == kind {
+            track = t
+        }
+    }
+    switch {
+    case track != nil && track.sources > 0:
+        log.Printf("⚠️ HLS %s: already streaming a %s track, skipping %s", s.PublisherID, kind, pt.Key)
+        return
+    case track == nil && s.started:
+        log.Printf("⚠️ HLS %s: can't add %s once the stream has started", s.PublisherID, pt.Key)
+        return
+    case track == nil:
+        track = &hlsTrack{mp4Track: mp4Track{
+            id:        uint32(len(s.tracks) + 1),
+            kind:      kind,
+            timescale: codec.ClockRate,
+            channels:  max(codec.Channels, 1),
+        }}
+        if kind == webrtc.RTPCodecTypeVideo {
+            // Until the SPS says otherwise.
+            track.width, track.height = 640, 480
+        }
+        s.tracks = append(s.tracks, track)
+    }
+    track.sources++
+
+    tap := &trackRecorder{
+        pt:    pt,
+        queue: newSendQueue(recordQueueSize, DropOldest),
+        done:  make(chan struct{}),
+    }
+    if layers := pt.Layers(); len(layers) > 0 {
+        tap.rid = layers[len(layers)-1].RID
+    }
+    src := &hlsSource{s: s, track: track, pt: pt, layer: pt.layer(tap.rid), clock: codec.ClockRate}
+    var depacketizer rtp.Depacketizer = &codecs.OpusPacket{}
+    if kind == webrtc.RTPCodecTypeVideo {
+        depacketizer = &codecs.H264Packet{IsAVC: true}
+    }
+    src.builder = samplebuilder.New(512, depacketizer, codec.ClockRate, samplebuilder.WithMaxTimeDelay(webmJitterLatency))
+    tap.writer = src
+
+    s.taps[pt.Key] = tap
+    go tap.run("HLS " + s.PublisherID)
+    pt.addRecorder(tap)
+    if kind == webrtc.RTPCodecTypeVideo {
+        pt.requestKeyframe(tap.rid, false)
+    }
+}
+
+// remove stops streaming an unpublished track. A track replacing it
+// carries on in its place.
+func (s *hlsStream) remove(pt *PublishedTrack) {
+    s.mu.Lock()
+    tap := s.taps[pt.Key]
+    delete(s.taps, pt.Key)
+    s.mu.Unlock()
+
+    if tap != nil {
+        tap.stop()
+    }
+}
+
+// stop ends the stream and stops its taps.
+func (s *hlsStream) stop() {
+    s.mu.Lock()
+    s.ended = true
+    taps := s.taps
+    s.taps = make(map[string]*trackRecorder)
+    s.notify()
+    s.mu.Unlock()
+
+    for _, tap := range taps {
+        tap.stop()
+    }
+    log.Printf("⏹️ HLS stream of %s stopped", s.PublisherID)
+}
+
+// Info describes the stream, with the URL of its playlist.
+func (s *hlsStream) Info(playlist string) HLSInfo {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    info := HLSInfo{
+        PublisherID: s.PublisherID,
+        Playlist:    playlist,
+        SegmentMS:   int(s.segmentDuration / time.Millisecond),
+        PartMS:      int(s.partDuration / time.Millisecond),
+        Window:      s.window,
+        Tracks:      []string{},
+    }
+    for key := range s.taps {
+        info.Tracks = append(info.Tracks, key)
+    }
+    sort.Strings(info.Tracks)
+    return info
+}
+
+// WriteRTP adds a packet to the source's jitter buffer and passes on the
+// frames it completes.
+func (src *hlsSource) WriteRTP(pkt *rtp.Packet) error {
+    src.builder.Push(keepPacket(pkt))
+    for sample := src.builder.Pop(); sample != nil; sample = src.builder.Pop() {
+        src.s.push(src, sample.PacketTimestamp, sample.Data)
+    }
+    return nil
+}
+
+// Close detaches the source from its track.
+func (src *hlsSource) Close() error {
+    src.s.mu.Lock()
+    defer src.s.mu.Unlock()
+
+    if src.track != nil {
+        src.track.sources--
+        src.track = nil
+    }
+    return nil
+}
+
+// h264AccessUnit reads the NAL units of an access unit in AVC format,
+// dropping access unit delimiters. It reports whether the unit holds an IDR
+// slice, and returns the last SPS and PPS in it.
+func h264AccessUnit(data []byte) (au []byte, keyframe bool, sps, pps []byte) {
+    au = make([]byte, 0, len(data))
+    for len(data) > 4 {
+        size := int(binary.BigEndian.Uint32(data))
+        if size == 0 || size > len(data)-4 {
+            break
+        }
+        nalu := data[:4+size]
+        data = data[4+size:]
+
+        switch nalu[4] & 0x1F {
+        case h264NALUTypeAUD:
+            continue
+        case h264NALUTypeIDR:
+            keyframe = true
+        case h264NALUTypeSPS:
+            sps = nalu[4:]
+        case h264NALUTypePPS:
+            pps = nalu[4:]
+        }
+        au = append(au, nalu...)
+    }
+    return au, keyframe, sps, pps
+}
+
+// push adds a complete frame to its track, and closes the current part or
+// segment when the lead track, the video if there is one, says it is due.
+func (s *hlsStream) push(src *hlsSource, ts uint32, data []byte) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    track := src.track
+    if s.ended || track == nil {
+        return
+    }
+    if !src.based {
+        src.base, src.baseTS, src.based = time.Now(), ts, true
+    }
+
+    video := track.kind == webrtc.RTPCodecTypeVideo
+    keyframe := true
+    if video {
+        var sps, pps []byte
+        data, keyframe, sps, pps = h264AccessUnit(data)
+        if sps != nil && !s.started {
+            track.sps = sps
+            if w, h, err := h264PictureSize(sps); err == nil {
+                track.width, track.height = w, h
+            }
+        }
+        if pps != nil && !s.started {
+            track.pps = pps
+        }
+        // A track, or the one replacing it, starts at a keyframe.
+        if (!track.started || track.source != src) && (!keyframe || track.sps == nil || track.pps == nil) {
+            return
+        }
+    }
+
+    at := s.clock.at(src.layer, src.clock, ts, src.base, src.baseTS)
+    if !s.started {
+        if s.lead().kind != track.kind {
+            return
+        }
+        s.start(at)
+    }
+
+    var dts int64
+    if !track.started || track.source != src {
+        // Place the first frame of a source on the stream's timeline; after
+        // that, frames follow on from its RTP timestamps.
+        dts = max(int64(at.Sub(s.zero))*int64(track.timescale)/int64(time.Second), 0)
+        if track.started {
+            dts = max(dts, track.dts+1)
+        }
+        track.started, track.source = true, src
+    } else {
+        dts = track.dts + max(int64(int32(ts-track.lastTS)), 1)
+    }
+    track.lastTS = ts
+
+    if track.pending != nil {
+        track.pending.duration = uint32(dts - track.dts)
+        track.interval = time.Duration(dts-track.dts) * time.Second / time.Duration(track.timescale)
+        if len(track.samples) == 0 {
+            track.runStart = track.dts
+        }
+        track.samples = append(track.samples, *track.pending)
+    }
+    track.pending = &mp4Sample{data: data, keyframe: keyframe}
+    track.dts = dts
+
+    if track != s.lead() {
+        return
+    }
+    now := time.Duration(float64(dts) / float64(track.timescale) * float64(time.Second))
+
+    // Segments start at keyframes, which are asked for a little before the
+    // segment is due, as they take a round trip to arrive. Audio can be cut
+    // anywhere.
+    due := s.segmentDuration
+    if video {
+        due -= min(keyframeRequestInterval, s.segmentDuration/2)
+    }
+    if now-s.current.start >= due {
+        if keyframe || !video {
+            s.flushPart(now)
+            s.closeSegment(now)
+            return
+        }
+        if !s.keyframeRequested {
+            s.keyframeRequested = true
+            src.pt.requestKeyframe(src.layer.RID, false)
+        }
+    }
+    // Parts must not exceed their target, so close one when the frame
+    // after this would.
+    if s.partDuration > 0 && now+track.interval-s.partStart > s.partDuration {
+        s.flushPart(now)
+    }
+}
+
+// lead returns the track whose frames decide when parts and segments end.
+// Callers must hold s.mu.
+func (s *hlsStream) lead() *hlsTrack {
+    for _, track := range s.tracks {
+        if track.kind == webrtc.RTPCodecTypeVideo {
+            return track
+        }
+    }
+    return s.tracks[0]
+}
+
+// start writes the init segment and opens the first segment. Callers must
+// hold s.mu.
+func (s *hlsStream) start(at time.Time) {
+    s.started = true
+    s.zero = at
+    var tracks []*mp4Track
+    for _, track := range s.tracks {
+        tracks = append(tracks, &track.mp4Track)
+    }
+    s.init = mp4Init(tracks)
+    s.current = &hlsSegment{}
+    s.notify()
+}
+
+// flushPart writes the frames ready on every track as the next part of the
+// current segment. Callers must hold s.mu.
+func (s *hlsStream) flushPart(now time.Duration) {
+    var runs []mp4Run
+    independent := s.lead().kind != webrtc.RTPCodecTypeVideo
+    for _, track := range s.tracks {
+        if len(track.samples) == 0 {
+            continue
+        }
+        runs = append(runs, mp4Run{track: &track.mp4Track, baseTime: uint64(track.runStart), samples: track.samples})
+        if track.kind == webrtc.RTPCodecTypeVideo {
+            independent = track.samples[0].keyframe
+        }
+        track.samples = nil
+    }
+    if len(runs) == 0 {
+        return
+    }
+
+    s.fragments++
+    s.current.parts = append(s.current.parts, hlsPart{
+        data:        mp4Fragment(s.fragments, runs),
+        duration:    now - s.partStart,
+        independent: independent,
+    })
+    s.partStart = now
+    s.notify()
+}
+
+// closeSegment ends the current segment and drops the oldest once the
+// window is full. Callers must hold s.mu.
+func (s *hlsStream) closeSegment(now time.Duration) {
+    seg := s.current
+    seg.duration = now - seg.start
+    for _, part := range seg.parts {
+        seg.data = append(seg.data, part.data...)
+    }
+    s.maxSegment = max(s.maxSegment, seg.duration)
+    s.segments = append(s.segments, seg)
+    if len(s.segments) > s.window {
+        s.segments = append([]*hlsSegment(nil), s.segments[len(s.segments)-s.window:]...)
+    }
+    s.current = &hlsSegment{seq: seg.seq + 1, start: now}
+    s.partStart = now
+    s.keyframeRequested = false
+    s.notify()
+}
+
+// notify wakes the requests waiting for the stream to change. Callers must
+// hold s.mu.
+func (s *hlsStream) notify() {
+    close(s.updated)
+    s.updated = make(chan struct{})
+}
+
+// available reports whether a part of a segment, or the whole segment if
+// part is negative, has been written. Callers must hold s.mu.
+func (s *hlsStream) available(msn uint64, part int) bool {
+    switch {
+    case s.current == nil:
+        return false
+    case msn < s.current.seq:
+        return true
+    }
+    return msn == s.current.seq && part >= 0 && part < len(s.current.parts)
+}
+
+// wait blocks until available(msn, part) holds, the stream ends or timeout
+// passes. Callers must hold s.mu, which is released while waiting.
+func (s *hlsStream) wait(msn uint64, part int, timeout time.Duration) {
+    deadline := time.After(timeout)
+    for !s.ended && !s.available(msn, part) {
+        updated := s.updated
+        s.mu.Unlock()
+        select {
+        case <-updated:
+        case <-deadline:
+            s.mu.Lock()
+            return
+        }
+        s.mu.Lock()
+    }
+}
+
+// tokenQuery returns the ?token= a playlist was fetched with, if any, for
+// the URIs it lists: players that can't send an Authorization header need
+// it on every file.
+func tokenQuery(query url.Values) string {
+    if token := query.Get("token"); token != "" {
+        return "?" + url.Values{"token": {token}}.Encode()
+    }
+    return ""
+}
+
+// playlist renders the media playlist, with suffix appended to every URI.
+// The parts of the last two segments and of the current one are listed, as
+// LL-HLS clients only need the recent ones. Callers must hold s.mu.
+func (s *hlsStream) playlist(suffix string) string {
+    var b strings.Builder
+    version := 7
+    if s.partDuration > 0 {
+        version = 9
+    }
+    target := max(s.segmentDuration, s.maxSegment)
+    fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:%d\n#EXT-X-TARGETDURATION:%d\n", version, int(math.Ceil(target.Seconds())))
+    if s.partDuration > 0 {
+        fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*s.partDuration.Seconds())
+        fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", s.partDuration.Seconds())
+    }
+    first := s.current.seq
+    if len(s.segments) > 0 {
+        first = s.segments[0].seq
+    }
+    fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n#EXT-X-INDEPENDENT-SEGMENTS\n#EXT-X-MAP:URI=\"init.mp4%s\"\n", first, suffix)
+
+    writeParts := func(seg *hlsSegment) {
+        for i, part := range seg.parts {
+            fmt.Fprintf(&b, "#EXT-X-PART:DURATION=%.3f,URI=\"part%d.%d.m4s%s\"", part.duration.Seconds(), seg.seq, i, suffix)
+            if part.independent {
+                b.WriteString(",INDEPENDENT=YES")
+            }
+            b.WriteString("\n")
+        }
+    }
+    for i, seg := range s.segments {
+        if s.partDuration > 0 && i >= len(s.segments)-2 {
+            writeParts(seg)
+        }
+        fmt.Fprintf(&b, "#EXTINF:%.3f,\nseg%d.m4s%s\n", seg.duration.Seconds(), seg.seq, suffix)
+    }
+    if s.ended {
+        b.WriteString("#EXT-X-ENDLIST\n")
+    } else if s.partDuration > 0 {
+        writeParts(s.current)
+        fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part%d.%d.m4s%s\"\n", s.current.seq, len(s.current.parts), suffix)
+    }
+    return b.String()
+}
+
+// segment returns a complete segment in the window, or nil.
+func (s *hlsStream) segment(seq uint64) *hlsSegment {
+    for _, seg := range s.segments {
+        if seg.seq == seq {
+            return seg
+        }
+    }
+    if s.current != nil && s.current.seq == seq {
+        return s.current
+    }
+    return nil
+}
+
+// parseHLSName reads the numbers of a segment or part file name, like
+// seg12.m4s or part12.3.m4s.
+func parseHLSName(name, prefix string) ([]uint64, bool) {
+    name, ok := strings.CutPrefix(name, prefix)
+    if !ok {
+        return nil, false
+    }
+    name, ok = strings.CutSuffix(name, ".m4s")
+    if !ok {
+        return nil, false
+    }
+    var numbers []uint64
+    for _, field := range strings.Split(name, ".") {
+        n, err := strconv.ParseUint(field, 10, 32)
+        if err != nil {
+            return nil, false
+        }
+        numbers = append(numbers, n)
+    }
+    return numbers, true
+}
+
+// hlsHandler starts or stops the HLS stream of the publisher named by the
+// {peer} path value, and describes it.
+func hlsHandler(start bool) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if !authorizeManager(w, r) {
+            return
+        }
+        room := rooms.get(roomID(r))
+        if room == nil {
+            http.Error(w, "Room not found", http.StatusNotFound)
+            return
+        }
+
+        publisherID := r.PathValue("peer")
+        var s *hlsStream
+        var err error
+        if start {
+            req := defaultHLSRequest()
+            if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+                http.Error(w, "Invalid HLS request", http.StatusBadRequest)
+                return
+            }
+            if err := req.validate(); err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+            }
+            s, err = room.startHLS(publisherID, req)
+        } else {
+            s, err = room.stopHLS(publisherID)
+        }
+        switch {
+        case errors.Is(err, errPeerNotFound), errors.Is(err, errNotStreaming):
+            http.Error(w, err.Error(), http.StatusNotFound)
+            return
+        case errors.Is(err, errHLSActive):
+            http.Error(w, err.Error(), http.StatusConflict)
+            return
+        case errors.Is(err, errNoHLSTracks):
+            http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+            return
+        case err != nil:
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        json.NewEncoder(w).Encode(s.Info(path.Join(path.Dir(r.URL.Path), "index.m3u8")))
+    }
+}
+
+// hlsFileHandler serves the playlist, init segment, segments and parts of
+// a publisher's HLS stream to players with a token for the room. Playlist
+// requests with _HLS_msn, and requests for parts not written yet, block
+// until they are available, as LL-HLS clients expect.
+func hlsFileHandler(w http.ResponseWriter, r *http.Request) {
+    // Players are usually served from another origin.
+    w.Header().Set("Access-Control-Allow-Origin", "*")
+    if _, ok := authorize(w, r); !ok {
+        return
+    }
+    room := rooms.get(roomID(r))
+    if room == nil {
+        http.Error(w, "Room not found", http.StatusNotFound)
+        return
+    }
+    s := room.hlsStream(r.PathValue("peer"))
+    if s == nil {
+        http.Error(w, errNotStreaming.Error(), http.StatusNotFound)
+        return
+    }
+    // The file is picked under the lock but written without it, so slow
+    // players don't hold up the stream. Written segments and parts are never
+    // changed, and playlists are rendered to a string.
+    s.mu.Lock()
+    contentType, data, err := s.file(r.PathValue("file"), r.URL.Query())
+    s.mu.Unlock()
+    if errors.Is(err, errHLSNotStarted) {
+        http.Error(w, err.Error(), http.StatusServiceUnavailable)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusNotFound)
+        return
+    }
+    w.Header().Set("Content-Type", contentType)
+    if contentType == hlsPlaylistType {
+        w.Header().Set("Cache-Control", "no-cache")
+    }
+    w.Write(data)
+}
+
+// file returns the content type and contents of one of the stream's files,
+// waiting for it as hlsFileHandler describes. Callers must hold s.mu, which
+// is released while waiting.
+func (s *hlsStream) file(file string, query url.Values) (string, []byte, error) {
+    timeout := 3 * s.segmentDuration
+    if !s.started {
+        s.wait(0, 0, timeout)
+        if !s.started {
+            return "", nil, errHLSNotStarted
+        }
+    }
+
+    switch {
+    case file == "index.m3u8":
+        if msn, err := strconv.ParseUint(query.Get("_HLS_msn"), 10, 64); err == nil && s.partDuration > 0 {
+            part := -1
+            if p, err := strconv.Atoi(query.Get("_HLS_part")); err == nil {
+                part = p
+            }
+            s.wait(msn, part, timeout)
+        }
+        return hlsPlaylistType, []byte(s.playlist(tokenQuery(query))), nil
+
+    case file == "init.mp4":
+        return "video/mp4", s.init, nil
+
+    case strings.HasPrefix(file, "seg"):
+        n, ok := parseHLSName(file, "seg")
+        var seg *hlsSegment
+        if ok && len(n) == 1 {
+            seg = s.segment(n[0])
+        }
+        if seg == nil || seg == s.current {
+            return "", nil, errSegmentNotFound
+        }
+        return "video/mp4", seg.data, nil
+
+    case strings.HasPrefix(file, "part"):
+        n, ok := parseHLSName(file, "part")
+        if !ok || len(n) != 2 {
+            return "", nil, errPartNotFound
+        }
+        s.wait(n[0], int(n[1]), timeout)
+        seg := s.segment(n[0])
+        if seg == nil || int(n[1]) >= len(seg.parts) {
+            return "", nil, errPartNotFound
+        }
+        return "video/mp4", seg.parts[n[1]].data, nil
+    }
+    return "", nil, errHLSFileNotFound
+}
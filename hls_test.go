@@ -0,0 +1,186 @@
+package main
+
+import (
+    "net/url"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestParseHLSName(t *testing.T) {
+    tests := []struct {
+        name   string
+        prefix string
+        want   []uint64
+        ok     bool
+    }{
+        {name: "seg12.m4s", prefix: "seg", want: []uint64{12}, ok: true},
+        {name: "seg0.m4s", prefix: "seg", want: []uint64{0}, ok: true},
+        {name: "part12.3.m4s", prefix: "part", want: []uint64{12, 3}, ok: true},
+        {name: "part12.3.m4s", prefix: "seg"},
+        {name: "seg12.mp4", prefix: "seg"},
+        {name: "seg.m4s", prefix: "seg"},
+        {name: "seg-1.m4s", prefix: "seg"},
+        {name: "seg1x.m4s", prefix: "seg"},
+        {name: "part12..m4s", prefix: "part"},
+        {name: "seg4294967296.m4s", prefix: "seg"},
+        {name: "init.mp4", prefix: "seg"},
+    }
+    for _, tt := range tests {
+        got, ok := parseHLSName(tt.name, tt.prefix)
+        if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("parseHLSName(%q, %q) = %v, %v, want %v, %v", tt.name, tt.prefix, got, ok, tt.want, tt.ok)
+        }
+    }
+}
+
+func TestTokenQuery(t *testing.T) {
+    tests := []struct {
+        query string
+        want  string
+    }{
+        {"", ""},
+        {"_HLS_msn=3", ""},
+        {"token=abc", "?token=abc"},
+        {"_HLS_msn=3&_HLS_part=1&token=a.b-c_d", "?token=a.b-c_d"},
+        {"token=a%2Bb%3D", "?token=a%2Bb%3D"},
+    }
+    for _, tt := range tests {
+        query, err := url.ParseQuery(tt.query)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if got := tokenQuery(query); got != tt.want {
+            t.Errorf("tokenQuery(%q) = %q, want %q", tt.query, got, tt.want)
+        }
+    }
+}
+
+func TestHLSPlaylist(t *testing.T) {
+    // segment is a segment of one-second parts, the first independent.
+    segment := func(seq uint64, parts int) *hlsSegment {
+        seg := &hlsSegment{seq: seq, duration: time.Duration(parts) * time.Second}
+        for i := 0; i < parts; i++ {
+            seg.parts = append(seg.parts, hlsPart{duration: time.Second, independent: i == 0})
+        }
+        return seg
+    }
+    lines := func(l ...string) string { return strings.Join(l, "\n") + "\n" }
+
+    tests := []struct {
+        name   string
+        stream *hlsStream
+        suffix string
+        want   string
+    }{
+        {
+            name: "live with parts of the last two segments",
+            stream: &hlsStream{
+                segmentDuration: 2 * time.Second,
+                partDuration:    time.Second,
+                segments:        []*hlsSegment{segment(3, 2), segment(4, 2), segment(5, 2)},
+                current:         segment(6, 1),
+            },
+            want: lines(
+                "#EXTM3U",
+                "#EXT-X-VERSION:9",
+                "#EXT-X-TARGETDURATION:2",
+                "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=3.000",
+                "#EXT-X-PART-INF:PART-TARGET=1.000",
+                "#EXT-X-MEDIA-SEQUENCE:3",
+                "#EXT-X-INDEPENDENT-SEGMENTS",
+                `#EXT-X-MAP:URI="init.mp4"`,
+                "#EXTINF:2.000,",
+                "seg3.m4s",
+                `#EXT-X-PART:DURATION=1.000,URI="part4.0.m4s",INDEPENDENT=YES`,
+                `#EXT-X-PART:DURATION=1.000,URI="part4.1.m4s"`,
+                "#EXTINF:2.000,",
+                "seg4.m4s",
+                `#EXT-X-PART:DURATION=1.000,URI="part5.0.m4s",INDEPENDENT=YES`,
+                `#EXT-X-PART:DURATION=1.000,URI="part5.1.m4s"`,
+                "#EXTINF:2.000,",
+                "seg5.m4s",
+                `#EXT-X-PART:DURATION=1.000,URI="part6.0.m4s",INDEPENDENT=YES`,
+                `#EXT-X-PRELOAD-HINT:TYPE=PART,URI="part6.1.m4s"`,
+            ),
+        },
+        {
+            name: "ended with token",
+            stream: &hlsStream{
+                segmentDuration: 2 * time.Second,
+                partDuration:    time.Second,
+                segments:        []*hlsSegment{segment(4, 2), segment(5, 2)},
+                current:         segment(6, 1),
+                ended:           true,
+            },
+            suffix: "?token=abc",
+            want: lines(
+                "#EXTM3U",
+                "#EXT-X-VERSION:9",
+                "#EXT-X-TARGETDURATION:2",
+                "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=3.000",
+                "#EXT-X-PART-INF:PART-TARGET=1.000",
+                "#EXT-X-MEDIA-SEQUENCE:4",
+                "#EXT-X-INDEPENDENT-SEGMENTS",
+                `#EXT-X-MAP:URI="init.mp4?token=abc"`,
+                `#EXT-X-PART:DURATION=1.000,URI="part4.0.m4s?token=abc",INDEPENDENT=YES`,
+                `#EXT-X-PART:DURATION=1.000,URI="part4.1.m4s?token=abc"`,
+                "#EXTINF:2.000,",
+                "seg4.m4s?token=abc",
+                `#EXT-X-PART:DURATION=1.000,URI="part5.0.m4s?token=abc",INDEPENDENT=YES`,
+                `#EXT-X-PART:DURATION=1.000,URI="part5.1.m4s?token=abc"`,
+                "#EXTINF:2.000,",
+                "seg5.m4s?token=abc",
+                "#EXT-X-ENDLIST",
+            ),
+        },
+        {
+            name: "without parts",
+            stream: &hlsStream{
+                segmentDuration: 2 * time.Second,
+                maxSegment:      2400 * time.Millisecond,
+                segments:        []*hlsSegment{segment(0, 2), segment(1, 2)},
+                current:         segment(2, 1),
+            },
+            want: lines(
+                "#EXTM3U",
+                "#EXT-X-VERSION:7",
+                "#EXT-X-TARGETDURATION:3",
+                "#EXT-X-MEDIA-SEQUENCE:0",
+                "#EXT-X-INDEPENDENT-SEGMENTS",
+                `#EXT-X-MAP:URI="init.mp4"`,
+                "#EXTINF:2.000,",
+                "seg0.m4s",
+                "#EXTINF:2.000,",
+                "seg1.m4s",
+            ),
+        },
+        {
+            name: "no segment yet",
+            stream: &hlsStream{
+                segmentDuration: 2 * time.Second,
+                partDuration:    500 * time.Millisecond,
+                current:         segment(0, 0),
+            },
+            want: lines(
+                "#EXTM3U",
+                "#EXT-X-VERSION:9",
+                "#EXT-X-TARGETDURATION:2",
+                "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=1.500",
+                "#EXT-X-PART-INF:PART-TARGET=0.500",
+                "#EXT-X-MEDIA-SEQUENCE:0",
+                "#EXT-X-INDEPENDENT-SEGMENTS",
+                `#EXT-X-MAP:URI="init.mp4"`,
+                `#EXT-X-PRELOAD-HINT:TYPE=PART,URI="part0.0.m4s"`,
+            ),
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := tt.stream.playlist(tt.suffix); got != tt.want {
+                t.Errorf("playlist(%q) =\n%s\nwant\n%s", tt.suffix, got, tt.want)
+            }
+        })
+    }
+}
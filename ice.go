@@ -0,0 +1,99 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+
+    "github.com/pion/webrtc/v3"
+)
+
+// onLocalCandidate trickles a server-side candidate to the client as soon as
+// it is gathered. Without a signaling socket it is kept until the client
+// attaches one or fetches it from /candidate/{peer-id}.
+func (p *Peer) onLocalCandidate(c *webrtc.ICECandidate) {
+    if c == nil {
+        log.Printf("[%s] ICE gathering complete", p.ID)
+        return
+    }
+    init := c.ToJSON()
+
+    p.signalMu.Lock()
+    defer p.signalMu.Unlock()
+
+    if p.signal != nil {
+        if err := p.signal.send(SignalMessage{Type: SignalCandidate, Candidate: &init}); err == nil {
+            return
+        }
+    }
+    p.localCandidates = append(p.localCandidates, init)
+}
+
+// takeLocalCandidates returns and clears the candidates not yet delivered.
+// Callers must hold signalMu.
+func (p *Peer) takeLocalCandidates() []webrtc.ICECandidateInit {
+    candidates := p.localCandidates
+    p.localCandidates = nil
+    return candidates
+}
+
+// addRemoteCandidate applies a candidate trickled by the client. Candidates
+// that arrive before the remote description is set are buffered and applied
+// by flushRemoteCandidates.
+func (p *Peer) addRemoteCandidate(candidate webrtc.ICECandidateInit) error {
+    p.negotiationMu.Lock()
+    defer p.negotiationMu.Unlock()
+
+    if p.PC.RemoteDescription() == nil {
+        p.pendingCandidates = append(p.pendingCandidates, candidate)
+        return nil
+    }
+    return p.PC.AddICECandidate(candidate)
+}
+
+// flushRemoteCandidates applies buffered client candidates. Callers must hold
+// negotiationMu and have just set the remote description.
+func (p *Peer) flushRemoteCandidates() {
+    for _, candidate := range p.pendingCandidates {
+        if err := p.PC.AddICECandidate(candidate); err != nil {
+            log.Printf("⚠️ [%s] Couldn't add buffered candidate: %v", p.ID, err)
+        }
+    }
+    p.pendingCandidates = nil
+}
+
+// candidateHandler is the HTTP fallback for trickle ICE. Clients POST their
+// candidates to it and GET the server candidates gathered since the last call.
+func candidateHandler(w http.ResponseWriter, r *http.Request) {
+    peer := lookupSession(w, r)
+    if peer == nil {
+        return
+    }
+
+    switch r.Method {
+    case http.MethodPost:
+        var candidate webrtc.ICECandidateInit
+        if err := json.NewDecoder(r.Body).Decode(&candidate); err != nil {
+            http.Error(w, "Invalid candidate", http.StatusBadRequest)
+            return
+        }
+        if err := peer.addRemoteCandidate(candidate); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        w.WriteHeader(http.StatusOK)
+
+    case http.MethodGet:
+        peer.signalMu.Lock()
+        candidates := peer.takeLocalCandidates()
+        peer.signalMu.Unlock()
+
+        if candidates == nil {
+            candidates = []webrtc.ICECandidateInit{}
+        }
+        json.NewEncoder(w).Encode(candidates)
+
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
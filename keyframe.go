@@ -0,0 +1,182 @@
+package main
+
+import (
+    "log"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/pion/rtcp"
+    "github.com/pion/rtp/codecs"
+    "github.com/pion/webrtc/v3"
+)
+
+// keyframeRequestInterval is the minimum time between two keyframe requests
+// sent to a publisher for the same layer. Requests arriving in between, from
+// any number of subscribers, are folded into one sent when it has passed.
+const keyframeRequestInterval = 500 * time.Millisecond
+
+// keyframeRequests aggregates the PLI and FIR requests for one layer of a
+// published track.
+type keyframeRequests struct {
+    mu      sync.Mutex
+    last    time.Time
+    pending bool
+    fir     bool
+    firSeq  uint8
+}
+
+// requestKeyframe asks the publisher for a keyframe on one layer, with a FIR
+// if fir is set and a PLI otherwise. Requests are rate limited per layer;
+// one made too soon after the last is delayed rather than dropped, so a
+// subscriber that just joined still gets its keyframe.
+func (pt *PublishedTrack) requestKeyframe(rid string, fir bool) {
+    layer := pt.layer(rid)
+    if layer == nil {
+        return
+    }
+
+    k := &layer.keyframes
+    k.mu.Lock()
+    defer k.mu.Unlock()
+
+    k.fir = k.fir || fir
+    if k.pending {
+        return
+    }
+    if wait := keyframeRequestInterval - time.Since(k.last); wait > 0 {
+        k.pending = true
+        time.AfterFunc(wait, func() {
+            k.mu.Lock()
+            defer k.mu.Unlock()
+            k.pending = false
+            pt.sendKeyframeRequest(layer)
+        })
+        return
+    }
+    pt.sendKeyframeRequest(layer)
+}
+
+// sendKeyframeRequest writes the aggregated request for a layer to the
+// publisher. Callers must hold layer.keyframes.mu.
+func (pt *PublishedTrack) sendKeyframeRequest(layer *simulcastLayer) {
+    k := &layer.keyframes
+    if pt.ended.Load() || pt.Publisher.closed.Load() {
+        return
+    }
+
+    ssrc := uint32(layer.Remote.SSRC())
+    var pkt rtcp.Packet = &rtcp.PictureLossIndication{MediaSSRC: ssrc}
+    if k.fir {
+        k.firSeq++
+        pkt = &rtcp.FullIntraRequest{
+            MediaSSRC: ssrc,
+            FIR:       []rtcp.FIREntry{{SSRC: ssrc, SequenceNumber: k.firSeq}},
+        }
+    }
+    k.last = time.Now()
+    k.fir = false
+
+    if err := pt.Publisher.PC.WriteRTCP([]rtcp.Packet{pkt}); err != nil {
+        log.Printf("⚠️ Couldn't request keyframe from %s: %v", pt.Publisher.ID, err)
+    }
+}
+
+// requestNegotiatedKeyframes asks for a keyframe for every video track
+// forwarded to p since its last negotiation. The outbound tracks are only
+// bound once the subscriber's answer is applied, so a keyframe requested
+// when the track was added would arrive before the subscriber could use it.
+func (p *Peer) requestNegotiatedKeyframes() {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    for _, out := range p.OutTracks {
+        if out.negotiated {
+            continue
+        }
+        out.negotiated = true
+        if out.Published.Remote.Kind() == webrtc.RTPCodecTypeVideo {
+            out.Published.requestKeyframe(out.targetLayer, false)
+        }
+    }
+}
+
+// isKeyframe reports whether an RTP payload starts a keyframe for the given
+// codec. Unknown codecs, and audio, never report keyframes.
+func isKeyframe(mimeType string, payload []byte) bool {
+    switch strings.ToLower(mimeType) {
+    case strings.ToLower(webrtc.MimeTypeVP8):
+        return isVP8Keyframe(payload)
+    case strings.ToLower(webrtc.MimeTypeVP9):
+        return isVP9Keyframe(payload)
+    case strings.ToLower(webrtc.MimeTypeH264):
+        return isH264Keyframe(payload)
+    }
+    return false
+}
+
+// isVP8Keyframe checks the P bit of the VP8 payload header of the first
+// packet of a frame (RFC 7741 section 4.3).
+func isVP8Keyframe(payload []byte) bool {
+    var vp8 codecs.VP8Packet
+    if _, err := vp8.Unmarshal(payload); err != nil {
+        return false
+    }
+    return vp8.S == 1 && vp8.PID == 0 && len(vp8.Payload) > 0 && vp8.Payload[0]&0x01 == 0
+}
+
+// isVP9Keyframe treats the start of a frame that is not inter-picture
+// predicted as a keyframe.
+func isVP9Keyframe(payload []byte) bool {
+    var vp9 codecs.VP9Packet
+    if _, err := vp9.Unmarshal(payload); err != nil {
+        return false
+    }
+    return vp9.B && !vp9.P
+}
+
+// H.264 NAL unit types relevant to keyframe detection (RFC 6184) and to
+// repackaging for HLS.
+const (
+    h264NALUTypeIDR   = 5
+    h264NALUTypeSPS   = 7
+    h264NALUTypePPS   = 8
+    h264NALUTypeAUD   = 9
+    h264NALUTypeSTAPA = 24
+    h264NALUTypeFUA   = 28
+)
+
+// isH264Keyframe looks for an SPS or IDR slice, either as a single NAL
+// unit, inside a STAP-A aggregate, or at the start of an FU-A fragment.
+func isH264Keyframe(payload []byte) bool {
+    if len(payload) < 1 {
+        return false
+    }
+
+    switch naluType := payload[0] & 0x1F; naluType {
+    case h264NALUTypeIDR, h264NALUTypeSPS:
+        return true
+
+    case h264NALUTypeSTAPA:
+        for offset := 1; offset+2 < len(payload); {
+            size := int(payload[offset])<<8 | int(payload[offset+1])
+            offset += 2
+            if offset >= len(payload) {
+                break
+            }
+            if t := payload[offset] & 0x1F; t == h264NALUTypeIDR || t == h264NALUTypeSPS {
+                return true
+            }
+            offset += size
+        }
+
+    case h264NALUTypeFUA:
+        if len(payload) < 2 {
+            return false
+        }
+        start := payload[1]&0x80 != 0
+        t := payload[1] & 0x1F
+        return start && (t == h264NALUTypeIDR || t == h264NALUTypeSPS)
+    }
+    return false
+}
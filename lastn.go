@@ -0,0 +1,185 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "sort"
+
+    "github.com/pion/webrtc/v3"
+)
+
+// lastNUnlimited as a Last-N limit forwards video from every publisher.
+const lastNUnlimited = -1
+
+// lastNLimit returns how many publishers' video p receives: its own limit
+// if it set one, else its room's. Callers must hold p.mu.
+func (p *Peer) lastNLimit() int {
+    if p.lastN != nil {
+        return *p.lastN
+    }
+    return p.Room.Settings().LastN
+}
+
+// lastNSelection returns the publishers whose video p receives: its pinned
+// publishers, plus the first lastNLimit others in ranking that p receives
+// video from. It returns nil if p receives all video. Callers must hold
+// p.mu.
+func (p *Peer) lastNSelection(ranking []string) map[string]bool {
+    n := p.lastNLimit()
+    if n < 0 {
+        return nil
+    }
+
+    publishers := make(map[string]bool)
+    for _, out := range p.OutTracks {
+        if out.Track.Kind() == webrtc.RTPCodecTypeVideo {
+            publishers[out.PublisherID] = true
+        }
+    }
+
+    selected := make(map[string]bool, n+len(p.pinnedPeers))
+    for id := range p.pinnedPeers {
+        selected[id] = true
+    }
+    for _, id := range ranking {
+        if n == 0 {
+            break
+        }
+        if publishers[id] && !selected[id] {
+            selected[id] = true
+            n--
+        }
+    }
+    return selected
+}
+
+// applyLastN pauses the video p receives from publishers outside its Last-N
+// and resumes the rest, from a keyframe. Audio is always forwarded. Callers
+// must hold p.mu.
+func (p *Peer) applyLastN(ranking []string) {
+    selected := p.lastNSelection(ranking)
+    for _, out := range p.OutTracks {
+        if out.Track.Kind() != webrtc.RTPCodecTypeVideo {
+            continue
+        }
+        excluded := selected != nil && !selected[out.PublisherID]
+        if excluded == out.lastNPaused {
+            continue
+        }
+
+        out.lastNPaused = excluded
+        out.syncFilter()
+        if excluded {
+            log.Printf("⏸️ %s: outside the last %d for %s", out.Key, p.lastNLimit(), p.ID)
+            continue
+        }
+        // Like a layer switch, the gap is hidden from the subscriber and
+        // forwarding waits for a keyframe.
+        out.resuming = true
+        if !out.paused {
+            out.Published.requestKeyframe(out.targetLayer, false)
+        }
+        log.Printf("▶️ %s: back in Last-N for %s", out.Key, p.ID)
+    }
+}
+
+// applyLastN reapplies every peer's Last-N after the ranking or the limits
+// changed.
+func (room *Room) applyLastN() {
+    ranking := room.speakers.ranking()
+    room.forEachPeer(func(p *Peer) bool {
+        p.mu.Lock()
+        p.applyLastN(ranking)
+        p.mu.Unlock()
+        return true
+    })
+}
+
+// setLastN changes p's own Last-N limit and its pinned publishers; a nil
+// limit or pinned list leaves that setting unchanged.
+func (p *Peer) setLastN(n *int, pinned []string) error {
+    if n != nil && *n < lastNUnlimited {
+        return errors.New("invalid last-n")
+    }
+
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    if n != nil {
+        limit := *n
+        p.lastN = &limit
+    }
+    if pinned != nil {
+        p.pinnedPeers = make(map[string]bool, len(pinned))
+        for _, id := range pinned {
+            p.pinnedPeers[id] = true
+        }
+    }
+    p.applyLastN(p.Room.speakers.ranking())
+    return nil
+}
+
+// LastNInfo is returned by the last-n routes. Forwarded lists the publishers
+// whose video p currently receives.
+type LastNInfo struct {
+    PeerID    string   `json:"peer_id"`
+    LastN     int      `json:"last_n"`
+    Pinned    []string `json:"pinned"`
+    Forwarded []string `json:"forwarded"`
+}
+
+// LastN reports p's Last-N settings and their effect.
+func (p *Peer) LastN() LastNInfo {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    info := LastNInfo{PeerID: p.ID, LastN: p.lastNLimit(), Pinned: []string{}, Forwarded: []string{}}
+    for id := range p.pinnedPeers {
+        info.Pinned = append(info.Pinned, id)
+    }
+    forwarded := make(map[string]bool)
+    for _, out := range p.OutTracks {
+        if out.Track.Kind() == webrtc.RTPCodecTypeVideo && !out.lastNPaused && !forwarded[out.PublisherID] {
+            forwarded[out.PublisherID] = true
+            info.Forwarded = append(info.Forwarded, out.PublisherID)
+        }
+    }
+    sort.Strings(info.Pinned)
+    sort.Strings(info.Forwarded)
+    return info
+}
+
+// lastNRequest is the body of POST /peer/{peer}/last-n. Fields left out are
+// unchanged; an empty pinned list unpins everyone.
+type lastNRequest struct {
+    LastN  *int     `json:"last_n"`
+    Pinned []string `json:"pinned"`
+}
+
+// lastNHandler reports a subscriber's Last-N settings on GET and changes them
+// on POST, which only its own client may send.
+func lastNHandler(w http.ResponseWriter, r *http.Request) {
+    lookup := lookupPeer
+    if r.Method == http.MethodPost {
+        lookup = lookupSession
+    }
+    peer := lookup(w, r)
+    if peer == nil {
+        return
+    }
+
+    if r.Method == http.MethodPost {
+        var req lastNRequest
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            http.Error(w, "Invalid last-n request", http.StatusBadRequest)
+            return
+        }
+        if err := peer.setLastN(req.LastN, req.Pinned); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+    }
+    json.NewEncoder(w).Encode(peer.LastN())
+}
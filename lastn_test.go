@@ -0,0 +1,122 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+
+    "github.com/pion/webrtc/v3"
+)
+
+func TestLastNSelection(t *testing.T) {
+    forwarded := func(publisher string, kind webrtc.RTPCodecType) *ForwardedTrack {
+        return &ForwardedTrack{
+            Key:         publisher + "/" + kind.String(),
+            PublisherID: publisher,
+            Track:       newForwardTrack(webrtc.RTPCodecCapability{}, webrtc.RTPParameters{}, kind.String(), publisher, kind),
+        }
+    }
+    limit := func(n int) *int { return &n }
+
+    // e only publishes audio, and so never takes a place in the Last-N.
+    ranking := []string{"e", "c", "a", "d", "b"}
+
+    tests := []struct {
+        name    string
+        roomN   int
+        peerN   *int
+        pinned  []string
+        ranking []string
+        want    map[string]bool
+    }{
+        {
+            name:    "unlimited",
+            roomN:   lastNUnlimited,
+            ranking: ranking,
+        },
+        {
+            name:    "room limit",
+            roomN:   2,
+            ranking: ranking,
+            want:    map[string]bool{"c": true, "a": true},
+        },
+        {
+            name:    "peer limit overrides room",
+            roomN:   2,
+            peerN:   limit(1),
+            ranking: ranking,
+            want:    map[string]bool{"c": true},
+        },
+        {
+            name:    "peer unlimited overrides room",
+            roomN:   2,
+            peerN:   limit(lastNUnlimited),
+            ranking: ranking,
+        },
+        {
+            name:    "no video",
+            roomN:   0,
+            ranking: ranking,
+            want:    map[string]bool{},
+        },
+        {
+            name:    "limit above publishers",
+            roomN:   10,
+            ranking: ranking,
+            want:    map[string]bool{"a": true, "b": true, "c": true, "d": true},
+        },
+        {
+            name:    "unranked publishers left out",
+            roomN:   4,
+            ranking: []string{"b", "a"},
+            want:    map[string]bool{"a": true, "b": true},
+        },
+        {
+            name:    "pinned on top of the limit",
+            roomN:   2,
+            pinned:  []string{"b"},
+            ranking: ranking,
+            want:    map[string]bool{"b": true, "c": true, "a": true},
+        },
+        {
+            name:    "pinned and ranked counted once",
+            roomN:   2,
+            pinned:  []string{"c"},
+            ranking: ranking,
+            want:    map[string]bool{"c": true, "a": true, "d": true},
+        },
+        {
+            name:    "pinned with no video",
+            roomN:   0,
+            pinned:  []string{"d"},
+            ranking: ranking,
+            want:    map[string]bool{"d": true},
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            p := &Peer{
+                Room:        &Room{settings: RoomSettings{LastN: tt.roomN}},
+                OutTracks:   make(map[string]*ForwardedTrack),
+                lastN:       tt.peerN,
+                pinnedPeers: make(map[string]bool),
+            }
+            for _, out := range []*ForwardedTrack{
+                forwarded("a", webrtc.RTPCodecTypeAudio),
+                forwarded("a", webrtc.RTPCodecTypeVideo),
+                forwarded("b", webrtc.RTPCodecTypeVideo),
+                forwarded("c", webrtc.RTPCodecTypeVideo),
+                forwarded("d", webrtc.RTPCodecTypeVideo),
+                forwarded("e", webrtc.RTPCodecTypeAudio),
+            } {
+                p.OutTracks[out.Key] = out
+            }
+            for _, id := range tt.pinned {
+                p.pinnedPeers[id] = true
+            }
+
+            if got := p.lastNSelection(tt.ranking); !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("lastNSelection() = %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "sync"
+
+    "github.com/pion/rtp"
+)
+
+// Drop policies for a full send queue.
+const (
+    // DropOldest discards the oldest queued packet to make room; the
+    // subscriber may recover it by NACK.
+    DropOldest = "drop-oldest"
+
+    // DropUntilKeyframe discards everything queued and every following
+    // packet until the next keyframe, which it requests from the
+    // publisher. The subscriber sees no gap, just a frozen picture.
+    // Tracks without keyframes, such as audio, fall back to DropOldest.
+    DropUntilKeyframe = "drop-until-keyframe"
+)
+
+// Send queue configuration, set from the -queue-size and -drop-policy flags.
+var (
+    sendQueueSize   = 256
+    sendQueuePolicy = DropOldest
+)
+
+// validDropPolicy reports whether policy names a known drop policy.
+func validDropPolicy(policy string) error {
+    switch policy {
+    case DropOldest, DropUntilKeyframe:
+        return nil
+    }
+    return fmt.Errorf("unknown drop policy %q", policy)
+}
+
+// queuedPacket is a packet waiting to be written to a forwarded track. The
+// queue owns one reference to buf.
+type queuedPacket struct {
+    rid      string
+    buf      *packetBuffer
+    keyframe bool
+
+    // resync marks the first packet after a run dropped by
+    // DropUntilKeyframe. rewritten marks retransmissions, whose buffer is
+    // not shared and whose header was already mapped onto the
+    // subscriber's stream.
+    resync    bool
+    rewritten bool
+}
+
+// sendQueue is the bounded queue between a published track's read loop and
+// the writer goroutine of one of its subscribers, so that a slow subscriber
+// only delays, and loses packets of, its own copy of the track.
+type sendQueue struct {
+    mu       sync.Mutex
+    items    []queuedPacket
+    head     int
+    size     int
+    policy   string
+    skipping bool
+    closed   bool
+    notify   chan struct{}
+
+    // finishing stops new packets from being queued, and the writer
+    // goroutine once it has written the ones already queued.
+    finishing bool
+
+    dropped uint64
+}
+
+func newSendQueue(size int, policy string) *sendQueue {
+    return &sendQueue{
+        items:  make([]queuedPacket, max(size, 1)),
+        policy: policy,
+        notify: make(chan struct{}, 1),
+    }
+}
+
+// push queues a packet without blocking, taking over the caller's reference
+// to its buffer, and applies the drop policy if the queue is full. It
+// reports whether the policy wants a keyframe requested.
+func (q *sendQueue) push(item queuedPacket, hasKeyframes bool) (wantKeyframe bool) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+
+    if q.closed || q.finishing {
+        item.buf.release()
+        return false
+    }
+    untilKeyframe := q.policy == DropUntilKeyframe && hasKeyframes && !item.rewritten
+
+    if q.skipping && untilKeyframe {
+        if !item.keyframe {
+            q.dropped++
+            item.buf.release()
+            return false
+        }
+        q.skipping = false
+        item.resync = true
+    }
+
+    if q.size == len(q.items) {
+        // A retransmission is not worth evicting fresher media for.
+        if item.rewritten {
+            q.dropped++
+            item.buf.release()
+            return false
+        }
+        if untilKeyframe {
+            q.dropped += uint64(q.size) + 1
+            q.discard()
+            item.buf.release()
+            q.skipping = true
+            return true
+        }
+        q.items[q.head].buf.release()
+        q.items[q.head] = queuedPacket{}
+        q.head = (q.head + 1) % len(q.items)
+        q.size--
+        q.dropped++
+    }
+
+    q.items[(q.head+q.size)%len(q.items)] = item
+    q.size++
+
+    select {
+    case q.notify <- struct{}{}:
+    default:
+    }
+    return false
+}
+
+// pop waits for the next packet. It reports false once the queue is closed,
+// or finished and empty.
+func (q *sendQueue) pop() (queuedPacket, bool) {
+    for {
+        q.mu.Lock()
+        if q.closed || (q.finishing && q.size == 0) {
+            q.mu.Unlock()
+            return queuedPacket{}, false
+        }
+        if q.size > 0 {
+            item := q.items[q.head]
+            q.items[q.head] = queuedPacket{}
+            q.head = (q.head + 1) % len(q.items)
+            q.size--
+            q.mu.Unlock()
+            return item, true
+        }
+        q.mu.Unlock()
+        <-q.notify
+    }
+}
+
+// discard empties the queue. Callers must hold q.mu.
+func (q *sendQueue) discard() {
+    for ; q.size > 0; q.size-- {
+        q.items[q.head].buf.release()
+        q.items[q.head] = queuedPacket{}
+        q.head = (q.head + 1) % len(q.items)
+    }
+    q.head = 0
+}
+
+// close stops the writer goroutine and discards anything still queued.
+func (q *sendQueue) close() {
+    q.mu.Lock()
+    q.closed = true
+    q.discard()
+    q.mu.Unlock()
+
+    select {
+    case q.notify <- struct{}{}:
+    default:
+    }
+}
+
+// finish stops the writer goroutine once it has written everything already
+// queued, where close would discard it.
+func (q *sendQueue) finish() {
+    q.mu.Lock()
+    q.finishing = true
+    q.mu.Unlock()
+
+    select {
+    case q.notify <- struct{}{}:
+    default:
+    }
+}
+
+// stats returns the number of packets dropped so far and currently queued.
+func (q *sendQueue) stats() (dropped uint64, queued int) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    return q.dropped, q.size
+}
+
+// writeLoop writes the packets queued for one forwarded track until the
+// track is removed. Layer selection and rewriting happen under p.mu, but
+// the write itself does not, so a slow write only holds up this track.
+func (p *Peer) writeLoop(out *ForwardedTrack) {
+    // The rewritten packet is built in place, since the queued one is
+    // shared with the other subscribers.
+    var pkt rtp.Packet
+    for {
+        item, ok := out.queue.pop()
+        if !ok {
+            return
+        }
+
+        send := true
+        if item.rewritten {
+            pkt = item.buf.pkt
+        } else {
+            p.mu.Lock()
+            send = out.rewrite(item, &pkt)
+            p.mu.Unlock()
+        }
+        if send {
+            if err := out.Track.WriteRTP(&pkt); err != nil {
+                log.Printf("⚠️ RTP forward error to %s: %v", p.ID, err)
+            }
+        }
+        pkt = rtp.Packet{}
+        item.buf.release()
+    }
+}
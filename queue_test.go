@@ -0,0 +1,123 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestSendQueueDropPolicies(t *testing.T) {
+    type packet struct {
+        seq       uint16
+        keyframe  bool
+        rewritten bool
+    }
+    frames := func(seqs ...uint16) []packet {
+        var packets []packet
+        for _, seq := range seqs {
+            packets = append(packets, packet{seq: seq})
+        }
+        return packets
+    }
+
+    tests := []struct {
+        name         string
+        policy       string
+        hasKeyframes bool
+        pushed       []packet
+        popped       []uint16
+        resync       []uint16
+        dropped      uint64
+        requests     int
+    }{
+        {
+            name:         "drop-oldest with room",
+            policy:       DropOldest,
+            hasKeyframes: true,
+            pushed:       frames(1, 2),
+            popped:       []uint16{1, 2},
+        },
+        {
+            name:         "drop-oldest when full",
+            policy:       DropOldest,
+            hasKeyframes: true,
+            pushed:       frames(1, 2, 3, 4, 5),
+            popped:       []uint16{3, 4, 5},
+            dropped:      2,
+        },
+        {
+            name:         "drop-until-keyframe when full",
+            policy:       DropUntilKeyframe,
+            hasKeyframes: true,
+            pushed:       append(frames(1, 2, 3, 4, 5), packet{seq: 6, keyframe: true}, packet{seq: 7}),
+            popped:       []uint16{6, 7},
+            resync:       []uint16{6},
+            dropped:      5,
+            requests:     1,
+        },
+        {
+            name:         "drop-until-keyframe without keyframes",
+            policy:       DropUntilKeyframe,
+            hasKeyframes: false,
+            pushed:       frames(1, 2, 3, 4, 5),
+            popped:       []uint16{3, 4, 5},
+            dropped:      2,
+        },
+        {
+            name:         "retransmission into a full queue",
+            policy:       DropOldest,
+            hasKeyframes: true,
+            pushed:       append(frames(1, 2, 3), packet{seq: 9, rewritten: true}),
+            popped:       []uint16{1, 2, 3},
+            dropped:      1,
+        },
+        {
+            name:         "retransmission while waiting for a keyframe",
+            policy:       DropUntilKeyframe,
+            hasKeyframes: true,
+            pushed:       append(frames(1, 2, 3, 4), packet{seq: 9, rewritten: true}, packet{seq: 5}, packet{seq: 6, keyframe: true}),
+            popped:       []uint16{9, 6},
+            resync:       []uint16{6},
+            dropped:      5,
+            requests:     1,
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            q := newSendQueue(3, tt.policy)
+            requests := 0
+            for _, p := range tt.pushed {
+                buf := getPacketBuffer()
+                buf.pkt.SequenceNumber = p.seq
+                if q.push(queuedPacket{buf: buf, keyframe: p.keyframe, rewritten: p.rewritten}, tt.hasKeyframes) {
+                    requests++
+                }
+            }
+            q.finish()
+
+            var popped, resync []uint16
+            for {
+                item, ok := q.pop()
+                if !ok {
+                    break
+                }
+                popped = append(popped, item.buf.pkt.SequenceNumber)
+                if item.resync {
+                    resync = append(resync, item.buf.pkt.SequenceNumber)
+                }
+                item.buf.release()
+            }
+            if !reflect.DeepEqual(popped, tt.popped) {
+                t.Errorf("popped %v, want %v", popped, tt.popped)
+            }
+            if !reflect.DeepEqual(resync, tt.resync) {
+                t.Errorf("resync on %v, want %v", resync, tt.resync)
+            }
+            if dropped, _ := q.stats(); dropped != tt.dropped {
+                t.Errorf("dropped %d, want %d", dropped, tt.dropped)
+            }
+            if requests != tt.requests {
+                t.Errorf("%d keyframe requests, want %d", requests, tt.requests)
+            }
+        })
+    }
+}
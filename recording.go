@@ -0,0 +1,802 @@
+package main
+
+import (
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "io/fs"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/pion/rtp"
+    "github.com/pion/rtp/codecs"
+    "github.com/pion/webrtc/v3"
+    "github.com/pion/webrtc/v3/pkg/media"
+    "github.com/pion/webrtc/v3/pkg/media/h264writer"
+    "github.com/pion/webrtc/v3/pkg/media/ivfwriter"
+    "github.com/pion/webrtc/v3/pkg/media/oggwriter"
+)
+
+// recordDir is where recordings are written, one directory per recording
+// under a directory per room. It is set from the -record-dir flag.
+var recordDir = "recordings"
+
+// Recording formats: a file per track, or a WebM file per publisher with
+// its audio and video in sync.
+const (
+    RecordSeparate = "separate"
+    RecordWebM     = "webm"
+)
+
+// recordFormat is the format recordings use unless their start request
+// says otherwise. It is set from the -record-format flag.
+var recordFormat = RecordSeparate
+
+func validRecordFormat(format string) error {
+    switch format {
+    case RecordSeparate, RecordWebM:
+        return nil
+    }
+    return fmt.Errorf("unknown recording format %q", format)
+}
+
+// recordQueueSize is how many packets of a track may wait for the disk.
+// Writes stall for longer than sends, so it is larger than a subscriber's
+// send queue.
+const recordQueueSize = 1024
+
+var (
+    errRecordingActive = errors.New("already recording")
+    errNotRecording    = errors.New("not recording")
+    errPeerNotFound    = errors.New("peer not found")
+)
+
+// recordingFormat is the file format a codec is recorded in.
+type recordingFormat struct {
+    ext  string
+    open func(path string, codec webrtc.RTPCodecParameters) (media.Writer, error)
+}
+
+// recordingFormats maps the lower-case MIME types we can record to their
+// file format. Other codecs are not recorded.
+var recordingFormats = map[string]recordingFormat{
+    "video/vp8": {".ivf", func(path string, _ webrtc.RTPCodecParameters) (media.Writer, error) {
+        return ivfwriter.New(path, ivfwriter.WithCodec(webrtc.MimeTypeVP8))
+    }},
+    "video/av1": {".ivf", func(path string, _ webrtc.RTPCodecParameters) (media.Writer, error) {
+        return ivfwriter.New(path, ivfwriter.WithCodec(webrtc.MimeTypeAV1))
+    }},
+    "video/vp9": {".ivf", func(path string, _ webrtc.RTPCodecParameters) (media.Writer, error) {
+        return newVP9Writer(path)
+    }},
+    "video/h264": {".h264", func(path string, _ webrtc.RTPCodecParameters) (media.Writer, error) {
+        return h264writer.New(path)
+    }},
+    "audio/opus": {".ogg", func(path string, codec webrtc.RTPCodecParameters) (media.Writer, error) {
+        return oggwriter.New(path, codec.ClockRate, max(codec.Channels, 1))
+    }},
+}
+
+// Recording writes the tracks published in a room, or by one publisher in
+// it, to a directory of media files with a manifest.json describing them.
+// Each track is fed from its read loop through a queue of its own, like a
+// subscriber, so a slow disk never holds up forwarding.
+type Recording struct {
+    ID          string
+    Room        *Room
+    PublisherID string
+    Dir         string
+    Format      string
+
+    mu       sync.Mutex
+    started  time.Time
+    stopped  time.Time
+    active   map[string]*trackRecorder
+    recorded []*trackRecorder
+
+    // muxers holds the open WebM file of each publisher, and muxed every
+    // WebM file of the recording.
+    muxers map[string]*webmMuxer
+    muxed  []*webmMuxer
+}
+
+// trackRecorder writes one published track to a file. Simulcast tracks are
+// recorded from the best layer available when recording starts.
+type trackRecorder struct {
+    pt     *PublishedTrack
+    rid    string
+    writer media.Writer
+    queue  *sendQueue
+    done   chan struct{}
+
+    // muxer is the WebM file the track is written to, if it is not
+    // written to a file of its own.
+    muxer *webmMuxer
+
+    packets atomic.Uint64
+
+    // file is guarded by the recording's mu.
+    file RecordedFile
+}
+
+// RecordedFile is one file of a recording, as listed in its manifest. Path
+// is relative to the recording's directory. A file holding one track has
+// its TrackID; a WebM file lists the tracks muxed into it in Tracks.
+type RecordedFile struct {
+    Path        string     `json:"path"`
+    TrackID     string     `json:"track_id,omitempty"`
+    Tracks      []string   `json:"tracks,omitempty"`
+    PublisherID string     `json:"publisher_id"`
+    Kind        string     `json:"kind"`
+    MimeType    string     `json:"mime_type"`
+    StartedAt   time.Time  `json:"started_at"`
+    EndedAt     *time.Time `json:"ended_at,omitempty"`
+    Packets     uint64     `json:"packets"`
+}
+
+// RecordingManifest describes a recording. It is written to manifest.json
+// in the recording's directory whenever a file is finished, and returned by
+// the recording routes.
+type RecordingManifest struct {
+    ID           string         `json:"id"`
+    Room         string         `json:"room"`
+    PublisherID  string         `json:"publisher_id,omitempty"`
+    Dir          string         `json:"dir"`
+    Format       string         `json:"format"`
+    StartedAt    time.Time      `json:"started_at"`
+    StoppedAt    *time.Time     `json:"stopped_at,omitempty"`
+    Participants []string       `json:"participants"`
+    Files        []RecordedFile `json:"files"`
+}
+
+// fileName turns IDs chosen by clients into something safe to use in a
+// file name.
+func fileName(s string) string {
+    return strings.Map(func(r rune) rune {
+        switch {
+        case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+            return r
+        }
+        return '_'
+    }, s)
+}
+
+// startRecording starts recording every track published in the room, or
+// only those of publisherID if it is not empty, including tracks published
+// later. Only one recording of each kind may run at a time.
+func (room *Room) startRecording(publisherID, format string) (*Recording, error) {
+    now := time.Now()
+    rec := &Recording{
+        ID:          now.UTC().Format("20060102T150405Z"),
+        Room:        room,
+        PublisherID: publisherID,
+        Format:      format,
+        started:     now,
+        active:      make(map[string]*trackRecorder),
+        muxers:      make(map[string]*webmMuxer),
+    }
+    if publisherID != "" {
+        rec.ID += "-" + fileName(publisherID)
+    }
+
+    room.mu.Lock()
+    if publisherID != "" && room.peers[publisherID] == nil {
+        room.mu.Unlock()
+        return nil, errPeerNotFound
+    }
+    for _, other := range room.recordings {
+        if other.PublisherID == publisherID && other.recording() {
+            room.mu.Unlock()
+            return nil, errRecordingActive
+        }
+    }
+    if err := rec.makeDir(filepath.Join(recordDir, fileName(room.ID))); err != nil {
+        room.mu.Unlock()
+        return nil, err
+    }
+    room.recordings = append(room.recordings, rec)
+    published := room.publishedTracks()
+    room.mu.Unlock()
+
+    log.Printf("⏺️ Recording %s started in %s", rec.ID, rec.Dir)
+    for _, pt := range published {
+        rec.add(pt)
+    }
+    rec.writeManifest()
+    return rec, nil
+}
+
+// makeDir creates the recording's directory in parent. A recording started
+// in the same second as an earlier one, whose directory already exists, has
+// a counter appended to its ID rather than overwriting that one's files.
+func (rec *Recording) makeDir(parent string) error {
+    if err := os.MkdirAll(parent, 0o755); err != nil {
+        return err
+    }
+    id := rec.ID
+    for n := 2; ; n++ {
+        dir := filepath.Join(parent, id)
+        err := os.Mkdir(dir, 0o755)
+        if err == nil {
+            rec.ID, rec.Dir = id, dir
+            return nil
+        }
+        if !errors.Is(err, fs.ErrExist) {
+            return err
+        }
+        id = fmt.Sprintf("%s-%d", rec.ID, n)
+    }
+}
+
+// stopRecording stops the room's recording of publisherID, or of the whole
+// room if it is empty.
+func (room *Room) stopRecording(publisherID string) (*Recording, error) {
+    for _, rec := range room.activeRecordings() {
+        if rec.PublisherID == publisherID {
+            rec.stop()
+            return rec, nil
+        }
+    }
+    return nil, errNotRecording
+}
+
+// activeRecordings returns the room's recordings that have not stopped.
+func (room *Room) activeRecordings() []*Recording {
+    room.mu.RLock()
+    defer room.mu.RUnlock()
+
+    var active []*Recording
+    for _, rec := range room.recordings {
+        if rec.recording() {
+            active = append(active, rec)
+        }
+    }
+    return active
+}
+
+// recordTrack adds a newly published track to the room's recordings.
+func (room *Room) recordTrack(pt *PublishedTrack) {
+    for _, rec := range room.activeRecordings() {
+        rec.add(pt)
+    }
+}
+
+// stopRecordingTrack finishes the files of an unpublished track.
+func (room *Room) stopRecordingTrack(pt *PublishedTrack) {
+    for _, rec := range room.activeRecordings() {
+        rec.remove(pt)
+    }
+}
+
+// leaveRecordings finalizes the files of a publisher leaving the room, so
+// they are complete even while the rest of the room is still recorded. A
+// recording of that publisher alone ends with it.
+func (room *Room) leaveRecordings(publisherID string) {
+    for _, rec := range room.activeRecordings() {
+        if rec.PublisherID == publisherID {
+            rec.stop()
+        } else {
+            rec.removePublisher(publisherID)
+        }
+    }
+}
+
+// stopRecordings stops every recording of a room that is being destroyed.
+func (room *Room) stopRecordings() {
+    for _, rec := range room.activeRecordings() {
+        rec.stop()
+    }
+}
+
+func (rec *Recording) recording() bool {
+    rec.mu.Lock()
+    defer rec.mu.Unlock()
+    return rec.stopped.IsZero()
+}
+
+// add starts recording a published track, unless it is already recorded or
+// belongs to another publisher than the one being recorded. WebM recordings
+// write it to its publisher's file if its codec fits there, and to a file
+// of its own if not.
+func (rec *Recording) add(pt *PublishedTrack) {
+    if rec.PublisherID != "" && pt.Publisher.ID != rec.PublisherID {
+        return
+    }
+    codec := pt.Remote.Codec()
+
+    rec.mu.Lock()
+    defer rec.mu.Unlock()
+
+    if !rec.stopped.IsZero() || rec.active[pt.Key] != nil || pt.ended.Load() {
+        return
+    }
+
+    tr := &trackRecorder{
+        pt:    pt,
+        queue: newSendQueue(recordQueueSize, DropOldest),
+        done:  make(chan struct{}),
+    }
+    if layers := pt.Layers(); len(layers) > 0 {
+        tr.rid = layers[len(layers)-1].RID
+    }
+
+    if rec.Format == RecordWebM {
+        if m := rec.muxer(pt.Publisher.ID); m != nil {
+            if src, ok := m.attach(pt, pt.layer(tr.rid)); ok {
+                tr.muxer, tr.writer = m, src
+            } else {
+                log.Printf("⚠️ Recording %s: can't add %s in %s to %s, recording it separately", rec.ID, pt.Key, codec.MimeType, m.file.Path)
+            }
+        }
+    }
+    if tr.writer == nil {
+        format, ok := recordingFormats[strings.ToLower(codec.MimeType)]
+        if !ok {
+            log.Printf("⚠️ Recording %s: can't record %s in %s", rec.ID, pt.Key, codec.MimeType)
+            return
+        }
+        // A track republished with the same key, as when its publisher
+        // renegotiates, gets a file of its own.
+        name := fileName(strings.ReplaceAll(pt.Key, "/", "-"))
+        count := 0
+        for _, other := range rec.recorded {
+            if other.muxer == nil && other.file.TrackID == pt.Key {
+                count++
+            }
+        }
+        if count > 0 {
+            name += fmt.Sprintf("-%d", count+1)
+        }
+        name += format.ext
+        writer, err := format.open(filepath.Join(rec.Dir, name), codec)
+        if err != nil {
+            log.Printf("❌ Recording %s: couldn't create %s: %v", rec.ID, name, err)
+            return
+        }
+        tr.writer = writer
+        tr.file = RecordedFile{
+            Path:        name,
+            TrackID:     pt.Key,
+            PublisherID: pt.Publisher.ID,
+            Kind:        pt.Remote.Kind().String(),
+            MimeType:    codec.MimeType,
+            StartedAt:   time.Now(),
+        }
+    }
+
+    rec.active[pt.Key] = tr
+    rec.recorded = append(rec.recorded, tr)
+    go tr.run("Recording " + rec.ID)
+    pt.addRecorder(tr)
+
+    // Video files can only start at a keyframe.
+    if pt.Remote.Kind() == webrtc.RTPCodecTypeVideo {
+        pt.requestKeyframe(tr.rid, false)
+    }
+    if tr.muxer != nil {
+        log.Printf("⏺️ Recording %s: %s to %s", rec.ID, pt.Key, tr.muxer.file.Path)
+    } else {
+        log.Printf("⏺️ Recording %s: %s to %s", rec.ID, pt.Key, tr.file.Path)
+    }
+}
+
+// muxer returns the open WebM file of a publisher, creating it if needed.
+// Callers must hold rec.mu.
+func (rec *Recording) muxer(publisherID string) *webmMuxer {
+    if m := rec.muxers[publisherID]; m != nil {
+        return m
+    }
+
+    // A publisher's file is only closed when it leaves, but IDs chosen by
+    // clients may come back.
+    name := fileName(publisherID)
+    count := 0
+    for _, m := range rec.muxed {
+        if m.file.PublisherID == publisherID {
+            count++
+        }
+    }
+    if count > 0 {
+        name += fmt.Sprintf("-%d", count+1)
+    }
+    name += ".webm"
+
+    m, err := newWebMMuxer(filepath.Join(rec.Dir, name), RecordedFile{
+        Path:        name,
+        PublisherID: publisherID,
+        StartedAt:   time.Now(),
+    })
+    if err != nil {
+        log.Printf("❌ Recording %s: couldn't create %s: %v", rec.ID, name, err)
+        return nil
+    }
+    rec.muxers[publisherID] = m
+    rec.muxed = append(rec.muxed, m)
+    return m
+}
+
+// closeMuxer finalizes a WebM file once its tracks are finished.
+func (rec *Recording) closeMuxer(m *webmMuxer) {
+    if err := m.close(); err != nil {
+        log.Printf("⚠️ Recording %s: couldn't finalize %s: %v", rec.ID, m.file.Path, err)
+    }
+}
+
+// remove finishes the file of a track that is no longer published.
+func (rec *Recording) remove(pt *PublishedTrack) {
+    rec.mu.Lock()
+    tr := rec.active[pt.Key]
+    delete(rec.active, pt.Key)
+    rec.mu.Unlock()
+
+    if tr != nil {
+        rec.finish(tr)
+        rec.writeManifest()
+    }
+}
+
+// stop finishes every file of the recording and writes its final manifest.
+func (rec *Recording) stop() {
+    rec.mu.Lock()
+    if !rec.stopped.IsZero() {
+        rec.mu.Unlock()
+        return
+    }
+    rec.stopped = time.Now()
+    active := rec.active
+    rec.active = make(map[string]*trackRecorder)
+    rec.mu.Unlock()
+
+    for _, tr := range active {
+        rec.finish(tr)
+    }
+
+    rec.mu.Lock()
+    muxers := rec.muxers
+    rec.muxers = make(map[string]*webmMuxer)
+    rec.mu.Unlock()
+
+    for _, m := range muxers {
+        rec.closeMuxer(m)
+    }
+    rec.writeManifest()
+    log.Printf("⏹️ Recording %s stopped", rec.ID)
+}
+
+// removePublisher finishes the files of a publisher that left.
+func (rec *Recording) removePublisher(publisherID string) {
+    rec.mu.Lock()
+    var leaving []*trackRecorder
+    for key, tr := range rec.active {
+        if tr.pt.Publisher.ID == publisherID {
+            leaving = append(leaving, tr)
+            delete(rec.active, key)
+        }
+    }
+    m := rec.muxers[publisherID]
+    delete(rec.muxers, publisherID)
+    rec.mu.Unlock()
+
+    if len(leaving) == 0 && m == nil {
+        return
+    }
+    for _, tr := range leaving {
+        rec.finish(tr)
+    }
+    if m != nil {
+        rec.closeMuxer(m)
+    }
+    rec.writeManifest()
+}
+
+// finish stops a track recorder and marks the end of its file.
+func (rec *Recording) finish(tr *trackRecorder) {
+    tr.stop()
+
+    rec.mu.Lock()
+    ended := time.Now()
+    tr.file.EndedAt = &ended
+    rec.mu.Unlock()
+}
+
+// stop detaches a track recorder from its track and waits for it to write
+// what is still queued and close its writer.
+func (tr *trackRecorder) stop() {
+    tr.pt.removeRecorder(tr)
+    tr.queue.finish()
+    <-tr.done
+}
+
+// run writes the packets queued for a track recorder until it is stopped.
+// Errors are logged with the name of what it records for.
+func (tr *trackRecorder) run(name string) {
+    defer close(tr.done)
+
+    failed := false
+    for {
+        item, ok := tr.queue.pop()
+        if !ok {
+            break
+        }
+        if err := tr.writer.WriteRTP(&item.buf.pkt); err != nil && !failed {
+            log.Printf("⚠️ %s: couldn't write %s: %v", name, tr.pt.Key, err)
+            failed = true
+        }
+        tr.packets.Add(1)
+        item.buf.release()
+    }
+    if err := tr.writer.Close(); err != nil {
+        log.Printf("⚠️ %s: couldn't close %s: %v", name, tr.pt.Key, err)
+    }
+}
+
+// Manifest describes the recording and the files written so far.
+func (rec *Recording) Manifest() RecordingManifest {
+    rec.mu.Lock()
+    defer rec.mu.Unlock()
+
+    manifest := RecordingManifest{
+        ID:           rec.ID,
+        Room:         rec.Room.ID,
+        PublisherID:  rec.PublisherID,
+        Dir:          rec.Dir,
+        Format:       rec.Format,
+        StartedAt:    rec.started,
+        Participants: []string{},
+        Files:        []RecordedFile{},
+    }
+    if !rec.stopped.IsZero() {
+        stopped := rec.stopped
+        manifest.StoppedAt = &stopped
+    }
+    for _, tr := range rec.recorded {
+        if tr.muxer != nil {
+            continue
+        }
+        file := tr.file
+        file.Packets = tr.packets.Load()
+        manifest.Files = append(manifest.Files, file)
+    }
+    for _, m := range rec.muxed {
+        manifest.Files = append(manifest.Files, m.manifestFile())
+    }
+    participants := make(map[string]bool)
+    for _, file := range manifest.Files {
+        if !participants[file.PublisherID] {
+            participants[file.PublisherID] = true
+            manifest.Participants = append(manifest.Participants, file.PublisherID)
+        }
+    }
+    sort.Strings(manifest.Participants)
+    return manifest
+}
+
+// writeManifest replaces the recording's manifest.json.
+func (rec *Recording) writeManifest() {
+    data, err := json.MarshalIndent(rec.Manifest(), "", "  ")
+    if err != nil {
+        log.Printf("❌ Recording %s: couldn't encode manifest: %v", rec.ID, err)
+        return
+    }
+    path := filepath.Join(rec.Dir, "manifest.json")
+    if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+        log.Printf("❌ Recording %s: couldn't write manifest: %v", rec.ID, err)
+        return
+    }
+    if err := os.Rename(path+".tmp", path); err != nil {
+        log.Printf("❌ Recording %s: couldn't write manifest: %v", rec.ID, err)
+    }
+}
+
+// recorderList returns the recorders tapping pt. The slice must not be
+// modified.
+func (pt *PublishedTrack) recorderList() []*trackRecorder {
+    if list := pt.recorders.Load(); list != nil {
+        return *list
+    }
+    return nil
+}
+
+func (pt *PublishedTrack) addRecorder(tr *trackRecorder) {
+    pt.recordersMu.Lock()
+    defer pt.recordersMu.Unlock()
+
+    old := pt.recorderList()
+    list := append(old[:len(old):len(old)], tr)
+    pt.recorders.Store(&list)
+}
+
+func (pt *PublishedTrack) removeRecorder(tr *trackRecorder) {
+    pt.recordersMu.Lock()
+    defer pt.recordersMu.Unlock()
+
+    var list []*trackRecorder
+    for _, other := range pt.recorderList() {
+        if other != tr {
+            list = append(list, other)
+        }
+    }
+    pt.recorders.Store(&list)
+}
+
+// record queues a packet from one layer of pt for the recorders of that
+// layer, each queue holding its own reference to buf.
+func (pt *PublishedTrack) record(rid string, buf *packetBuffer, keyframe bool) {
+    for _, tr := range pt.recorderList() {
+        if tr.rid != rid {
+            continue
+        }
+        buf.retain()
+        tr.queue.push(queuedPacket{rid: rid, buf: buf, keyframe: keyframe}, false)
+    }
+}
+
+// vp9Writer writes VP9 to an IVF file, which Pion's IVF writer only does
+// for VP8 and AV1. Frames are timestamped with the 90 kHz RTP clock,
+// starting from the first keyframe.
+type vp9Writer struct {
+    f       *os.File
+    frame   []byte
+    count   uint32
+    firstTS uint32
+    started bool
+}
+
+func newVP9Writer(path string) (*vp9Writer, error) {
+    f, err := os.Create(path)
+    if err != nil {
+        return nil, err
+    }
+
+    header := make([]byte, 32)
+    copy(header[0:], "DKIF")
+    binary.LittleEndian.PutUint16(header[6:], 32)
+    copy(header[8:], "VP90")
+    binary.LittleEndian.PutUint16(header[12:], 640)
+    binary.LittleEndian.PutUint16(header[14:], 480)
+    binary.LittleEndian.PutUint32(header[16:], 90000)
+    binary.LittleEndian.PutUint32(header[20:], 1)
+    if _, err := f.Write(header); err != nil {
+        f.Close()
+        return nil, err
+    }
+    return &vp9Writer{f: f}, nil
+}
+
+func (w *vp9Writer) WriteRTP(pkt *rtp.Packet) error {
+    if w.f == nil {
+        return os.ErrClosed
+    }
+    var vp9 codecs.VP9Packet
+    if _, err := vp9.Unmarshal(pkt.Payload); err != nil {
+        return err
+    }
+    if !w.started {
+        // A frame that is not predicted from earlier ones is a keyframe.
+        if !vp9.B || vp9.P {
+            return nil
+        }
+        w.started = true
+        w.firstTS = pkt.Timestamp
+    }
+
+    if vp9.B {
+        w.frame = w.frame[:0]
+    }
+    w.frame = append(w.frame, vp9.Payload...)
+    if !vp9.E {
+        return nil
+    }
+
+    header := make([]byte, 12)
+    binary.LittleEndian.PutUint32(header[0:], uint32(len(w.frame)))
+    binary.LittleEndian.PutUint64(header[4:], uint64(pkt.Timestamp-w.firstTS))
+    if _, err := w.f.Write(header); err != nil {
+        return err
+    }
+    if _, err := w.f.Write(w.frame); err != nil {
+        return err
+    }
+    w.count++
+    return nil
+}
+
+// Close fills in the frame count and closes the file. Closing twice does
+// nothing.
+func (w *vp9Writer) Close() error {
+    if w.f == nil {
+        return nil
+    }
+    defer func() { w.f = nil }()
+
+    count := make([]byte, 4)
+    binary.LittleEndian.PutUint32(count, w.count)
+    if _, err := w.f.WriteAt(count, 24); err != nil {
+        w.f.Close()
+        return err
+    }
+    return w.f.Close()
+}
+
+// recordingRequest is the optional body of a request starting a recording.
+type recordingRequest struct {
+    Format string `json:"format"`
+}
+
+// recordingHandler starts or stops recording a room, or the publisher
+// named by the {peer} path value if there is one, and returns the
+// recording's manifest.
+func recordingHandler(start bool) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if !authorizeManager(w, r) {
+            return
+        }
+        room := rooms.get(roomID(r))
+        if room == nil {
+            http.Error(w, "Room not found", http.StatusNotFound)
+            return
+        }
+
+        publisherID := r.PathValue("peer")
+        var rec *Recording
+        var err error
+        if start {
+            req := recordingRequest{Format: recordFormat}
+            if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+                http.Error(w, "Invalid recording request", http.StatusBadRequest)
+                return
+            }
+            if err := validRecordFormat(req.Format); err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+            }
+            rec, err = room.startRecording(publisherID, req.Format)
+        } else {
+            rec, err = room.stopRecording(publisherID)
+        }
+        switch {
+        case errors.Is(err, errPeerNotFound), errors.Is(err, errNotRecording):
+            http.Error(w, err.Error(), http.StatusNotFound)
+            return
+        case errors.Is(err, errRecordingActive):
+            http.Error(w, err.Error(), http.StatusConflict)
+            return
+        case err != nil:
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        json.NewEncoder(w).Encode(rec.Manifest())
+    }
+}
+
+// recordingsHandler lists the manifests of the room's recordings, running
+// or stopped.
+func recordingsHandler(w http.ResponseWriter, r *http.Request) {
+    if _, ok := authorize(w, r); !ok {
+        return
+    }
+    room := rooms.get(roomID(r))
+    if room == nil {
+        http.Error(w, "Room not found", http.StatusNotFound)
+        return
+    }
+
+    room.mu.RLock()
+    recordings := append([]*Recording(nil), room.recordings...)
+    room.mu.RUnlock()
+
+    manifests := []RecordingManifest{}
+    for _, rec := range recordings {
+        manifests = append(manifests, rec.Manifest())
+    }
+    json.NewEncoder(w).Encode(manifests)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+    "log"
+    "sync"
+
+    "github.com/pion/interceptor"
+    "github.com/pion/interceptor/pkg/nack"
+    "github.com/pion/rtcp"
+    "github.com/pion/webrtc/v3"
+)
+
+// Number of recent packets kept per published layer to answer NACKs from,
+// by media kind. Zero disables retransmission for that kind. Set from the
+// -nack-buffer-audio and -nack-buffer-video flags.
+var (
+    nackBufferAudio = 128
+    nackBufferVideo = 1024
+)
+
+func nackBufferSize(kind webrtc.RTPCodecType) int {
+    if kind == webrtc.RTPCodecTypeAudio {
+        return nackBufferAudio
+    }
+    return nackBufferVideo
+}
+
+// registerInterceptors is webrtc.RegisterDefaultInterceptors without the
+// NACK responder: subscriber NACKs are answered from the published track's
+// packetHistory instead, which is shared by all subscribers rather than
+// duplicated in every sender. Unlike the defaults, NACKs are negotiated
+// for audio too, so audio tracks' histories have something to answer.
+func registerInterceptors(m *webrtc.MediaEngine, i *interceptor.Registry) error {
+    generator, err := nack.NewGeneratorInterceptor()
+    if err != nil {
+        return err
+    }
+    m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack"}, webrtc.RTPCodecTypeAudio)
+    m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack"}, webrtc.RTPCodecTypeVideo)
+    m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"}, webrtc.RTPCodecTypeVideo)
+    i.Add(generator)
+
+    if err := webrtc.ConfigureRTCPReports(i); err != nil {
+        return err
+    }
+    return webrtc.ConfigureTWCCSender(m, i)
+}
+
+// packetHistory is a ring buffer of the most recent RTP packets of one
+// published layer, indexed by sequence number.
+type packetHistory struct {
+    mu    sync.Mutex
+    slots []historySlot
+}
+
+type historySlot struct {
+    seq   uint16
+    valid bool
+    data  []byte
+}
+
+// newPacketHistory returns a history holding at least size packets, or nil,
+// which stores nothing, if size is not positive. The size is rounded up to a
+// power of two so that slots stay in order across sequence number
+// wraparound.
+func newPacketHistory(size int) *packetHistory {
+    if size <= 0 {
+        return nil
+    }
+    slots := 1
+    for slots < min(size, 1<<16) {
+        slots <<= 1
+    }
+    return &packetHistory{slots: make([]historySlot, slots)}
+}
+
+// push stores a copy of a marshaled packet, evicting the oldest one.
+func (h *packetHistory) push(seq uint16, raw []byte) {
+    if h == nil {
+        return
+    }
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    slot := &h.slots[int(seq)%len(h.slots)]
+    slot.seq = seq
+    slot.valid = true
+    slot.data = append(slot.data[:0], raw...)
+}
+
+// get copies the packet with the given sequence number into a new buffer.
+// It returns nil if the packet is no longer, or was never, buffered.
+func (h *packetHistory) get(seq uint16) *packetBuffer {
+    if h == nil {
+        return nil
+    }
+    h.mu.Lock()
+    slot := &h.slots[int(seq)%len(h.slots)]
+    if !slot.valid || slot.seq != seq {
+        h.mu.Unlock()
+        return nil
+    }
+    buf := getPacketBuffer()
+    n := copy(buf.data, slot.data)
+    h.mu.Unlock()
+
+    if err := buf.unmarshal(n); err != nil {
+        buf.release()
+        return nil
+    }
+    return buf
+}
+
+// retransmit answers a subscriber's NACK from the history of the layer it
+// is receiving, queueing them behind the packets already waiting, and
+// returns that layer with the packets no longer buffered, for the caller to
+// ask the publisher for once it has released the lock.
+// Packets sent before the last layer switch came from another layer and are
+// not retransmitted. Callers must hold the subscriber's mu.
+func (out *ForwardedTrack) retransmit(nack *rtcp.TransportLayerNack) (*simulcastLayer, []uint16) {
+    if !out.started {
+        return nil, nil
+    }
+    layer := out.Published.layer(out.currentLayer)
+    if layer == nil {
+        return nil, nil
+    }
+
+    var missing []uint16
+    for _, pair := range nack.Nacks {
+        for _, seq := range pair.PacketList() {
+            out.stats.nacked++
+            if int16(seq-out.layerStartSeq) < 0 || int16(seq-out.lastSeq) > 0 {
+                continue
+            }
+
+            source := seq - out.seqOffset
+            buf := layer.history.get(source)
+            if buf == nil {
+                missing = append(missing, source)
+                continue
+            }
+            buf.pkt.Header = out.rewriteHeader(buf.pkt.Header)
+            out.queue.push(queuedPacket{rid: layer.RID, buf: buf, rewritten: true}, false)
+            out.stats.retransmitted++
+        }
+    }
+
+    out.stats.retransmitRequested += uint64(len(missing))
+    return layer, missing
+}
+
+// requestRetransmission NACKs packets of one layer to its publisher. The
+// resent packets are forwarded like any other.
+func (pt *PublishedTrack) requestRetransmission(layer *simulcastLayer, seqs []uint16) {
+    if pt.ended.Load() || pt.Publisher.closed.Load() {
+        return
+    }
+    nack := &rtcp.TransportLayerNack{
+        MediaSSRC: uint32(layer.Remote.SSRC()),
+        Nacks:     rtcp.NackPairsFromSequenceNumbers(seqs),
+    }
+    if err := pt.Publisher.PC.WriteRTCP([]rtcp.Packet{nack}); err != nil {
+        log.Printf("⚠️ Couldn't send NACK to %s: %v", pt.Publisher.ID, err)
+    }
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+    "testing"
+
+    "github.com/pion/rtp"
+)
+
+func pushPacket(t *testing.T, h *packetHistory, seq uint16) {
+    t.Helper()
+    raw, err := (&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq}, Payload: []byte{byte(seq)}}).Marshal()
+    if err != nil {
+        t.Fatal(err)
+    }
+    h.push(seq, raw)
+}
+
+func TestPacketHistory(t *testing.T) {
+    tests := []struct {
+        name    string
+        size    int
+        pushed  []uint16 // pushed in order
+        present []uint16
+        missing []uint16
+    }{
+        {"recent packets", 4, []uint16{10, 11, 12}, []uint16{10, 11, 12}, []uint16{9, 13}},
+        {"oldest evicted", 4, []uint16{10, 11, 12, 13, 14}, []uint16{11, 12, 13, 14}, []uint16{10}},
+        {"same slot, other sequence number", 4, []uint16{10, 14}, []uint16{14}, []uint16{10, 18}},
+        {"wraparound", 4, []uint16{65534, 65535, 0, 1}, []uint16{65534, 65535, 0, 1}, []uint16{2, 65533}},
+        {"wraparound with a size that doesn't divide 65536", 100, seqRange(65500, 40), seqRange(65500, 40), []uint16{65499, 4}},
+        {"gaps", 8, []uint16{1, 3, 6}, []uint16{1, 3, 6}, []uint16{2, 4, 5}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            h := newPacketHistory(tt.size)
+            for _, seq := range tt.pushed {
+                pushPacket(t, h, seq)
+            }
+            for _, seq := range tt.present {
+                buf := h.get(seq)
+                if buf == nil {
+                    t.Errorf("get(%d) = nil, want the packet", seq)
+                    continue
+                }
+                if buf.pkt.SequenceNumber != seq || len(buf.pkt.Payload) != 1 || buf.pkt.Payload[0] != byte(seq) {
+                    t.Errorf("get(%d) = seq %d, payload %v", seq, buf.pkt.SequenceNumber, buf.pkt.Payload)
+                }
+                buf.release()
+            }
+            for _, seq := range tt.missing {
+                if buf := h.get(seq); buf != nil {
+                    t.Errorf("get(%d) = seq %d, want nil", seq, buf.pkt.SequenceNumber)
+                    buf.release()
+                }
+            }
+        })
+    }
+}
+
+func TestPacketHistoryDisabled(t *testing.T) {
+    h := newPacketHistory(0)
+    if h != nil {
+        t.Fatalf("newPacketHistory(0) = %v, want nil", h)
+    }
+    h.push(1, []byte{0x80, 0, 0, 1})
+    if buf := h.get(1); buf != nil {
+        t.Errorf("get on a disabled history = %v, want nil", buf)
+    }
+}
+
+// seqRange returns n sequence numbers from first on, wrapping around.
+func seqRange(first uint16, n int) []uint16 {
+    seqs := make([]uint16, n)
+    for i := range seqs {
+        seqs[i] = first + uint16(i)
+    }
+    return seqs
+}
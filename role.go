@@ -0,0 +1,67 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+
+    "github.com/pion/webrtc/v3"
+)
+
+// Role is what a peer does in its room, chosen when it joins. Publishers'
+// tracks are forwarded to others but they are never subscribed to
+// anything; subscribers receive tracks but can't send any, so a room can
+// have one presenter and many viewers.
+type Role string
+
+const (
+    RolePublisher  Role = "publisher"
+    RoleSubscriber Role = "subscriber"
+    RoleBoth       Role = "both"
+)
+
+var errSubscriberSends = errors.New("subscribers can't send media")
+
+// parseRole reads the role a client asked to join with, which defaults to
+// both.
+func parseRole(s string) (Role, error) {
+    switch role := Role(s); role {
+    case "":
+        return RoleBoth, nil
+    case RolePublisher, RoleSubscriber, RoleBoth:
+        return role, nil
+    }
+    return "", fmt.Errorf("unknown role %q", s)
+}
+
+// publishes reports whether p's tracks are forwarded to its room.
+func (p *Peer) publishes() bool {
+    return p.Role != RoleSubscriber
+}
+
+// subscribes reports whether p may receive other peers' tracks.
+func (p *Peer) subscribes() bool {
+    return p.Role != RolePublisher
+}
+
+// checkOffer rejects an offer from a subscriber that has an m-line it
+// would send media on.
+func (role Role) checkOffer(offer webrtc.SessionDescription) error {
+    if role != RoleSubscriber {
+        return nil
+    }
+    parsed, err := offer.Unmarshal()
+    if err != nil {
+        return err
+    }
+    for _, md := range parsed.MediaDescriptions {
+        if md.MediaName.Port.Value == 0 || (md.MediaName.Media != "audio" && md.MediaName.Media != "video") {
+            continue
+        }
+        _, recvonly := md.Attribute(webrtc.RTPTransceiverDirectionRecvonly.String())
+        _, inactive := md.Attribute(webrtc.RTPTransceiverDirectionInactive.String())
+        if !recvonly && !inactive {
+            return fmt.Errorf("%w: %s m-line is not recvonly", errSubscriberSends, md.MediaName.Media)
+        }
+    }
+    return nil
+}
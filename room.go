@@ -0,0 +1,317 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+    "sort"
+    "sync"
+)
+
+// defaultRoom is the room used by the original /offer, /answer and
+// /renegotiate routes that carry no room in their path.
+const defaultRoom = "default"
+
+// RoomSettings holds the per-room policy that can be changed at runtime
+// through PATCH /rooms/{room}.
+type RoomSettings struct {
+    // AutoSubscribe subscribes every peer to every track published in the
+    // room. With it off, peers only receive what they ask for.
+    AutoSubscribe bool `json:"auto_subscribe"`
+
+    // LastN is how many publishers' video each subscriber receives, most
+    // recently active first, unless the subscriber sets its own. Pinned
+    // publishers come on top. lastNUnlimited forwards all video.
+    LastN int `json:"last_n"`
+}
+
+// defaultRoomSettings is applied to every newly created room.
+var defaultRoomSettings = RoomSettings{AutoSubscribe: true, LastN: lastNUnlimited}
+
+// Room is an isolated set of peers. Media published by a peer is only
+// forwarded to the other peers of its room.
+type Room struct {
+    ID string
+
+    // refs counts peers that are joining or have joined the room; it is
+    // guarded by the registry lock and the room is destroyed at zero.
+    refs int
+
+    mu       sync.RWMutex
+    peers    map[string]*Peer
+    tracks   map[string]*PublishedTrack
+    settings RoomSettings
+
+    speakers *speakerDetector
+
+    // recordings lists every recording made of the room, running or
+    // stopped.
+    recordings []*Recording
+
+    // hls holds the HLS streams of the room's publishers.
+    hls map[string]*hlsStream
+}
+
+// RoomInfo is the JSON view of a room returned by GET /rooms/{room}.
+type RoomInfo struct {
+    ID       string       `json:"id"`
+    Settings RoomSettings `json:"settings"`
+    Peers    []PeerInfo   `json:"peers"`
+    Tracks   []TrackInfo  `json:"tracks"`
+}
+
+// PeerInfo describes a peer in a room listing.
+type PeerInfo struct {
+    ID       string `json:"id"`
+    Role     Role   `json:"role"`
+    Identity string `json:"identity,omitempty"`
+}
+
+// roomRegistry creates rooms on first join and destroys them once empty.
+// It also keeps every peer, in any room, by its public ID and by its
+// secret, so that neither is ever handed out twice.
+type roomRegistry struct {
+    mu       sync.Mutex
+    rooms    map[string]*Room
+    peers    map[string]*Peer
+    sessions map[string]*Peer
+}
+
+var rooms = &roomRegistry{
+    rooms:    make(map[string]*Room),
+    peers:    make(map[string]*Peer),
+    sessions: make(map[string]*Peer),
+}
+
+// acquire returns the room with the given ID, creating it if needed, and
+// takes a reference on it. Every acquire must be paired with a release.
+func (r *roomRegistry) acquire(id string) *Room {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    room, ok := r.rooms[id]
+    if !ok {
+        room = &Room{
+            ID:       id,
+            peers:    make(map[string]*Peer),
+            tracks:   make(map[string]*PublishedTrack),
+            hls:      make(map[string]*hlsStream),
+            settings: defaultRoomSettings,
+            speakers: newSpeakerDetector(),
+        }
+        go room.speakers.run(room)
+        r.rooms[id] = room
+        log.Printf("🏠 Room %s created", id)
+    }
+    room.refs++
+    return room
+}
+
+// release drops a reference taken by acquire and destroys the room when
+// nobody is left in it.
+func (r *roomRegistry) release(room *Room) {
+    r.mu.Lock()
+
+    room.refs--
+    if room.refs > 0 {
+        r.mu.Unlock()
+        return
+    }
+    delete(r.rooms, room.ID)
+    close(room.speakers.stop)
+    r.mu.Unlock()
+
+    room.stopRecordings()
+    log.Printf("🏚️ Room %s destroyed", room.ID)
+}
+
+func (r *roomRegistry) get(id string) *Room {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.rooms[id]
+}
+
+// register gives p an ID and a secret that no other peer has, generating
+// new ones on the off chance they collide.
+func (r *roomRegistry) register(p *Peer) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    for p.ID = generatePeerID(); r.peers[p.ID] != nil; p.ID = generatePeerID() {
+        log.Printf("⚠️ Peer ID %s is taken, generating another", p.ID)
+    }
+    for p.secret = newPeerSecret(); r.sessions[p.secret] != nil; p.secret = newPeerSecret() {
+        log.Printf("⚠️ [%s] Peer secret is taken, generating another", p.ID)
+    }
+    r.peers[p.ID] = p
+    r.sessions[p.secret] = p
+}
+
+// unregister frees p's ID and secret.
+func (r *roomRegistry) unregister(p *Peer) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    if r.peers[p.ID] == p {
+        delete(r.peers, p.ID)
+    }
+    if r.sessions[p.secret] == p {
+        delete(r.sessions, p.secret)
+    }
+}
+
+// session returns the peer whose secret is given, if any.
+func (r *roomRegistry) session(secret string) *Peer {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.sessions[secret]
+}
+
+// join makes p a member of the room and, if the room auto-subscribes and p
+// doesn't only publish, subscribes it to every track already published
+// there.
+func (room *Room) join(p *Peer) {
+    room.mu.Lock()
+    room.peers[p.ID] = p
+    settings := room.settings
+    published := room.publishedTracks()
+    room.mu.Unlock()
+    if p.publishes() {
+        room.speakers.add(p.ID)
+    }
+
+    if settings.AutoSubscribe && p.subscribes() && !p.offerless {
+        for _, pt := range published {
+            if err := p.subscribe(pt); err != nil {
+                log.Printf("⚠️ Couldn't subscribe %s to %s: %v", p.ID, pt.Key, err)
+            }
+        }
+    }
+    room.applyLastN()
+    p.sendTracks(room.Tracks())
+    if speaker := room.Speaker().SpeakerID; speaker != "" {
+        p.sendSpeaker(speaker)
+    }
+}
+
+func (room *Room) removePeer(p *Peer) {
+    room.mu.Lock()
+    if room.peers[p.ID] == p {
+        delete(room.peers, p.ID)
+    }
+    room.mu.Unlock()
+}
+
+// Peer returns the peer with the given ID, or nil if it is not in the room.
+func (room *Room) Peer(id string) *Peer {
+    room.mu.RLock()
+    defer room.mu.RUnlock()
+    return room.peers[id]
+}
+
+// Settings returns the room's current settings.
+func (room *Room) Settings() RoomSettings {
+    room.mu.RLock()
+    defer room.mu.RUnlock()
+    return room.settings
+}
+
+// forEachPeer calls fn for every peer in the room until fn returns false.
+// fn runs without the room lock held, so it may look at the room itself.
+func (room *Room) forEachPeer(fn func(*Peer) bool) {
+    room.mu.RLock()
+    peers := make([]*Peer, 0, len(room.peers))
+    for _, p := range room.peers {
+        peers = append(peers, p)
+    }
+    room.mu.RUnlock()
+
+    for _, p := range peers {
+        if !fn(p) {
+            return
+        }
+    }
+}
+
+// roomID returns the room named in the request path, or defaultRoom for the
+// routes that predate rooms.
+func roomID(r *http.Request) string {
+    if id := r.PathValue("room"); id != "" {
+        return id
+    }
+    return defaultRoom
+}
+
+// lookupPeer checks a request's token and resolves its {room} and {peer}
+// path values, writing an error and returning nil if the token doesn't
+// pass or either does not exist.
+func lookupPeer(w http.ResponseWriter, r *http.Request) *Peer {
+    if _, ok := authorize(w, r); !ok {
+        return nil
+    }
+    room := rooms.get(roomID(r))
+    if room == nil {
+        http.Error(w, "Room not found", http.StatusNotFound)
+        return nil
+    }
+    peer := room.Peer(r.PathValue("peer"))
+    if peer == nil {
+        http.Error(w, "Peer not found", http.StatusNotFound)
+        return nil
+    }
+    return peer
+}
+
+// roomSettingsRequest is the body of PATCH /rooms/{room}. Fields left out
+// are unchanged.
+type roomSettingsRequest struct {
+    AutoSubscribe *bool `json:"auto_subscribe"`
+    LastN         *int  `json:"last_n"`
+}
+
+// roomHandler reports a room's peers, tracks and settings on GET, and
+// updates its settings on PATCH. Fields missing from a PATCH body are left
+// unchanged.
+func roomHandler(w http.ResponseWriter, r *http.Request) {
+    claims, ok := authorize(w, r)
+    if !ok {
+        return
+    }
+    room := rooms.get(roomID(r))
+    if room == nil {
+        http.Error(w, "Room not found", http.StatusNotFound)
+        return
+    }
+
+    if r.Method == http.MethodPatch {
+        if !claims.manages() {
+            http.Error(w, errNotManager.Error(), http.StatusForbidden)
+            return
+        }
+        var req roomSettingsRequest
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.LastN != nil && *req.LastN < lastNUnlimited {
+            http.Error(w, "Invalid settings", http.StatusBadRequest)
+            return
+        }
+        room.mu.Lock()
+        settings := room.settings
+        if req.AutoSubscribe != nil {
+            settings.AutoSubscribe = *req.AutoSubscribe
+        }
+        if req.LastN != nil {
+            settings.LastN = *req.LastN
+        }
+        room.settings = settings
+        room.mu.Unlock()
+        log.Printf("⚙️ Room %s settings: %+v", room.ID, settings)
+        room.applyLastN()
+    }
+
+    info := RoomInfo{ID: room.ID, Settings: room.Settings(), Peers: []PeerInfo{}, Tracks: room.Tracks()}
+    room.forEachPeer(func(p *Peer) bool {
+        info.Peers = append(info.Peers, PeerInfo{ID: p.ID, Role: p.Role, Identity: p.Identity})
+        return true
+    })
+    sort.Slice(info.Peers, func(i, j int) bool { return info.Peers[i].ID < info.Peers[j].ID })
+    json.NewEncoder(w).Encode(info)
+}
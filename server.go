@@ -2,293 +2,426 @@ package main
 
 import (
     "encoding/json"
-    "fmt"
+    "errors"
+    "flag"
     "log"
-    "math/rand"
     "net/http"
+    "os"
+    "strings"
     "sync"
+    "sync/atomic"
     "time"
     "github.com/cilium/ebpf"
+    "github.com/pion/interceptor"
+    "github.com/pion/interceptor/pkg/cc"
+    "github.com/pion/sdp/v3"
     "github.com/pion/webrtc/v3"
 )
 
 type Peer struct {
     ID               string
+    Room             *Room
     PC               *webrtc.PeerConnection
-    OutTracks        map[string]*webrtc.TrackLocalStaticRTP
-    InTracks         map[string]*webrtc.TrackRemote      
+    OutTracks        map[string]*ForwardedTrack
+    InTracks         map[string]*PublishedTrack
     OfferChan        chan webrtc.SessionDescription
     RemoteAnswerChan chan webrtc.SessionDescription
     mu               sync.Mutex
+
+    // signal is the peer's WebSocket signaling connection, if it has one.
+    // Peers without one fall back to the /renegotiate polling flow.
+    // localCandidates holds server candidates not yet delivered to the client.
+    signal          *signalConn
+    localCandidates []webrtc.ICECandidateInit
+    signalMu        sync.Mutex
+
+    // negotiationMu serializes offer/answer rounds. pendingNegotiation is
+    // set when a renegotiation is requested while an offer is outstanding,
+    // and pendingCandidates holds client candidates that arrived before a
+    // remote description.
+    negotiationMu      sync.Mutex
+    pendingNegotiation bool
+    pendingCandidates  []webrtc.ICECandidateInit
+
+    // closed is set once teardown starts so the forwarding loops stop
+    // attaching new tracks to or from this peer.
+    closed          atomic.Bool
+    closeOnce       sync.Once
+    disconnectTimer *time.Timer
+
+    // estimator is the TWCC bandwidth estimate for media sent to the
+    // peer, and bandwidth what the peer reported itself. The latter is
+    // guarded by mu.
+    estimator cc.BandwidthEstimator
+    bandwidth bandwidthState
+
+    // lastN overrides the room's Last-N limit for the video p receives,
+    // and pinnedPeers are publishers whose video p receives regardless.
+    // Guarded by mu.
+    lastN       *int
+    pinnedPeers map[string]bool
+
+    // Role is what the peer does in its room. offerless is set for peers
+    // that joined over WHIP or WHEP, which give the SFU no way to send
+    // them offers: WHEP players only receive the tracks attached when
+    // they joined. Both are set before the peer's offer is applied.
+    Role      Role
+    offerless bool
+
+    // Identity is who the token the peer joined with names, if signaling
+    // is authenticated. secret is issued when the peer joins, for its
+    // client to present on the peer's signaling routes.
+    Identity string
+    secret   string
+}
+
+// ForwardedTrack is an outbound track a subscriber receives from a publisher
+// in its room, together with the sender that carries it. Key is the
+// published track's trackKey.
+type ForwardedTrack struct {
+    Key         string
+    PublisherID string
+    Published   *PublishedTrack
+    Subscriber  *Peer
+    Track       *forwardTrack
+    Sender      *webrtc.RTPSender
+
+    // queue holds packets from the publisher's read loop until the
+    // track's writer goroutine sends them.
+    queue *sendQueue
+
+    // Simulcast layer selection, and the sequence number and timestamp
+    // rewriting that hides layer switches from the subscriber. Guarded by
+    // the subscriber's mu.
+    currentLayer   string
+    targetLayer    string
+    pinnedLayer    bool
+    requestedLayer string
+    started        bool
+    seqOffset      uint16
+    tsOffset       uint32
+    lastSeq        uint16
+    lastTS         uint32
+    lastWrite      time.Time
+
+    // paused is set while bandwidth allocation holds the track back, and
+    // lastNPaused while its publisher is outside the subscriber's Last-N.
+    // resuming makes the next packet forwarded wait for a keyframe.
+    paused      bool
+    lastNPaused bool
+    resuming    bool
+
+    // filter is the state above that fanOut reads, republished by
+    // syncFilter whenever it changes so that the publisher's read loop
+    // never takes the subscriber's mu.
+    filter atomic.Pointer[layerFilter]
+
+    // layerStartSeq is the first outbound sequence number of the current
+    // layer; only packets from there on can be retransmitted.
+    layerStartSeq uint16
+    stats         forwardStats
+
+    // negotiated is set once the subscriber has answered an offer that
+    // includes the track. Guarded by the subscriber's mu.
+    negotiated bool
 }
 
-var peers sync.Map
+var peerIPMap *ebpf.Map
 
+// iceServers are the STUN servers the SFU and its clients gather
+// candidates with.
+var iceServers = []webrtc.ICEServer{
+    {URLs: []string{"stun:stun.l.google.com:19302"}},
+}
+
+// generatePeerID returns a random public ID for a peer. Other peers see it,
+// so it grants nothing, but it mustn't be guessable either.
 func generatePeerID() string {
-    return fmt.Sprintf("peer-%d", rand.Intn(1000000))
+    return "peer-" + randomString(12)
 }
 
-func newPeerConnection() (*webrtc.PeerConnection, error) {
-    config := webrtc.Configuration{
-        ICEServers: []webrtc.ICEServer{
-            {URLs: []string{"stun:stun.l.google.com:19302"}},
-        },
+// newPeerConnection creates a PeerConnection along with the bandwidth
+// estimator for the media the SFU sends on it.
+func newPeerConnection() (*webrtc.PeerConnection, cc.BandwidthEstimator, error) {
+    config := webrtc.Configuration{ICEServers: iceServers}
+
+    // Same as webrtc.NewPeerConnection, but with the codecs allowed by the
+    // codec policy, plus the MID/RID header extensions needed to receive
+    // simulcast and the audio level one used for speaker detection, and
+    // with NACKs answered by the SFU's own retransmission buffer.
+    m := &webrtc.MediaEngine{}
+    if err := codecConfig.registerCodecs(m); err != nil {
+        return nil, nil, err
+    }
+    if err := webrtc.ConfigureSimulcastExtensionHeaders(m); err != nil {
+        return nil, nil, err
     }
-    return webrtc.NewPeerConnection(config)
+    if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI}, webrtc.RTPCodecTypeAudio); err != nil {
+        return nil, nil, err
+    }
+    i := &interceptor.Registry{}
+    if err := registerInterceptors(m, i); err != nil {
+        return nil, nil, err
+    }
+    congestion, err := registerBandwidthEstimator(m, i)
+    if err != nil {
+        return nil, nil, err
+    }
+    var estimator cc.BandwidthEstimator
+    congestion.OnNewPeerConnection(func(_ string, e cc.BandwidthEstimator) {
+        estimator = e
+    })
+
+    // Packets a publisher resends at our request were usually received
+    // once already, so SRTP replay protection would discard them.
+    s := webrtc.SettingEngine{}
+    s.DisableSRTPReplayProtection(true)
+
+    api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(s))
+    pc, err := api.NewPeerConnection(config)
+    if err != nil {
+        return nil, nil, err
+    }
+    return pc, estimator, nil
 }
 
-func offerHandler(w http.ResponseWriter, r *http.Request) {
-    peerID := generatePeerID()
-    pc, err := newPeerConnection()
+// newPeer creates a PeerConnection for a client joining the given room in
+// the given role, wires up media forwarding and answers the client's offer.
+// setup, if not nil, runs before the offer is applied. The peer holds a
+// reference on the room but is not yet one of its members; callers add it
+// once the answer has been delivered so that no renegotiation offer can
+// overtake it.
+func newPeer(roomID string, role Role, offer webrtc.SessionDescription, setup func(*Peer)) (*Peer, error) {
+    offer, err := codecConfig.checkOffer(offer)
     if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
-        return
+        return nil, err
+    }
+    if err := role.checkOffer(offer); err != nil {
+        return nil, err
+    }
+    pc, estimator, err := newPeerConnection()
+    if err != nil {
+        return nil, err
     }
 
     peer := &Peer{
-        ID:               peerID,
+        Room:             rooms.acquire(roomID),
+        Role:             role,
         PC:               pc,
-        OutTracks:        make(map[string]*webrtc.TrackLocalStaticRTP),
-        InTracks:         make(map[string]*webrtc.TrackRemote),
+        OutTracks:        make(map[string]*ForwardedTrack),
+        InTracks:         make(map[string]*PublishedTrack),
         OfferChan:        make(chan webrtc.SessionDescription, 1),
         RemoteAnswerChan: make(chan webrtc.SessionDescription, 1),
+        estimator:        estimator,
     }
-
-    peers.Store(peerID, peer)
+    rooms.register(peer)
+    peerID := peer.ID
+    go peer.allocateLoop()
 
     pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
         log.Printf("[%s] ICE state: %s", peerID, state.String())
     })
-    log.Print("Got Track from peer", peer.OutTracks)
+    pc.OnICECandidate(peer.onLocalCandidate)
+    pc.OnConnectionStateChange(peer.onConnectionStateChange)
 
-    // pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-    //     log.Printf("[%s] Received track: %s", peerID, track.Kind().String())
-    //     time.Sleep(200 * time.Millisecond)
-    //     go forwardTrackToPeers(peerID, track)
-    // })
     pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-        kind := track.Kind().String()
-        log.Printf("[%s] Received track: %s", peerID, kind)
-    
+        if !peer.publishes() {
+            log.Printf("⚠️ [%s] Ignoring %s track from a subscriber", peerID, track.Kind().String())
+            return
+        }
+        key := trackKey(peerID, track)
+        log.Printf("[%s] Received track: %s (%s) rid=%q", peerID, track.Kind().String(), key, track.RID())
+
+        // Simulcast publishers fire OnTrack once per RID; later layers
+        // join the track published for the first one.
         peer.mu.Lock()
-        peer.InTracks[kind] = track
+        pt := peer.InTracks[key]
+        isNew := pt == nil
+        if isNew {
+            pt = newPublishedTrack(peer, track, receiver)
+            peer.InTracks[key] = pt
+        }
+        layer := pt.addLayer(track)
         peer.mu.Unlock()
-    
-        // Start reading RTP packets from this track
-        go func() {
-            buf := make([]byte, 1500)
-            for {
-                n, _, err := track.Read(buf)
-                if err != nil {
-                    log.Printf("[%s] RTP read error: %v", peerID, err)
-                    return
-                }
-    
-                // Forward to all other peers from InTracks
-                peers.Range(func(_, val any) bool {
-                    other := val.(*Peer)
-                    if other.ID == peerID {
-                        return true // skip sender
-                    }
-    
-                    other.mu.Lock()
-                    defer other.mu.Unlock()
-    
-                    outTrack := other.OutTracks[kind]
-                    if outTrack == nil {
-                        // Create and attach outbound track
-                        newTrack, err := webrtc.NewTrackLocalStaticRTP(track.Codec().RTPCodecCapability, track.ID(), track.StreamID())
-                        if err != nil {
-                            log.Printf("❌ Couldn't create outbound track: %v", err)
-                            return true
-                        }
-    
-                        sender, err := other.PC.AddTrack(newTrack)
-                        if err != nil {
-                            log.Printf("❌ Couldn't add track to peer %s: %v", other.ID, err)
-                            return true
-                        }
-    
-                        go func() {
-                            rtcpBuf := make([]byte, 1500)
-                            for {
-                                if _, _, err := sender.Read(rtcpBuf); err != nil {
-                                    return
-                                }
-                            }
-                        }()
-    
-                        other.OutTracks[kind] = newTrack
-    
-                        // Trigger renegotiation
-                        offer, err := other.PC.CreateOffer(nil)
-                        if err == nil && other.PC.SetLocalDescription(offer) == nil {
-                            if desc := other.PC.LocalDescription(); desc != nil {
-                                select {
-                                case other.OfferChan <- *desc:
-                                    log.Printf("📡 Sent renegotiation offer to %s", other.ID)
-                                default:
-                                    log.Printf("⚠️ OfferChan full for %s", other.ID)
-                                }
-                            }
-                        }
-                    }
-    
-                    // Write RTP packet
-                    if other.OutTracks[kind] != nil {
-                        log.Printf("Sending track from %s to %s", peerID, other.ID)
-                        _, err := other.OutTracks[kind].Write(buf[:n])
-                        if err != nil {
-                            log.Printf("⚠️ RTP forward error to %s: %v", other.ID, err)
-                        }
-                    }
-    
-                    return true
-                })
-            }
-        }()
+
+        if isNew {
+            peer.Room.publish(pt)
+        } else {
+            peer.Room.broadcastTracks()
+        }
+
+        // Start reading RTP packets from this layer
+        go peer.forwardLayer(pt, layer)
+        go pt.readSenderReports(layer)
     })
-    
 
-    var offer webrtc.SessionDescription
-    if err := json.NewDecoder(r.Body).Decode(&offer); err != nil {
-        http.Error(w, "Invalid SDP", http.StatusBadRequest)
-        return
+    if setup != nil {
+        setup(peer)
     }
-
     if err := pc.SetRemoteDescription(offer); err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
-        return
+        peer.close()
+        return nil, err
     }
 
     answer, err := pc.CreateAnswer(nil)
     if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
-        return
+        peer.close()
+        return nil, err
     }
 
     if err := pc.SetLocalDescription(answer); err != nil {
+        peer.close()
+        return nil, err
+    }
+
+    return peer, nil
+}
+
+// offerRequest is the body of /offer: the client's offer, with the role it
+// joins with.
+type offerRequest struct {
+    webrtc.SessionDescription
+    Role string `json:"role,omitempty"`
+}
+
+func offerHandler(w http.ResponseWriter, r *http.Request) {
+    claims, ok := authorize(w, r)
+    if !ok {
+        return
+    }
+    var req offerRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid SDP", http.StatusBadRequest)
+        return
+    }
+    role, err := claims.role(req.Role)
+    if errors.Is(err, errRoleNotAllowed) {
+        http.Error(w, err.Error(), http.StatusForbidden)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    peer, err := newPeer(roomID(r), role, req.SessionDescription, nil)
+    if errors.Is(err, errNoAllowedCodec) || errors.Is(err, errSubscriberSends) {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
+    peer.Identity = claims.identity()
+    peer.Room.join(peer)
 
+    // peer_id is the public ID the room knows the peer by; secret is the
+    // private credential its client sends with it in X-Peer-Secret.
     json.NewEncoder(w).Encode(struct {
         SDP    webrtc.SessionDescription `json:"sdp"`
         PeerID string                    `json:"peer_id"`
-    }{*pc.LocalDescription(), peerID})
+        Secret string                    `json:"secret"`
+    }{*peer.PC.LocalDescription(), peer.ID, peer.secret})
 }
 
-func forwardTrackToPeers(fromPeerID string, track *webrtc.TrackRemote) {
-    buf := make([]byte, 1500)
-    for {
+// renegotiate creates a new offer for the peer and delivers it over the
+// peer's signaling transport. If an earlier offer is still waiting for an
+// answer, another round is scheduled for when that answer arrives.
+func (p *Peer) renegotiate() {
+    if p.offerless {
+        return
+    }
+    p.negotiationMu.Lock()
+    defer p.negotiationMu.Unlock()
 
-        n, _, err := track.Read(buf)
-        if err != nil {
-            log.Printf("[%s] Error reading track: %v", fromPeerID, err)
+    if p.PC.SignalingState() != webrtc.SignalingStateStable {
+        p.pendingNegotiation = true
+        return
+    }
+    p.pendingNegotiation = false
+
+    offer, err := p.PC.CreateOffer(nil)
+    if err != nil {
+        log.Printf("❌ Couldn't create offer for %s: %v", p.ID, err)
+        return
+    }
+    if err := p.PC.SetLocalDescription(offer); err != nil {
+        log.Printf("❌ Couldn't set local description for %s: %v", p.ID, err)
+        return
+    }
+    p.sendOffer(*p.PC.LocalDescription())
+}
+
+// sendOffer pushes a renegotiation offer over the peer's WebSocket, or
+// queues it on OfferChan for clients still polling /renegotiate.
+func (p *Peer) sendOffer(offer webrtc.SessionDescription) {
+    if sc := p.signalConn(); sc != nil {
+        if err := sc.send(SignalMessage{Type: SignalOffer, SDP: &offer}); err == nil {
+            log.Printf("📡 Sent renegotiation offer to %s over WebSocket", p.ID)
             return
         }
+    }
+    select {
+    case p.OfferChan <- offer:
+        log.Printf("📡 Sent renegotiation offer to %s", p.ID)
+    default:
+        log.Printf("⚠️ OfferChan full for %s", p.ID)
+    }
+}
+
+// handleAnswer applies the client's answer to our last offer and runs any
+// renegotiation that was requested in the meantime.
+func (p *Peer) handleAnswer(answer webrtc.SessionDescription) error {
+    p.negotiationMu.Lock()
+    err := p.PC.SetRemoteDescription(answer)
+    if err == nil {
+        p.flushRemoteCandidates()
+    }
+    pending := p.pendingNegotiation
+    p.negotiationMu.Unlock()
 
-        peers.Range(func(key, value any) bool {
-            peer := value.(*Peer)
-            if peer.ID == fromPeerID {
-                return true
-            }
-
-            peer.mu.Lock()
-            log.Print("KIND OF TRACK: "+track.Kind().String())
-            localTrack, ok := peer.OutTracks[track.Kind().String()]
-            log.Print("Tracks ", localTrack)
-
-            if !ok {
-
-                newTrack, err := webrtc.NewTrackLocalStaticRTP(
-                    track.Codec().RTPCodecCapability, track.ID(), track.StreamID())
-                if err != nil {
-                    log.Printf("Error creating local track: %v", err)
-                    peer.mu.Unlock()
-                    return true
-                }
-
-                sender, err := peer.PC.AddTrack(newTrack)
-                if err != nil {
-                    log.Printf("Error adding track to peer %s: %v", peer.ID, err)
-                    peer.mu.Unlock()
-                    return true
-                }
-
-                go func() {
-                    rtcpBuf := make([]byte, 1500)
-                    for {
-                        if _, _, rtcpErr := sender.Read(rtcpBuf); rtcpErr != nil {
-                            return
-                        }
-                    }
-                }()
-
-                peer.OutTracks[track.Kind().String()] = newTrack
-                localTrack = newTrack
-
-                offer, err := peer.PC.CreateOffer(nil)
-                if err == nil {
-                    peer.PC.SetLocalDescription(offer)
-                    peer.OfferChan <- *peer.PC.LocalDescription()
-                }
-            }
-
-            if localTrack != nil {
-                _, err := localTrack.Write(buf[:n])
-                if err != nil {
-                    log.Printf("Error forwarding packet: %v", err)
-                }
-            }
-
-            peer.mu.Unlock()
-            return true
-        })
+    if err != nil {
+        return err
+    }
+    p.requestNegotiatedKeyframes()
+    if pending {
+        go p.renegotiate()
     }
+    return nil
 }
 
 func renegotiateHandler(w http.ResponseWriter, r *http.Request) {
-    peerID := r.URL.Path[len("/renegotiate/"):]
-    if val, ok := peers.Load(peerID); ok {
-        peer := val.(*Peer)
+    if peer := lookupSession(w, r); peer != nil {
         select {
         case offer := <-peer.OfferChan:
             json.NewEncoder(w).Encode(offer)
         case <-time.After(2 * time.Second):
             w.WriteHeader(http.StatusNoContent)
         }
-    } else {
-        http.Error(w, "Peer not found", http.StatusNotFound)
     }
 }
 
 func answerHandler(w http.ResponseWriter, r *http.Request) {
-    peerID := r.URL.Path[len("/answer/"):]
-    if val, ok := peers.Load(peerID); ok {
-        peer := val.(*Peer)
-
+    if peer := lookupSession(w, r); peer != nil {
         var answer webrtc.SessionDescription
         if err := json.NewDecoder(r.Body).Decode(&answer); err != nil {
             http.Error(w, "Invalid SDP", http.StatusBadRequest)
             return
         }
 
-        if err := peer.PC.SetRemoteDescription(answer); err != nil {
+        if err := peer.handleAnswer(answer); err != nil {
             http.Error(w, err.Error(), http.StatusInternalServerError)
             return
         }
 
         w.WriteHeader(http.StatusOK)
-    } else {
-        http.Error(w, "Peer not found", http.StatusNotFound)
     }
 }
 
 func initEBPFMap() {
     var err error
-    var ipMap any
-    ipMap, err = ebpf.LoadPinnedMap("/sys/fs/bpf/peer_ips", nil)
+    peerIPMap, err = ebpf.LoadPinnedMap("/sys/fs/bpf/peer_ips", nil)
     if err != nil {
         log.Fatalf("❌ Failed to load pinned eBPF map: %v", err)
     }
@@ -296,10 +429,137 @@ func initEBPFMap() {
 }
 
 func main() {
-    rand.Seed(time.Now().UnixNano())
+    if len(os.Args) > 1 && os.Args[1] == "token" {
+        if err := tokenCommand(os.Args[2:]); err != nil {
+            log.Fatal(err)
+        }
+        return
+    }
+    flag.BoolVar(&defaultRoomSettings.AutoSubscribe, "auto-subscribe", true, "Subscribe peers to every track in their room by default")
+    flag.IntVar(&nackBufferAudio, "nack-buffer-audio", nackBufferAudio, "Packets of each published audio track kept for retransmission (0 disables)")
+    flag.IntVar(&nackBufferVideo, "nack-buffer-video", nackBufferVideo, "Packets of each published video layer kept for retransmission (0 disables)")
+    flag.IntVar(&sendQueueSize, "queue-size", sendQueueSize, "Packets queued per forwarded track before the drop policy applies")
+    flag.StringVar(&sendQueuePolicy, "drop-policy", sendQueuePolicy, "What to drop from a full send queue: drop-oldest or drop-until-keyframe")
+    flag.IntVar(&bweInitialBitrate, "bwe-initial-bitrate", bweInitialBitrate, "Bandwidth estimate (bps) each subscriber starts with")
+    flag.IntVar(&defaultRoomSettings.LastN, "last-n", lastNUnlimited, "Publishers whose video each subscriber receives by default, most recently active first (-1 for all)")
+    codecList := flag.String("codecs", strings.Join(codecConfig.Codecs, ","), "Codecs to negotiate, most preferred first (opus, g722, pcmu, pcma, vp8, vp9, av1, h264)")
+    h264Profiles := flag.String("h264-profiles", strings.Join(codecConfig.H264Profiles, ","), "H.264 profiles to accept, most preferred first (constrained-baseline, baseline, main, high)")
+    h264Level := flag.String("h264-level", "3.1", "Highest H.264 level publishers may send")
+    flag.StringVar(&recordDir, "record-dir", recordDir, "Directory recordings are written to")
+    flag.StringVar(&recordFormat, "record-format", recordFormat, "Default recording format: separate (a file per track) or webm (a file per publisher)")
+    flag.DurationVar(&hlsSegmentDuration, "hls-segment", hlsSegmentDuration, "Default duration of HLS segments")
+    flag.DurationVar(&hlsPartDuration, "hls-part", hlsPartDuration, "Default duration of LL-HLS parts (0 for plain HLS)")
+    flag.IntVar(&hlsWindow, "hls-window", hlsWindow, "Default number of segments in HLS playlists")
+    jwtSecret := flag.String("jwt-secret", "", "HMAC secret signaling tokens are verified with")
+    jwtPublicKey := flag.String("jwt-public-key", "", "PEM file with the RSA or ECDSA public key signaling tokens are verified with")
+    flag.Parse()
+    if err := validDropPolicy(sendQueuePolicy); err != nil {
+        log.Fatal(err)
+    }
+    if err := validRecordFormat(recordFormat); err != nil {
+        log.Fatal(err)
+    }
+    if err := defaultHLSRequest().validate(); err != nil {
+        log.Fatal(err)
+    }
+    policy, err := parseCodecPolicy(*codecList, *h264Profiles, *h264Level)
+    if err != nil {
+        log.Fatal(err)
+    }
+    codecConfig = policy
+    if *jwtSecret != "" {
+        tokenAuth.hmacKey = []byte(*jwtSecret)
+    }
+    if *jwtPublicKey != "" {
+        key, err := loadPublicKey(*jwtPublicKey)
+        if err != nil {
+            log.Fatal(err)
+        }
+        tokenAuth.publicKey = key
+    }
+    if !tokenAuth.enabled() {
+        log.Println("⚠️ No -jwt-secret or -jwt-public-key: signaling is not authenticated")
+    }
+
+    // Routes without a room prefix join the default room.
     http.HandleFunc("/offer", offerHandler)
-    http.HandleFunc("/renegotiate/", renegotiateHandler)
-    http.HandleFunc("/answer/", answerHandler)
+    http.HandleFunc("/renegotiate/{peer}", renegotiateHandler)
+    http.HandleFunc("/answer/{peer}", answerHandler)
+    http.HandleFunc("/candidate/{peer}", candidateHandler)
+    http.HandleFunc("/ws", wsHandler)
+    http.HandleFunc("POST /whip", whipHandler)
+    http.HandleFunc("PATCH /whip/{session}", whipSessionHandler)
+    http.HandleFunc("DELETE /whip/{session}", whipSessionHandler)
+    http.HandleFunc("POST /whep", whepHandler)
+    http.HandleFunc("PATCH /whep/{session}", whepSessionHandler)
+    http.HandleFunc("DELETE /whep/{session}", whepSessionHandler)
+    http.HandleFunc("OPTIONS /whep", whepPreflightHandler)
+    http.HandleFunc("OPTIONS /whep/{session}", whepPreflightHandler)
+    http.HandleFunc("POST /peer/{publisher}/whep", whepHandler)
+    http.HandleFunc("PATCH /peer/{publisher}/whep/{session}", whepSessionHandler)
+    http.HandleFunc("DELETE /peer/{publisher}/whep/{session}", whepSessionHandler)
+    http.HandleFunc("OPTIONS /peer/{publisher}/whep", whepPreflightHandler)
+    http.HandleFunc("OPTIONS /peer/{publisher}/whep/{session}", whepPreflightHandler)
+    http.HandleFunc("DELETE /peer/{peer}", deletePeerHandler)
+    http.HandleFunc("GET /tracks", tracksHandler)
+    http.HandleFunc("GET /peer/{peer}/subscriptions", subscriptionsHandler(true))
+    http.HandleFunc("POST /peer/{peer}/subscribe", subscriptionsHandler(true))
+    http.HandleFunc("POST /peer/{peer}/unsubscribe", subscriptionsHandler(false))
+    http.HandleFunc("POST /peer/{peer}/layer", layerHandler)
+    http.HandleFunc("GET /peer/{peer}/stats", statsHandler)
+    http.HandleFunc("GET /peer/{peer}/bandwidth", bandwidthHandler)
+    http.HandleFunc("GET /peer/{peer}/last-n", lastNHandler)
+    http.HandleFunc("POST /peer/{peer}/last-n", lastNHandler)
+    http.HandleFunc("GET /speaker", speakerHandler)
+    http.HandleFunc("GET /codecs", codecsHandler)
+    http.HandleFunc("GET /recordings", recordingsHandler)
+    http.HandleFunc("POST /recording/start", recordingHandler(true))
+    http.HandleFunc("POST /recording/stop", recordingHandler(false))
+    http.HandleFunc("POST /peer/{peer}/recording/start", recordingHandler(true))
+    http.HandleFunc("POST /peer/{peer}/recording/stop", recordingHandler(false))
+    http.HandleFunc("POST /peer/{peer}/hls/start", hlsHandler(true))
+    http.HandleFunc("POST /peer/{peer}/hls/stop", hlsHandler(false))
+    http.HandleFunc("GET /peer/{peer}/hls/{file}", hlsFileHandler)
+
+    http.HandleFunc("/rooms/{room}/offer", offerHandler)
+    http.HandleFunc("/rooms/{room}/renegotiate/{peer}", renegotiateHandler)
+    http.HandleFunc("/rooms/{room}/answer/{peer}", answerHandler)
+    http.HandleFunc("/rooms/{room}/candidate/{peer}", candidateHandler)
+    http.HandleFunc("/rooms/{room}/ws", wsHandler)
+    http.HandleFunc("POST /rooms/{room}/whip", whipHandler)
+    http.HandleFunc("PATCH /rooms/{room}/whip/{session}", whipSessionHandler)
+    http.HandleFunc("DELETE /rooms/{room}/whip/{session}", whipSessionHandler)
+    http.HandleFunc("POST /rooms/{room}/whep", whepHandler)
+    http.HandleFunc("PATCH /rooms/{room}/whep/{session}", whepSessionHandler)
+    http.HandleFunc("DELETE /rooms/{room}/whep/{session}", whepSessionHandler)
+    http.HandleFunc("OPTIONS /rooms/{room}/whep", whepPreflightHandler)
+    http.HandleFunc("OPTIONS /rooms/{room}/whep/{session}", whepPreflightHandler)
+    http.HandleFunc("POST /rooms/{room}/peer/{publisher}/whep", whepHandler)
+    http.HandleFunc("PATCH /rooms/{room}/peer/{publisher}/whep/{session}", whepSessionHandler)
+    http.HandleFunc("DELETE /rooms/{room}/peer/{publisher}/whep/{session}", whepSessionHandler)
+    http.HandleFunc("OPTIONS /rooms/{room}/peer/{publisher}/whep", whepPreflightHandler)
+    http.HandleFunc("OPTIONS /rooms/{room}/peer/{publisher}/whep/{session}", whepPreflightHandler)
+    http.HandleFunc("DELETE /rooms/{room}/peer/{peer}", deletePeerHandler)
+    http.HandleFunc("GET /rooms/{room}", roomHandler)
+    http.HandleFunc("PATCH /rooms/{room}", roomHandler)
+    http.HandleFunc("GET /rooms/{room}/tracks", tracksHandler)
+    http.HandleFunc("GET /rooms/{room}/peer/{peer}/subscriptions", subscriptionsHandler(true))
+    http.HandleFunc("POST /rooms/{room}/peer/{peer}/subscribe", subscriptionsHandler(true))
+    http.HandleFunc("POST /rooms/{room}/peer/{peer}/unsubscribe", subscriptionsHandler(false))
+    http.HandleFunc("POST /rooms/{room}/peer/{peer}/layer", layerHandler)
+    http.HandleFunc("GET /rooms/{room}/peer/{peer}/stats", statsHandler)
+    http.HandleFunc("GET /rooms/{room}/peer/{peer}/bandwidth", bandwidthHandler)
+    http.HandleFunc("GET /rooms/{room}/peer/{peer}/last-n", lastNHandler)
+    http.HandleFunc("POST /rooms/{room}/peer/{peer}/last-n", lastNHandler)
+    http.HandleFunc("GET /rooms/{room}/speaker", speakerHandler)
+    http.HandleFunc("GET /rooms/{room}/recordings", recordingsHandler)
+    http.HandleFunc("POST /rooms/{room}/recording/start", recordingHandler(true))
+    http.HandleFunc("POST /rooms/{room}/recording/stop", recordingHandler(false))
+    http.HandleFunc("POST /rooms/{room}/peer/{peer}/recording/start", recordingHandler(true))
+    http.HandleFunc("POST /rooms/{room}/peer/{peer}/recording/stop", recordingHandler(false))
+    http.HandleFunc("POST /rooms/{room}/peer/{peer}/hls/start", hlsHandler(true))
+    http.HandleFunc("POST /rooms/{room}/peer/{peer}/hls/stop", hlsHandler(false))
+    http.HandleFunc("GET /rooms/{room}/peer/{peer}/hls/{file}", hlsFileHandler)
 
     log.Println("✅ SFU Server running on :8080")
     log.Fatal(http.ListenAndServe(":8080", nil))
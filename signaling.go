@@ -0,0 +1,290 @@
+package main
+
+import (
+    "errors"
+    "log"
+    "net"
+    "net/http"
+    "sync"
+    "time"
+
+    "github.com/gorilla/websocket"
+    "github.com/pion/webrtc/v3"
+)
+
+// Signaling message types exchanged over /ws.
+const (
+    // A client joins with its first SignalOffer, in the Role it names
+    // (publisher, subscriber or both, the default). The SignalAnswer to it
+    // carries the peer's ID and Secret.
+    SignalOffer     = "offer"
+    SignalAnswer    = "answer"
+    SignalCandidate = "candidate"
+    SignalError     = "error"
+
+    // SignalTracks carries the room's track list; the server pushes it
+    // whenever it changes and clients may send it to request a refresh.
+    // SignalSubscribe and SignalUnsubscribe name tracks in TrackIDs, and
+    // the server replies with SignalSubscriptions listing the result.
+    SignalTracks        = "tracks"
+    SignalSubscribe     = "subscribe"
+    SignalUnsubscribe   = "unsubscribe"
+    SignalSubscriptions = "subscriptions"
+
+    // SignalLayer selects the simulcast layer (or "auto") of the tracks in
+    // TrackIDs.
+    SignalLayer = "layer"
+
+    // SignalSpeaker announces the room's dominant speaker in SpeakerID,
+    // which is empty once the dominant speaker has left.
+    SignalSpeaker = "speaker"
+
+    // SignalAttach, as the first message, attaches the socket to a peer
+    // created via /offer, named by PeerID and proven by its Secret.
+    SignalAttach = "attach"
+
+    // SignalLastN sets how many publishers' video the peer receives in
+    // LastN and which publishers it pins in PeerIDs; either may be left
+    // out. The server replies with the resulting settings.
+    SignalLastN = "last_n"
+)
+
+// SignalMessage is the JSON envelope used on the signaling WebSocket.
+type SignalMessage struct {
+    Type      string                     `json:"type"`
+    PeerID    string                     `json:"peer_id,omitempty"`
+    SDP       *webrtc.SessionDescription `json:"sdp,omitempty"`
+    Candidate *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
+    Tracks    []TrackInfo                `json:"tracks,omitempty"`
+    TrackIDs  []string                   `json:"track_ids,omitempty"`
+    Layer     string                     `json:"layer,omitempty"`
+    SpeakerID string                     `json:"speaker_id,omitempty"`
+    LastN     *int                       `json:"last_n,omitempty"`
+    PeerIDs   []string                   `json:"peer_ids,omitempty"`
+    Role      string                     `json:"role,omitempty"`
+    Secret    string                     `json:"secret,omitempty"`
+    Error     string                     `json:"error,omitempty"`
+}
+
+const signalWriteTimeout = 5 * time.Second
+
+var upgrader = websocket.Upgrader{
+    CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// signalConn serializes writes to a signaling WebSocket, which may come from
+// the read loop as well as from the media goroutines triggering renegotiation.
+type signalConn struct {
+    conn *websocket.Conn
+    mu   sync.Mutex
+}
+
+func (s *signalConn) send(msg SignalMessage) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.conn.SetWriteDeadline(time.Now().Add(signalWriteTimeout))
+    return s.conn.WriteJSON(msg)
+}
+
+func (s *signalConn) sendError(msg string) {
+    if err := s.send(SignalMessage{Type: SignalError, Error: msg}); err != nil {
+        log.Printf("⚠️ Couldn't send signaling error: %v", err)
+    }
+}
+
+func (p *Peer) signalConn() *signalConn {
+    p.signalMu.Lock()
+    defer p.signalMu.Unlock()
+    return p.signal
+}
+
+// attachSignal makes sc the peer's signaling connection and trickles any
+// server candidates gathered before it was attached.
+func (p *Peer) attachSignal(sc *signalConn) {
+    p.signalMu.Lock()
+    defer p.signalMu.Unlock()
+
+    p.signal = sc
+    for _, candidate := range p.takeLocalCandidates() {
+        if err := sc.send(SignalMessage{Type: SignalCandidate, Candidate: &candidate}); err != nil {
+            log.Printf("⚠️ [%s] Couldn't trickle candidate: %v", p.ID, err)
+        }
+    }
+}
+
+// detachSignal clears the peer's signaling connection if it is still sc, so a
+// reconnecting client's new socket is not dropped by the old one closing.
+func (p *Peer) detachSignal(sc *signalConn) {
+    p.signalMu.Lock()
+    if p.signal == sc {
+        p.signal = nil
+    }
+    p.signalMu.Unlock()
+}
+
+// wsHandler serves the signaling WebSocket for a room. A client either joins
+// by sending an offer as its first message, or attaches to an existing peer
+// created via /offer: with an attach message, or by passing ?peer_id= and
+// the peer's secret in X-Peer-Secret if it can set headers. After that the
+// server pushes renegotiation offers and accepts answers and ICE candidates
+// on the same socket.
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+    claims, ok := authorize(w, r)
+    if !ok {
+        return
+    }
+    conn, err := upgrader.Upgrade(w, r, nil)
+    if err != nil {
+        log.Printf("❌ WebSocket upgrade failed: %v", err)
+        return
+    }
+    defer conn.Close()
+
+    sc := &signalConn{conn: conn}
+    room := roomID(r)
+
+    var peer *Peer
+    if peerID := r.URL.Query().Get("peer_id"); peerID != "" {
+        if peer, err = attach(sc, room, peerID, r.Header.Get(peerSecretHeader)); err != nil {
+            sc.sendError(err.Error())
+            return
+        }
+    }
+
+    for {
+        var msg SignalMessage
+        if err := conn.ReadJSON(&msg); err != nil {
+            if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) && !errors.Is(err, net.ErrClosed) {
+                log.Printf("⚠️ Signaling read error: %v", err)
+            }
+            break
+        }
+
+        if err := handleSignal(sc, room, claims, &peer, msg); err != nil {
+            sc.sendError(err.Error())
+        }
+    }
+
+    if peer != nil {
+        peer.detachSignal(sc)
+        log.Printf("🔌 [%s] Signaling socket closed", peer.ID)
+    }
+}
+
+// attach makes sc the signaling socket of the peer in room with the given ID,
+// if secret is the peer's.
+func attach(sc *signalConn, room, peerID, secret string) (*Peer, error) {
+    var peer *Peer
+    if existing := rooms.get(room); existing != nil {
+        peer = existing.Peer(peerID)
+    }
+    if peer == nil {
+        return nil, errors.New("Peer not found")
+    }
+    if !peer.checkSecret(secret) {
+        return nil, errBadPeerSecret
+    }
+    peer.attachSignal(sc)
+    log.Printf("🔌 [%s] Signaling socket attached", peer.ID)
+    return peer, nil
+}
+
+// handleSignal processes one message from a signaling socket opened for the
+// given room with the given token claims. *peer is set once the socket has
+// joined or attached to a peer.
+func handleSignal(sc *signalConn, room string, claims *tokenClaims, peer **Peer, msg SignalMessage) error {
+    switch msg.Type {
+    case SignalOffer:
+        if *peer != nil {
+            return errors.New("already joined")
+        }
+        if msg.SDP == nil {
+            return errors.New("missing sdp")
+        }
+        role, err := claims.role(msg.Role)
+        if err != nil {
+            return err
+        }
+        p, err := newPeer(room, role, *msg.SDP, nil)
+        if err != nil {
+            return err
+        }
+        p.Identity = claims.identity()
+        if err := sc.send(SignalMessage{Type: SignalAnswer, PeerID: p.ID, Secret: p.secret, SDP: p.PC.LocalDescription()}); err != nil {
+            p.close()
+            return err
+        }
+        p.attachSignal(sc)
+        p.Room.join(p)
+        *peer = p
+        log.Printf("🔗 [%s] Joined room %s over WebSocket", p.ID, room)
+
+    case SignalAttach:
+        if *peer != nil {
+            return errors.New("already joined")
+        }
+        p, err := attach(sc, room, msg.PeerID, msg.Secret)
+        if err != nil {
+            return err
+        }
+        *peer = p
+
+    case SignalAnswer:
+        if *peer == nil {
+            return errors.New("not joined")
+        }
+        if msg.SDP == nil {
+            return errors.New("missing sdp")
+        }
+        return (*peer).handleAnswer(*msg.SDP)
+
+    case SignalCandidate:
+        if *peer == nil {
+            return errors.New("not joined")
+        }
+        if msg.Candidate == nil {
+            return errors.New("missing candidate")
+        }
+        return (*peer).addRemoteCandidate(*msg.Candidate)
+
+    case SignalTracks:
+        if *peer == nil {
+            return errors.New("not joined")
+        }
+        (*peer).sendTracks((*peer).Room.Tracks())
+
+    case SignalSubscribe, SignalUnsubscribe:
+        if *peer == nil {
+            return errors.New("not joined")
+        }
+        err := (*peer).updateSubscriptions(msg.TrackIDs, msg.Type == SignalSubscribe)
+        if sendErr := sc.send(SignalMessage{Type: SignalSubscriptions, TrackIDs: (*peer).Subscriptions()}); sendErr != nil {
+            return sendErr
+        }
+        return err
+
+    case SignalLayer:
+        if *peer == nil {
+            return errors.New("not joined")
+        }
+        for _, key := range msg.TrackIDs {
+            if err := (*peer).selectLayer(key, msg.Layer); err != nil {
+                return err
+            }
+        }
+
+    case SignalLastN:
+        if *peer == nil {
+            return errors.New("not joined")
+        }
+        if err := (*peer).setLastN(msg.LastN, msg.PeerIDs); err != nil {
+            return err
+        }
+        info := (*peer).LastN()
+        return sc.send(SignalMessage{Type: SignalLastN, LastN: &info.LastN, PeerIDs: info.Pinned})
+
+    default:
+        return errors.New("unknown message type: " + msg.Type)
+    }
+    return nil
+}
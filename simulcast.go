@@ -0,0 +1,320 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "sort"
+    "sync/atomic"
+    "time"
+
+    "github.com/pion/rtcp"
+    "github.com/pion/rtp"
+    "github.com/pion/webrtc/v3"
+)
+
+// layerAuto, when requested as a layer, hands layer choice back to the
+// server's bandwidth-based selection.
+const layerAuto = "auto"
+
+const (
+    // layerLossDown is the fraction lost (out of 256) above which a
+    // subscriber's downlink counts as congested. Layers only move up again
+    // once layerUpHoldoff has passed since the last downgrade.
+    layerLossDown  = 26 // ~10%
+    layerUpHoldoff = 5 * time.Second
+)
+
+// simulcastLayer is one encoding of a published track. Tracks that are not
+// simulcast have a single layer with an empty RID.
+type simulcastLayer struct {
+    RID    string
+    Remote *webrtc.TrackRemote
+
+    // bitrate is the layer's incoming bitrate in bits per second, measured
+    // by its read loop over roughly one second.
+    bitrate atomic.Uint64
+
+    keyframes keyframeRequests
+    history   *packetHistory
+
+    // senderReport is the latest RTCP sender report for the layer, which
+    // recordings use to line it up with the publisher's other tracks.
+    senderReport atomic.Pointer[senderReport]
+}
+
+// layerRank orders the RIDs used by common senders from lowest to highest
+// quality. Unknown RIDs rank in the middle.
+func layerRank(rid string) int {
+    switch rid {
+    case "q", "l", "low", "0":
+        return 0
+    case "h", "m", "mid", "1":
+        return 1
+    case "f", "high", "2":
+        return 2
+    }
+    return 1
+}
+
+// addLayer records a newly received encoding of the track.
+func (pt *PublishedTrack) addLayer(remote *webrtc.TrackRemote) *simulcastLayer {
+    layer := &simulcastLayer{
+        RID:     remote.RID(),
+        Remote:  remote,
+        history: newPacketHistory(nackBufferSize(remote.Kind())),
+    }
+
+    pt.layersMu.Lock()
+    pt.layers[layer.RID] = layer
+    pt.layersMu.Unlock()
+    return layer
+}
+
+// removeLayer forgets an ended layer and reports how many remain.
+func (pt *PublishedTrack) removeLayer(layer *simulcastLayer) int {
+    pt.layersMu.Lock()
+    defer pt.layersMu.Unlock()
+
+    if pt.layers[layer.RID] == layer {
+        delete(pt.layers, layer.RID)
+    }
+    return len(pt.layers)
+}
+
+func (pt *PublishedTrack) layer(rid string) *simulcastLayer {
+    pt.layersMu.RLock()
+    defer pt.layersMu.RUnlock()
+    return pt.layers[rid]
+}
+
+// Layers returns the track's layers from lowest to highest quality.
+func (pt *PublishedTrack) Layers() []*simulcastLayer {
+    pt.layersMu.RLock()
+    layers := make([]*simulcastLayer, 0, len(pt.layers))
+    for _, layer := range pt.layers {
+        layers = append(layers, layer)
+    }
+    pt.layersMu.RUnlock()
+
+    sort.Slice(layers, func(i, j int) bool {
+        if ri, rj := layerRank(layers[i].RID), layerRank(layers[j].RID); ri != rj {
+            return ri < rj
+        }
+        return layers[i].RID < layers[j].RID
+    })
+    return layers
+}
+
+// simulcast reports whether the publisher sends RID-identified layers.
+func (pt *PublishedTrack) simulcast() bool {
+    return pt.Remote.RID() != ""
+}
+
+// wants reports whether a packet from layer rid may be forwarded: it is
+// either the layer being forwarded or the one being switched to. It reads
+// the snapshot published by syncFilter, so it needs no lock.
+func (out *ForwardedTrack) wants(rid string) bool {
+    f := out.filter.Load()
+    return !f.paused && (rid == f.current || rid == f.target)
+}
+
+// layerFilter is a snapshot of whether a forwarded track is paused and which
+// layers it is switching between.
+type layerFilter struct {
+    paused          bool
+    current, target string
+}
+
+// syncFilter publishes the track's pause and layer state to fanOut.
+// Callers must hold the subscriber's mu and call it after changing any of
+// them.
+func (out *ForwardedTrack) syncFilter() {
+    out.filter.Store(&layerFilter{
+        paused:  out.paused || out.lastNPaused,
+        current: out.currentLayer,
+        target:  out.targetLayer,
+    })
+}
+
+// rewrite fills dst with the packet to write for a queued packet from one
+// layer of the published track, and reports false if it is not forwarded.
+// Only the current layer is forwarded; a switch to the target layer happens
+// on its next keyframe, with sequence numbers and timestamps rewritten so
+// the subscriber sees one continuous stream. The outbound track then maps
+// the SSRC, payload type and header extensions. Callers must hold the
+// subscriber's mu.
+func (out *ForwardedTrack) rewrite(item queuedPacket, dst *rtp.Packet) bool {
+    rid, pkt := item.rid, &item.buf.pkt
+    simulcast := out.Published.simulcast()
+
+    if out.paused || out.lastNPaused {
+        return false
+    }
+    // Packets were dropped before this keyframe; hide the gap as if
+    // switching to the same layer.
+    if item.resync && out.started && rid == out.currentLayer {
+        out.switchLayer(rid, pkt)
+    }
+    if !out.started || rid != out.currentLayer || out.resuming {
+        if rid != out.targetLayer || ((simulcast || out.resuming) && !item.keyframe) {
+            return false
+        }
+        out.switchLayer(rid, pkt)
+    }
+
+    header := out.rewriteHeader(pkt.Header)
+    if int16(header.SequenceNumber-out.lastSeq) > 0 || out.lastWrite.IsZero() {
+        out.lastSeq = header.SequenceNumber
+        out.lastTS = header.Timestamp
+        out.lastWrite = time.Now()
+    }
+    out.stats.packets++
+    out.stats.bytes += uint64(len(pkt.Payload))
+    dst.Header = header
+    dst.Payload = pkt.Payload
+    return true
+}
+
+// rewriteHeader maps the header of a packet from the current layer onto the
+// subscriber's continuous stream. Callers must hold the subscriber's mu.
+func (out *ForwardedTrack) rewriteHeader(header rtp.Header) rtp.Header {
+    header.SequenceNumber += out.seqOffset
+    header.Timestamp += out.tsOffset
+    return header
+}
+
+// switchLayer starts forwarding rid, continuing the sequence numbers and
+// timestamps of the previous layer, or of the same layer before a pause.
+func (out *ForwardedTrack) switchLayer(rid string, pkt *rtp.Packet) {
+    if out.started {
+        clockRate := out.Published.Remote.Codec().ClockRate
+        gap := uint32(time.Since(out.lastWrite).Seconds() * float64(clockRate))
+        if gap == 0 {
+            gap = 1
+        }
+        out.seqOffset = out.lastSeq + 1 - pkt.SequenceNumber
+        out.tsOffset = out.lastTS + gap - pkt.Timestamp
+        if rid != out.currentLayer {
+            log.Printf("🔀 %s: switched layer %q -> %q", out.Key, out.currentLayer, rid)
+        }
+    }
+    out.currentLayer = rid
+    out.started = true
+    out.resuming = false
+    out.layerStartSeq = pkt.SequenceNumber + out.seqOffset
+    out.syncFilter()
+}
+
+// setTargetLayer chooses the layer to switch to and asks the publisher for
+// a keyframe on it. Callers must hold the subscriber's mu.
+func (out *ForwardedTrack) setTargetLayer(rid string) {
+    if rid == out.targetLayer {
+        return
+    }
+    out.targetLayer = rid
+    out.syncFilter()
+    if rid != out.currentLayer || !out.started {
+        out.Published.requestKeyframe(rid, false)
+    }
+}
+
+// readRTCP consumes the RTCP a subscriber sends for one of its forwarded
+// tracks. Reading is also what lets the sender's interceptors see it.
+func (p *Peer) readRTCP(out *ForwardedTrack) {
+    buf := make([]byte, 1500)
+    for {
+        n, _, err := out.Sender.Read(buf)
+        if err != nil {
+            return
+        }
+        pkts, err := rtcp.Unmarshal(buf[:n])
+        if err != nil {
+            continue
+        }
+        p.handleRTCP(out, pkts)
+    }
+}
+
+// handleRTCP relays keyframe requests from the subscriber to the publisher,
+// answers its NACKs, and records the REMB and loss it reports for bandwidth
+// allocation. Nothing is sent to the publisher with p.mu held.
+func (p *Peer) handleRTCP(out *ForwardedTrack, pkts []rtcp.Packet) {
+    // Keyframes are requested on the target layer: either it is the one
+    // being forwarded, or its keyframe is what completes a pending switch.
+    for _, pkt := range pkts {
+        switch pkt := pkt.(type) {
+        case *rtcp.PictureLossIndication:
+            out.Published.requestKeyframe(out.filter.Load().target, false)
+
+        case *rtcp.FullIntraRequest:
+            out.Published.requestKeyframe(out.filter.Load().target, true)
+
+        case *rtcp.TransportLayerNack:
+            p.mu.Lock()
+            layer, missing := out.retransmit(pkt)
+            p.mu.Unlock()
+            if len(missing) > 0 {
+                out.Published.requestRetransmission(layer, missing)
+            }
+
+        default:
+            p.mu.Lock()
+            p.bandwidth.onRTCP(pkt)
+            p.mu.Unlock()
+        }
+    }
+}
+
+// selectLayer pins the layer forwarded to p for a track, or hands the choice
+// back to the server when rid is layerAuto. A pinned layer is still lowered
+// if p's bandwidth cannot carry it.
+func (p *Peer) selectLayer(key, rid string) error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    out := p.OutTracks[key]
+    if out == nil {
+        return fmt.Errorf("not subscribed to %s", key)
+    }
+    if rid == layerAuto {
+        out.pinnedLayer = false
+        return nil
+    }
+    if out.Published.layer(rid) == nil {
+        return fmt.Errorf("track %s has no layer %q", key, rid)
+    }
+    out.pinnedLayer = true
+    out.requestedLayer = rid
+    if !out.paused {
+        out.setTargetLayer(rid)
+    }
+    return nil
+}
+
+// layerRequest is the body of the layer selection route.
+type layerRequest struct {
+    Track string `json:"track"`
+    Layer string `json:"layer"`
+}
+
+// layerHandler lets a subscriber's client choose which simulcast layer of a
+// track it receives.
+func layerHandler(w http.ResponseWriter, r *http.Request) {
+    peer := lookupSession(w, r)
+    if peer == nil {
+        return
+    }
+
+    var req layerRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid layer request", http.StatusBadRequest)
+        return
+    }
+    if err := peer.selectLayer(req.Track, req.Layer); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+    "math"
+    "net/http"
+    "slices"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/pion/rtp"
+    "github.com/pion/sdp/v3"
+    "github.com/pion/webrtc/v3"
+)
+
+// Dominant speaker detection. Every speakerInterval, each peer's audio
+// levels are averaged into one activity sample; a peer takes over as
+// dominant speaker once it has been clearly louder than the current one both
+// just now and over the last second, so a cough or a short interjection
+// does not steal the floor.
+const (
+    speakerInterval = 100 * time.Millisecond
+
+    // Activity is averaged over speakerImmediate samples for the short
+    // window and speakerMedium samples for the longer one.
+    speakerImmediate = 3
+    speakerMedium    = 10
+
+    // speakerNoiseFloor is the audio level, in -dBov, at and below which a
+    // packet counts as silence. Speech is usually around -20 to -40 dBov.
+    speakerNoiseFloor = 70
+
+    // speakerMinActivity is the immediate activity a peer needs to take
+    // over, and speakerSwitchRatio how much louder than the current
+    // dominant speaker it must be over the longer window.
+    speakerMinActivity = 10
+    speakerSwitchRatio = 1.5
+
+    // Publishers that send no audio levels are judged by packet size:
+    // Opus payloads up to opusSilenceSize bytes are DTX or comfort noise,
+    // and anything larger counts as speech at speakerVoiceLevel -dBov.
+    opusSilenceSize   = 10
+    speakerVoiceLevel = 40
+)
+
+// speakerActivity is what the detector knows about one peer's audio.
+type speakerActivity struct {
+    // sum and count accumulate the current interval's packets.
+    sum   float64
+    count int
+
+    // samples is a ring of per-interval activity, newest at next-1.
+    samples [speakerMedium]float64
+    next    int
+
+    level uint8
+}
+
+// push ends the current interval, recording its average activity.
+func (a *speakerActivity) push() {
+    var sample float64
+    if a.count > 0 {
+        sample = a.sum / float64(a.count)
+    }
+    a.samples[a.next] = sample
+    a.next = (a.next + 1) % len(a.samples)
+    a.sum, a.count = 0, 0
+}
+
+// score averages the last n interval samples.
+func (a *speakerActivity) score(n int) float64 {
+    var total float64
+    for i := 1; i <= n; i++ {
+        total += a.samples[(a.next-i+len(a.samples))%len(a.samples)]
+    }
+    return total / float64(n)
+}
+
+// speakerDetector tracks the dominant speaker of one room, and ranks its
+// peers by how recently they spoke.
+type speakerDetector struct {
+    mu       sync.Mutex
+    peers    map[string]*speakerActivity
+    dominant string
+    since    time.Time
+    stop     chan struct{}
+
+    // order lists every peer in the room, most recently active first.
+    order []string
+}
+
+func newSpeakerDetector() *speakerDetector {
+    return &speakerDetector{
+        peers: make(map[string]*speakerActivity),
+        stop:  make(chan struct{}),
+    }
+}
+
+// add ranks a peer that joined the room last.
+func (d *speakerDetector) add(peerID string) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    if !slices.Contains(d.order, peerID) {
+        d.order = append(d.order, peerID)
+    }
+}
+
+// observe records the audio level, in -dBov as carried by the audio level
+// header extension, of one packet sent by a peer.
+func (d *speakerDetector) observe(peerID string, level uint8) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    a := d.peers[peerID]
+    if a == nil {
+        a = &speakerActivity{}
+        d.peers[peerID] = a
+    }
+    a.sum += math.Max(0, speakerNoiseFloor-float64(level))
+    a.count++
+    a.level = level
+}
+
+// remove forgets a peer that left, reporting whether it was the dominant
+// speaker.
+func (d *speakerDetector) remove(peerID string) bool {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    delete(d.peers, peerID)
+    d.order = slices.DeleteFunc(d.order, func(id string) bool { return id == peerID })
+    if d.dominant != peerID {
+        return false
+    }
+    d.dominant = ""
+    d.since = time.Time{}
+    return true
+}
+
+// tick closes the current interval. It reports who the dominant speaker is,
+// whether that changed, and whether the ranking changed.
+func (d *speakerDetector) tick() (speaker string, changed, reordered bool) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    var challenger string
+    var best float64
+    for id, a := range d.peers {
+        a.push()
+        if medium := a.score(speakerMedium); a.score(speakerImmediate) >= speakerMinActivity && medium > best {
+            challenger, best = id, medium
+        }
+    }
+
+    if challenger != "" && challenger != d.dominant {
+        current := d.peers[d.dominant]
+        if current == nil || (best >= current.score(speakerMedium)*speakerSwitchRatio &&
+            d.peers[challenger].score(speakerImmediate) > current.score(speakerImmediate)) {
+            d.dominant = challenger
+            d.since = time.Now()
+            changed = true
+        }
+    }
+    return d.dominant, changed, d.rerank()
+}
+
+// rerank moves the dominant speaker, then everyone speaking right now, to
+// the front of the ranking, keeping the order among them and among the
+// rest. It reports whether anything moved. Callers must hold d.mu.
+func (d *speakerDetector) rerank() bool {
+    rank := func(id string) int {
+        if id == d.dominant {
+            return 0
+        }
+        if a := d.peers[id]; a != nil && a.score(speakerImmediate) >= speakerMinActivity {
+            return 1
+        }
+        return 2
+    }
+    if slices.IsSortedFunc(d.order, func(a, b string) int { return rank(a) - rank(b) }) {
+        return false
+    }
+    slices.SortStableFunc(d.order, func(a, b string) int { return rank(a) - rank(b) })
+    return true
+}
+
+// ranking returns the room's peers, most recently active first.
+func (d *speakerDetector) ranking() []string {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    return slices.Clone(d.order)
+}
+
+// run detects speaker changes in room until the detector is stopped.
+func (d *speakerDetector) run(room *Room) {
+    ticker := time.NewTicker(speakerInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-d.stop:
+            return
+        case <-ticker.C:
+            speaker, changed, reordered := d.tick()
+            if changed {
+                log.Printf("🗣️ Room %s: dominant speaker is now %s", room.ID, speaker)
+                room.broadcastSpeaker(speaker)
+            }
+            if reordered {
+                room.applyLastN()
+            }
+        }
+    }
+}
+
+// broadcastSpeaker tells every peer in the room with a signaling socket who
+// the dominant speaker is. An empty speaker means nobody is.
+func (room *Room) broadcastSpeaker(speaker string) {
+    room.forEachPeer(func(p *Peer) bool {
+        p.sendSpeaker(speaker)
+        return true
+    })
+}
+
+func (p *Peer) sendSpeaker(speaker string) {
+    if sc := p.signalConn(); sc != nil {
+        if err := sc.send(SignalMessage{Type: SignalSpeaker, SpeakerID: speaker}); err != nil {
+            log.Printf("⚠️ Couldn't send speaker to %s: %v", p.ID, err)
+        }
+    }
+}
+
+// leaveSpeakers removes p from its room's speaker detection, announcing that
+// nobody is speaking if p was the dominant speaker.
+func (p *Peer) leaveSpeakers() {
+    if p.Room.speakers.remove(p.ID) {
+        log.Printf("🗣️ Room %s: dominant speaker %s left", p.Room.ID, p.ID)
+        p.Room.broadcastSpeaker("")
+    }
+    p.Room.applyLastN()
+}
+
+// audioLevelExtensionID returns the ID the publisher of an audio track
+// negotiated for the audio level header extension, or zero if it did not.
+func (pt *PublishedTrack) audioLevelExtensionID() uint8 {
+    if pt.Remote.Kind() != webrtc.RTPCodecTypeAudio {
+        return 0
+    }
+    for _, ext := range pt.Receiver.GetParameters().HeaderExtensions {
+        if ext.URI == sdp.AudioLevelURI {
+            return uint8(ext.ID)
+        }
+    }
+    return 0
+}
+
+// observeAudio feeds the audio level of a packet p published to the room's
+// speaker detection: the one it carries in the extension with the given ID,
+// or else one estimated from the size of an Opus payload.
+func (p *Peer) observeAudio(pkt *rtp.Packet, extensionID uint8, opus bool) {
+    if extensionID != 0 {
+        if payload := pkt.GetExtension(extensionID); payload != nil {
+            var ext rtp.AudioLevelExtension
+            if err := ext.Unmarshal(payload); err == nil {
+                p.Room.speakers.observe(p.ID, ext.Level)
+            }
+            return
+        }
+    }
+    if !opus {
+        return
+    }
+    level := uint8(speakerVoiceLevel)
+    if len(pkt.Payload) <= opusSilenceSize {
+        level = 127
+    }
+    p.Room.speakers.observe(p.ID, level)
+}
+
+// SpeakerLevel is one peer's recent audio activity. AudioLevel is the level
+// of its last packet in -dBov, so 0 is loudest and 127 silence.
+type SpeakerLevel struct {
+    PeerID     string  `json:"peer_id"`
+    AudioLevel uint8   `json:"audio_level"`
+    Activity   float64 `json:"activity"`
+}
+
+// SpeakerInfo is returned by GET /rooms/{room}/speaker. SpeakerID is empty
+// until someone has spoken.
+type SpeakerInfo struct {
+    Room      string         `json:"room"`
+    SpeakerID string         `json:"speaker_id"`
+    Since     *time.Time     `json:"since,omitempty"`
+    Levels    []SpeakerLevel `json:"levels"`
+}
+
+// Speaker reports the room's dominant speaker and everyone's activity,
+// loudest first.
+func (room *Room) Speaker() SpeakerInfo {
+    d := room.speakers
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    info := SpeakerInfo{Room: room.ID, SpeakerID: d.dominant, Levels: []SpeakerLevel{}}
+    if !d.since.IsZero() {
+        since := d.since
+        info.Since = &since
+    }
+    for id, a := range d.peers {
+        info.Levels = append(info.Levels, SpeakerLevel{
+            PeerID:     id,
+            AudioLevel: a.level,
+            Activity:   a.score(speakerMedium),
+        })
+    }
+    sort.Slice(info.Levels, func(i, j int) bool {
+        return info.Levels[i].Activity > info.Levels[j].Activity
+    })
+    return info
+}
+
+func speakerHandler(w http.ResponseWriter, r *http.Request) {
+    if _, ok := authorize(w, r); !ok {
+        return
+    }
+    room := rooms.get(roomID(r))
+    if room == nil {
+        http.Error(w, "Room not found", http.StatusNotFound)
+        return
+    }
+    json.NewEncoder(w).Encode(room.Speaker())
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+    "reflect"
+    "slices"
+    "testing"
+)
+
+func TestSpeakerDetectorTick(t *testing.T) {
+    // rounds repeats one interval's audio levels n times.
+    rounds := func(n int, levels map[string]uint8) []map[string]uint8 {
+        return slices.Repeat([]map[string]uint8{levels}, n)
+    }
+
+    tests := []struct {
+        name    string
+        peers   []string
+        levels  []map[string]uint8
+        speaker string
+        changed bool
+        ranking []string
+    }{
+        {
+            name:    "silence",
+            peers:   []string{"a", "b"},
+            levels:  rounds(5, map[string]uint8{"a": 127, "b": 127}),
+            ranking: []string{"a", "b"},
+        },
+        {
+            name:    "below noise floor",
+            peers:   []string{"a", "b"},
+            levels:  rounds(5, map[string]uint8{"b": speakerNoiseFloor + 10}),
+            ranking: []string{"a", "b"},
+        },
+        {
+            name:    "first speaker",
+            peers:   []string{"a", "b"},
+            levels:  rounds(1, map[string]uint8{"b": 30}),
+            speaker: "b",
+            changed: true,
+            ranking: []string{"b", "a"},
+        },
+        {
+            name:  "interjection keeps the floor",
+            peers: []string{"a", "c", "b"},
+            levels: slices.Concat(
+                rounds(10, map[string]uint8{"a": 30}),
+                rounds(1, map[string]uint8{"b": 10}),
+            ),
+            speaker: "a",
+            ranking: []string{"a", "b", "c"},
+        },
+        {
+            name:  "louder speaker not yet over the switch ratio",
+            peers: []string{"a", "b"},
+            levels: slices.Concat(
+                rounds(10, map[string]uint8{"a": 30}),
+                rounds(4, map[string]uint8{"b": 10}),
+            ),
+            speaker: "a",
+            ranking: []string{"a", "b"},
+        },
+        {
+            name:  "louder speaker takes over",
+            peers: []string{"a", "b"},
+            levels: slices.Concat(
+                rounds(10, map[string]uint8{"a": 30}),
+                rounds(5, map[string]uint8{"b": 10}),
+            ),
+            speaker: "b",
+            changed: true,
+            ranking: []string{"b", "a"},
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            d := newSpeakerDetector()
+            for _, id := range tt.peers {
+                d.add(id)
+            }
+            var speaker string
+            var changed bool
+            for _, levels := range tt.levels {
+                for id, level := range levels {
+                    d.observe(id, level)
+                }
+                speaker, changed, _ = d.tick()
+            }
+            if speaker != tt.speaker || changed != tt.changed {
+                t.Errorf("tick() = %q, changed %v, want %q, changed %v", speaker, changed, tt.speaker, tt.changed)
+            }
+            if got := d.ranking(); !reflect.DeepEqual(got, tt.ranking) {
+                t.Errorf("ranking() = %v, want %v", got, tt.ranking)
+            }
+        })
+    }
+}
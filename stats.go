@@ -0,0 +1,73 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "sort"
+)
+
+// forwardStats counts what was sent to a subscriber on one forwarded track.
+// Guarded by the subscriber's mu.
+type forwardStats struct {
+    packets             uint64
+    bytes               uint64
+    nacked              uint64
+    retransmitted       uint64
+    retransmitRequested uint64
+}
+
+// ForwardedTrackStats is the JSON view of a forwarded track's counters.
+// RetransmitRequested counts NACKed packets that were no longer buffered
+// and had to be requested from the publisher. Dropped counts packets the
+// send queue's drop policy discarded, and Queued those waiting in it.
+type ForwardedTrackStats struct {
+    Track               string `json:"track"`
+    Kind                string `json:"kind"`
+    Layer               string `json:"layer,omitempty"`
+    PacketsSent         uint64 `json:"packets_sent"`
+    BytesSent           uint64 `json:"bytes_sent"`
+    NACKedPackets       uint64 `json:"nacked_packets"`
+    Retransmitted       uint64 `json:"retransmitted_packets"`
+    RetransmitRequested uint64 `json:"retransmit_requested"`
+    Dropped             uint64 `json:"dropped_packets"`
+    Queued              int    `json:"queued_packets"`
+}
+
+// PeerStats is returned by GET /peer/{peer}/stats.
+type PeerStats struct {
+    ID        string                `json:"id"`
+    Forwarded []ForwardedTrackStats `json:"forwarded"`
+}
+
+// Stats returns the counters of every track forwarded to p, sorted by key.
+func (p *Peer) Stats() PeerStats {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    stats := PeerStats{ID: p.ID, Forwarded: []ForwardedTrackStats{}}
+    for _, out := range p.OutTracks {
+        dropped, queued := out.queue.stats()
+        stats.Forwarded = append(stats.Forwarded, ForwardedTrackStats{
+            Track:               out.Key,
+            Kind:                out.Published.Remote.Kind().String(),
+            Layer:               out.currentLayer,
+            PacketsSent:         out.stats.packets,
+            BytesSent:           out.stats.bytes,
+            NACKedPackets:       out.stats.nacked,
+            Retransmitted:       out.stats.retransmitted,
+            RetransmitRequested: out.stats.retransmitRequested,
+            Dropped:             dropped,
+            Queued:              queued,
+        })
+    }
+    sort.Slice(stats.Forwarded, func(i, j int) bool {
+        return stats.Forwarded[i].Track < stats.Forwarded[j].Track
+    })
+    return stats
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+    if peer := lookupPeer(w, r); peer != nil {
+        json.NewEncoder(w).Encode(peer.Stats())
+    }
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "sort"
+    "sync"
+    "sync/atomic"
+
+    "github.com/pion/webrtc/v3"
+)
+
+// PublishedTrack is a track a peer publishes into its room. Other peers
+// receive it by subscribing, which gives them a ForwardedTrack for it.
+// Remote is the first layer received; simulcast tracks have one layer per
+// RID in layers.
+type PublishedTrack struct {
+    Key       string
+    Publisher *Peer
+    Remote    *webrtc.TrackRemote
+    Receiver  *webrtc.RTPReceiver
+
+    layersMu sync.RWMutex
+    layers   map[string]*simulcastLayer
+
+    // subscribers is replaced, never modified, under subscribersMu, so the
+    // read loops can fan out without taking a lock.
+    subscribersMu sync.Mutex
+    subscribers   atomic.Pointer[[]*ForwardedTrack]
+
+    // recorders is managed the same way, for the recordings tapping the
+    // track.
+    recordersMu sync.Mutex
+    recorders   atomic.Pointer[[]*trackRecorder]
+
+    // ended is set once the track is unpublished so that no new
+    // subscriptions are attached to it.
+    ended atomic.Bool
+}
+
+// TrackInfo describes a published track to clients choosing what to
+// subscribe to. ID is the track key used by the subscribe API.
+type TrackInfo struct {
+    ID          string   `json:"id"`
+    PublisherID string   `json:"publisher_id"`
+    Kind        string   `json:"kind"`
+    StreamID    string   `json:"stream_id"`
+    TrackID     string   `json:"track_id"`
+    MimeType    string   `json:"mime_type"`
+    Layers      []string `json:"layers,omitempty"`
+}
+
+func newPublishedTrack(publisher *Peer, remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) *PublishedTrack {
+    return &PublishedTrack{
+        Key:       trackKey(publisher.ID, remote),
+        Publisher: publisher,
+        Remote:    remote,
+        Receiver:  receiver,
+        layers:    make(map[string]*simulcastLayer),
+    }
+}
+
+func (pt *PublishedTrack) Info() TrackInfo {
+    info := TrackInfo{
+        ID:          pt.Key,
+        PublisherID: pt.Publisher.ID,
+        Kind:        pt.Remote.Kind().String(),
+        StreamID:    pt.Remote.StreamID(),
+        TrackID:     pt.Remote.ID(),
+        MimeType:    pt.Remote.Codec().MimeType,
+    }
+    if pt.simulcast() {
+        for _, layer := range pt.Layers() {
+            info.Layers = append(info.Layers, layer.RID)
+        }
+    }
+    return info
+}
+
+// subscriberList returns the tracks pt is currently forwarded as. The slice
+// must not be modified.
+func (pt *PublishedTrack) subscriberList() []*ForwardedTrack {
+    if list := pt.subscribers.Load(); list != nil {
+        return *list
+    }
+    return nil
+}
+
+func (pt *PublishedTrack) addSubscriber(out *ForwardedTrack) {
+    pt.subscribersMu.Lock()
+    defer pt.subscribersMu.Unlock()
+
+    old := pt.subscriberList()
+    list := append(old[:len(old):len(old)], out)
+    pt.subscribers.Store(&list)
+}
+
+func (pt *PublishedTrack) removeSubscriber(out *ForwardedTrack) {
+    pt.subscribersMu.Lock()
+    defer pt.subscribersMu.Unlock()
+
+    var list []*ForwardedTrack
+    for _, other := range pt.subscriberList() {
+        if other != out {
+            list = append(list, other)
+        }
+    }
+    pt.subscribers.Store(&list)
+}
+
+// publish adds a track to the room, subscribes the other peers to it if the
+// room auto-subscribes, and tells everyone the track list changed.
+func (room *Room) publish(pt *PublishedTrack) {
+    room.mu.Lock()
+    room.tracks[pt.Key] = pt
+    settings := room.settings
+    room.mu.Unlock()
+
+    if settings.AutoSubscribe {
+        room.forEachPeer(func(other *Peer) bool {
+            if other != pt.Publisher && other.subscribes() && !other.offerless {
+                if err := other.subscribe(pt); err != nil {
+                    log.Printf("⚠️ Couldn't subscribe %s to %s: %v", other.ID, pt.Key, err)
+                }
+            }
+            return true
+        })
+    }
+    room.recordTrack(pt)
+    room.streamTrack(pt)
+    room.broadcastTracks()
+}
+
+// unpublish removes an ended track from the room and from every subscriber.
+func (room *Room) unpublish(pt *PublishedTrack) {
+    pt.ended.Store(true)
+
+    room.mu.Lock()
+    if room.tracks[pt.Key] == pt {
+        delete(room.tracks, pt.Key)
+    }
+    room.mu.Unlock()
+
+    room.forEachPeer(func(other *Peer) bool {
+        other.removeForwardedTracks(func(out *ForwardedTrack) bool {
+            return out.Key == pt.Key
+        })
+        return true
+    })
+    room.stopRecordingTrack(pt)
+    room.stopStreamingTrack(pt)
+    room.broadcastTracks()
+}
+
+// publishedTracks returns the room's tracks. Callers must hold room.mu.
+func (room *Room) publishedTracks() []*PublishedTrack {
+    published := make([]*PublishedTrack, 0, len(room.tracks))
+    for _, pt := range room.tracks {
+        published = append(published, pt)
+    }
+    return published
+}
+
+// Tracks lists the tracks currently published in the room.
+func (room *Room) Tracks() []TrackInfo {
+    room.mu.RLock()
+    defer room.mu.RUnlock()
+
+    infos := make([]TrackInfo, 0, len(room.tracks))
+    for _, pt := range room.tracks {
+        infos = append(infos, pt.Info())
+    }
+    sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+    return infos
+}
+
+func (room *Room) track(key string) *PublishedTrack {
+    room.mu.RLock()
+    defer room.mu.RUnlock()
+    return room.tracks[key]
+}
+
+// broadcastTracks pushes the current track list to every peer with a
+// signaling socket.
+func (room *Room) broadcastTracks() {
+    tracks := room.Tracks()
+    room.forEachPeer(func(p *Peer) bool {
+        p.sendTracks(tracks)
+        return true
+    })
+}
+
+// sendTracks pushes a track list to p over its signaling socket, if any.
+func (p *Peer) sendTracks(tracks []TrackInfo) {
+    if sc := p.signalConn(); sc != nil {
+        if err := sc.send(SignalMessage{Type: SignalTracks, Tracks: tracks}); err != nil {
+            log.Printf("⚠️ Couldn't send track list to %s: %v", p.ID, err)
+        }
+    }
+}
+
+// subscribe starts forwarding a published track to p. Subscribing to a
+// track p already receives is a no-op.
+func (p *Peer) subscribe(pt *PublishedTrack) error {
+    if !p.subscribes() {
+        return fmt.Errorf("%s only publishes", p.ID)
+    }
+    if p.offerless {
+        return fmt.Errorf("%s can't be sent new tracks", p.ID)
+    }
+    if codec := pt.Remote.Codec(); !p.canReceive(codec) {
+        return fmt.Errorf("%s can't receive %s in %s", p.ID, pt.Key, codec.MimeType)
+    }
+    return p.forward(pt)
+}
+
+// forward attaches a forwarded track for pt to p, unless p already
+// receives it.
+func (p *Peer) forward(pt *PublishedTrack) error {
+    if pt.Publisher == p {
+        return fmt.Errorf("can't subscribe to own track %s", pt.Key)
+    }
+
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    if p.closed.Load() || pt.Publisher.closed.Load() || pt.ended.Load() {
+        return fmt.Errorf("track %s is no longer available", pt.Key)
+    }
+    if _, ok := p.OutTracks[pt.Key]; ok {
+        return nil
+    }
+    _, err := p.addForwardedTrack(pt)
+    return err
+}
+
+// Subscriptions lists the keys of the tracks forwarded to p.
+func (p *Peer) Subscriptions() []string {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    keys := make([]string, 0, len(p.OutTracks))
+    for key := range p.OutTracks {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// updateSubscriptions subscribes p to or unsubscribes it from the given
+// track keys. Every key is attempted; the first error is returned.
+func (p *Peer) updateSubscriptions(keys []string, subscribe bool) error {
+    var firstErr error
+    if !subscribe {
+        remove := make(map[string]bool, len(keys))
+        for _, key := range keys {
+            remove[key] = true
+        }
+        p.removeForwardedTracks(func(out *ForwardedTrack) bool {
+            return remove[out.Key]
+        })
+        return nil
+    }
+
+    for _, key := range keys {
+        pt := p.Room.track(key)
+        if pt == nil {
+            if firstErr == nil {
+                firstErr = fmt.Errorf("unknown track %s", key)
+            }
+            continue
+        }
+        if err := p.subscribe(pt); err != nil && firstErr == nil {
+            firstErr = err
+        }
+    }
+    return firstErr
+}
+
+// tracksHandler lists the tracks published in a room.
+func tracksHandler(w http.ResponseWriter, r *http.Request) {
+    if _, ok := authorize(w, r); !ok {
+        return
+    }
+    room := rooms.get(roomID(r))
+    if room == nil {
+        http.Error(w, "Room not found", http.StatusNotFound)
+        return
+    }
+    json.NewEncoder(w).Encode(room.Tracks())
+}
+
+// subscriptionRequest is the body of the subscribe and unsubscribe routes.
+type subscriptionRequest struct {
+    Tracks []string `json:"tracks"`
+}
+
+// subscriptionsHandler returns a peer's subscriptions on GET. On POST to
+// .../subscribe or .../unsubscribe, which only the peer's own client may
+// send, it first applies the requested change; the server renegotiates with
+// the peer to add or drop the tracks.
+func subscriptionsHandler(subscribe bool) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        lookup := lookupPeer
+        if r.Method == http.MethodPost {
+            lookup = lookupSession
+        }
+        peer := lookup(w, r)
+        if peer == nil {
+            return
+        }
+
+        if r.Method == http.MethodPost {
+            var req subscriptionRequest
+            if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                http.Error(w, "Invalid subscription request", http.StatusBadRequest)
+                return
+            }
+            if err := peer.updateSubscriptions(req.Tracks, subscribe); err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+            }
+        }
+
+        json.NewEncoder(w).Encode(subscriptionRequest{Tracks: peer.Subscriptions()})
+    }
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+    "log"
+    "net/http"
+    "time"
+
+    "github.com/pion/webrtc/v3"
+)
+
+// disconnectTimeout is how long a peer may stay disconnected before it is
+// torn down. ICE would eventually report failed on its own, but only after
+// its much longer failure timeout.
+const disconnectTimeout = 10 * time.Second
+
+// onConnectionStateChange tears the peer down once its connection has failed
+// or closed, or has stayed disconnected for longer than disconnectTimeout.
+func (p *Peer) onConnectionStateChange(state webrtc.PeerConnectionState) {
+    log.Printf("[%s] Connection state: %s", p.ID, state.String())
+
+    switch state {
+    case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+        p.close()
+
+    case webrtc.PeerConnectionStateDisconnected:
+        p.mu.Lock()
+        if p.disconnectTimer == nil {
+            p.disconnectTimer = time.AfterFunc(disconnectTimeout, func() {
+                // Pion delivers state changes on separate goroutines, so
+                // check the state again rather than trusting the order.
+                if p.PC.ConnectionState() == webrtc.PeerConnectionStateDisconnected {
+                    log.Printf("⏱️ [%s] Disconnected for %s, tearing down", p.ID, disconnectTimeout)
+                    p.close()
+                }
+            })
+        }
+        p.mu.Unlock()
+
+    case webrtc.PeerConnectionStateConnected:
+        p.mu.Lock()
+        if p.disconnectTimer != nil {
+            p.disconnectTimer.Stop()
+            p.disconnectTimer = nil
+        }
+        p.mu.Unlock()
+    }
+}
+
+// close tears the peer down: it leaves its room, closes its PeerConnection
+// and signaling socket, removes the tracks it published from every other
+// peer in the room, finalizes its recordings and ends its HLS stream. It is
+// safe to call more than once.
+func (p *Peer) close() {
+    p.closeOnce.Do(func() {
+        p.closed.Store(true)
+        p.Room.removePeer(p)
+        p.leaveSpeakers()
+
+        if err := p.PC.Close(); err != nil {
+            log.Printf("⚠️ [%s] Error closing PeerConnection: %v", p.ID, err)
+        }
+        if sc := p.signalConn(); sc != nil {
+            sc.conn.Close()
+        }
+
+        p.Room.forEachPeer(func(other *Peer) bool {
+            other.removeForwardedTracks(func(out *ForwardedTrack) bool {
+                return out.PublisherID == p.ID
+            })
+            return true
+        })
+
+        p.mu.Lock()
+        for _, out := range p.OutTracks {
+            out.Published.removeSubscriber(out)
+            out.queue.close()
+        }
+        if p.disconnectTimer != nil {
+            p.disconnectTimer.Stop()
+        }
+        p.mu.Unlock()
+
+        p.Room.leaveRecordings(p.ID)
+        p.Room.stopHLS(p.ID)
+        rooms.release(p.Room)
+        rooms.unregister(p)
+        log.Printf("👋 [%s] Left room %s", p.ID, p.Room.ID)
+    })
+}
+
+// removeForwardedTracks stops forwarding the outbound tracks matched by
+// match to p and renegotiates so the client drops the dead streams.
+func (p *Peer) removeForwardedTracks(match func(*ForwardedTrack) bool) {
+    p.mu.Lock()
+    removed := false
+    for key, out := range p.OutTracks {
+        if !match(out) {
+            continue
+        }
+        if err := p.PC.RemoveTrack(out.Sender); err != nil {
+            log.Printf("⚠️ Couldn't remove %s from %s: %v", key, p.ID, err)
+        }
+        out.Published.removeSubscriber(out)
+        out.queue.close()
+        delete(p.OutTracks, key)
+        removed = true
+    }
+    if removed {
+        p.applyLastN(p.Room.speakers.ranking())
+    }
+    p.mu.Unlock()
+
+    if removed {
+        go p.renegotiate()
+    }
+}
+
+// deletePeerHandler lets a client (or an operator) end a session explicitly
+// instead of waiting for the connection to time out.
+func deletePeerHandler(w http.ResponseWriter, r *http.Request) {
+    if peer := lookupSession(w, r); peer != nil {
+        peer.close()
+        w.WriteHeader(http.StatusNoContent)
+    }
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+    "sync"
+    "sync/atomic"
+
+    "github.com/pion/rtp"
+    "github.com/pion/sdp/v3"
+    "github.com/pion/webrtc/v3"
+)
+
+// hopByHopExtensions are header extensions that describe the link they were
+// received on rather than the media, so they are never forwarded: the
+// subscriber's MID and RID differ from the publisher's, and transport-wide
+// sequence numbers and send times are set by our own sender.
+var hopByHopExtensions = map[string]bool{
+    sdp.SDESMidURI:         true,
+    sdp.SDESRTPStreamIDURI: true,
+    repairedStreamIDURI:    true,
+    sdp.TransportCCURI:     true,
+    sdp.ABSSendTimeURI:     true,
+}
+
+// repairedStreamIDURI is the RID extension of RTX packets, which pion/sdp
+// has no constant for.
+const repairedStreamIDURI = "urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id"
+
+// RFC 8285 header extension profiles.
+const (
+    extensionProfileOneByte = 0xBEDE
+    extensionProfileTwoByte = 0x1000
+)
+
+// headerMapping translates the payload types and header extension IDs a
+// publisher negotiated into the ones a subscriber negotiated. Packets with a
+// payload type not set in ok are dropped, and so are extensions not listed
+// in forwarded.
+type headerMapping struct {
+    pt  [128]uint8
+    ok  [128]bool
+    ext [256]uint8
+
+    // forwarded lists the publisher's extension IDs that ext maps.
+    forwarded []uint8
+}
+
+// newHeaderMapping maps each publisher codec to the subscriber's payload type
+// for the same codec, and each forwardable publisher extension to the
+// subscriber's ID for the same URI.
+func newHeaderMapping(from, to webrtc.RTPParameters) *headerMapping {
+    m := &headerMapping{}
+    for _, codec := range from.Codecs {
+        if codec.PayloadType >= 128 {
+            continue
+        }
+        want := parseCodec(codec.MimeType, codec.SDPFmtpLine)
+        for _, other := range to.Codecs {
+            if sameCodec(want, parseCodec(other.MimeType, other.SDPFmtpLine)) {
+                m.pt[codec.PayloadType] = uint8(other.PayloadType)
+                m.ok[codec.PayloadType] = true
+                break
+            }
+        }
+    }
+    for _, ext := range from.HeaderExtensions {
+        if hopByHopExtensions[ext.URI] || ext.ID <= 0 || ext.ID > 255 {
+            continue
+        }
+        for _, other := range to.HeaderExtensions {
+            if other.URI == ext.URI && other.ID > 0 && other.ID <= 255 {
+                m.ext[ext.ID] = uint8(other.ID)
+                m.forwarded = append(m.forwarded, uint8(ext.ID))
+                break
+            }
+        }
+    }
+    return m
+}
+
+// rewrite maps a header onto the subscriber's payload type and extension
+// IDs. The extensions kept are appended to exts rather than to the header's
+// own slice, which is shared with every other subscriber of the packet. It
+// reports false if the subscriber did not negotiate the packet's codec.
+func (m *headerMapping) rewrite(header *rtp.Header, exts []rtp.Extension) ([]rtp.Extension, bool) {
+    if header.PayloadType >= 128 || !m.ok[header.PayloadType] {
+        return exts, false
+    }
+    header.PayloadType = m.pt[header.PayloadType]
+
+    src := *header
+    header.Extension = false
+    header.ExtensionProfile = 0
+    header.Extensions = exts[:0]
+    if !src.Extension {
+        return header.Extensions, true
+    }
+
+    // The one-byte form only fits IDs up to 14 and payloads up to 16 bytes.
+    profile := uint16(extensionProfileOneByte)
+    for _, id := range m.forwarded {
+        if payload := src.GetExtension(id); payload != nil && (m.ext[id] > 14 || len(payload) > 16) {
+            profile = extensionProfileTwoByte
+        }
+    }
+    for _, id := range m.forwarded {
+        if payload := src.GetExtension(id); payload != nil {
+            if !header.Extension {
+                header.Extension = true
+                header.ExtensionProfile = profile
+            }
+            header.SetExtension(m.ext[id], payload)
+        }
+    }
+    return header.Extensions, true
+}
+
+// forwardTrack is the outbound track a subscriber receives a published track
+// on. Unlike webrtc.TrackLocalStaticRTP, which only swaps in the payload
+// type of one codec, it maps every codec and header extension the publisher
+// negotiated onto what the subscriber negotiated.
+type forwardTrack struct {
+    id, streamID string
+    kind         webrtc.RTPCodecType
+    codec        webrtc.RTPCodecCapability
+    source       webrtc.RTPParameters
+
+    mu      sync.Mutex
+    binding atomic.Pointer[trackBinding]
+
+    // header and exts are scratch space for the rewritten header, so
+    // forwarding does not allocate. Writes come from one writer goroutine
+    // only.
+    header rtp.Header
+    exts   []rtp.Extension
+}
+
+type trackBinding struct {
+    id      string
+    ssrc    webrtc.SSRC
+    stream  webrtc.TrackLocalWriter
+    mapping *headerMapping
+}
+
+// newForwardTrack creates the outbound track for a published track. source
+// holds the codecs and header extensions the publisher negotiated.
+func newForwardTrack(codec webrtc.RTPCodecCapability, source webrtc.RTPParameters, id, streamID string, kind webrtc.RTPCodecType) *forwardTrack {
+    return &forwardTrack{id: id, streamID: streamID, kind: kind, codec: codec, source: source}
+}
+
+// Bind is called by the subscriber's RTPSender once negotiation picked the
+// codecs and header extensions it sends with.
+func (t *forwardTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    want := parseCodec(t.codec.MimeType, t.codec.SDPFmtpLine)
+    for _, codec := range ctx.CodecParameters() {
+        if !sameCodec(want, parseCodec(codec.MimeType, codec.SDPFmtpLine)) {
+            continue
+        }
+        target := webrtc.RTPParameters{Codecs: ctx.CodecParameters(), HeaderExtensions: ctx.HeaderExtensions()}
+        t.binding.Store(&trackBinding{
+            id:      ctx.ID(),
+            ssrc:    ctx.SSRC(),
+            stream:  ctx.WriteStream(),
+            mapping: newHeaderMapping(t.source, target),
+        })
+        return codec, nil
+    }
+    return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
+}
+
+// Unbind is called when the subscriber's sender stops.
+func (t *forwardTrack) Unbind(ctx webrtc.TrackLocalContext) error {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    if b := t.binding.Load(); b == nil || b.id != ctx.ID() {
+        return webrtc.ErrUnbindFailed
+    }
+    t.binding.Store(nil)
+    return nil
+}
+
+func (t *forwardTrack) ID() string                { return t.id }
+func (t *forwardTrack) RID() string               { return "" }
+func (t *forwardTrack) StreamID() string          { return t.streamID }
+func (t *forwardTrack) Kind() webrtc.RTPCodecType { return t.kind }
+
+// WriteRTP sends a packet from the publisher to the subscriber with its
+// header mapped onto the subscriber's stream. The packet itself is not
+// modified. Packets in a codec the subscriber did not negotiate, or
+// written before negotiation, are dropped.
+func (t *forwardTrack) WriteRTP(pkt *rtp.Packet) error {
+    b := t.binding.Load()
+    if b == nil {
+        return nil
+    }
+
+    t.header = pkt.Header
+    t.header.SSRC = uint32(b.ssrc)
+    exts, ok := b.mapping.rewrite(&t.header, t.exts[:0])
+    t.exts = exts
+    if !ok {
+        return nil
+    }
+    _, err := b.stream.WriteRTP(&t.header, pkt.Payload)
+    return err
+}
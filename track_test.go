@@ -0,0 +1,305 @@
+package main
+
+import (
+    "testing"
+
+    "github.com/pion/interceptor"
+    "github.com/pion/rtp"
+    "github.com/pion/sdp/v3"
+    "github.com/pion/webrtc/v3"
+)
+
+// clientEngine describes a client's MediaEngine. Pion numbers header
+// extensions in the order they are registered, so clients registering the
+// same extensions in a different order offer different IDs for them.
+type clientEngine struct {
+    codecs     []webrtc.RTPCodecParameters
+    extensions []string
+}
+
+// negotiate has a client with the given engine offer to receive or send
+// kind, and returns the codecs and header extensions the SFU negotiated from
+// that offer, as the subscriber's sender or the publisher's receiver sees
+// them.
+func negotiate(t *testing.T, engine clientEngine, kind webrtc.RTPCodecType, direction webrtc.RTPTransceiverDirection) webrtc.RTPParameters {
+    t.Helper()
+
+    m := &webrtc.MediaEngine{}
+    for _, codec := range engine.codecs {
+        if err := m.RegisterCodec(codec, kind); err != nil {
+            t.Fatal(err)
+        }
+    }
+    for _, uri := range engine.extensions {
+        if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: uri}, kind); err != nil {
+            t.Fatal(err)
+        }
+    }
+    client, err := webrtc.NewAPI(webrtc.WithMediaEngine(m)).NewPeerConnection(webrtc.Configuration{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+    if _, err := client.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: direction}); err != nil {
+        t.Fatal(err)
+    }
+    offer, err := client.CreateOffer(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    server, _, err := newPeerConnection()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer server.Close()
+    if err := server.SetRemoteDescription(offer); err != nil {
+        t.Fatal(err)
+    }
+    for _, transceiver := range server.GetTransceivers() {
+        if transceiver.Kind() == kind {
+            return transceiver.Receiver().GetParameters()
+        }
+    }
+    t.Fatalf("no %s transceiver negotiated", kind)
+    return webrtc.RTPParameters{}
+}
+
+func extensionID(t *testing.T, params webrtc.RTPParameters, uri string) uint8 {
+    t.Helper()
+    for _, ext := range params.HeaderExtensions {
+        if ext.URI == uri {
+            return uint8(ext.ID)
+        }
+    }
+    t.Fatalf("%s not negotiated", uri)
+    return 0
+}
+
+func payloadType(t *testing.T, params webrtc.RTPParameters, mimeType string) uint8 {
+    t.Helper()
+    for _, codec := range params.Codecs {
+        if codec.MimeType == mimeType {
+            return uint8(codec.PayloadType)
+        }
+    }
+    t.Fatalf("%s not negotiated", mimeType)
+    return 0
+}
+
+// fakeBinding is the subscriber side of a forwardTrack's binding. It keeps
+// a copy of every packet written, since the track reuses its headers.
+type fakeBinding struct {
+    params  webrtc.RTPParameters
+    written []rtp.Packet
+}
+
+func (f *fakeBinding) CodecParameters() []webrtc.RTPCodecParameters { return f.params.Codecs }
+func (f *fakeBinding) SSRC() webrtc.SSRC                            { return 4321 }
+func (f *fakeBinding) WriteStream() webrtc.TrackLocalWriter         { return f }
+func (f *fakeBinding) ID() string                                   { return "binding" }
+func (f *fakeBinding) RTCPReader() interceptor.RTCPReader           { return nil }
+func (f *fakeBinding) Write(b []byte) (int, error)                  { return len(b), nil }
+
+func (f *fakeBinding) HeaderExtensions() []webrtc.RTPHeaderExtensionParameter {
+    return f.params.HeaderExtensions
+}
+
+func (f *fakeBinding) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+    raw, err := (&rtp.Packet{Header: *header, Payload: payload}).Marshal()
+    if err != nil {
+        return 0, err
+    }
+    var pkt rtp.Packet
+    if err := pkt.Unmarshal(raw); err != nil {
+        return 0, err
+    }
+    f.written = append(f.written, pkt)
+    return len(raw), nil
+}
+
+// bindForwardTrack binds a track forwarding media negotiated as publisher
+// to a subscriber that negotiated subscriber.
+func bindForwardTrack(t *testing.T, codec webrtc.RTPCodecCapability, publisher, subscriber webrtc.RTPParameters, kind webrtc.RTPCodecType) (*forwardTrack, *fakeBinding) {
+    t.Helper()
+    track := newForwardTrack(codec, publisher, "track", "stream", kind)
+    binding := &fakeBinding{params: subscriber}
+    if _, err := track.Bind(binding); err != nil {
+        t.Fatal(err)
+    }
+    return track, binding
+}
+
+var (
+    opus = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+    vp8  = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+    h264 = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"}
+)
+
+func TestForwardTrackRewritesAudio(t *testing.T) {
+    publisher := negotiate(t, clientEngine{
+        codecs:     []webrtc.RTPCodecParameters{{RTPCodecCapability: opus, PayloadType: 109}},
+        extensions: []string{sdp.AudioLevelURI, sdp.TransportCCURI},
+    }, webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverDirectionSendonly)
+    subscriber := negotiate(t, clientEngine{
+        codecs:     []webrtc.RTPCodecParameters{{RTPCodecCapability: opus, PayloadType: 111}},
+        extensions: []string{sdp.TransportCCURI, sdp.ABSSendTimeURI, sdp.AudioLevelURI},
+    }, webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverDirectionRecvonly)
+
+    fromLevel, toLevel := extensionID(t, publisher, sdp.AudioLevelURI), extensionID(t, subscriber, sdp.AudioLevelURI)
+    fromTWCC := extensionID(t, publisher, sdp.TransportCCURI)
+    if fromLevel == toLevel {
+        t.Fatalf("offers should disagree on the audio level ID, both use %d", fromLevel)
+    }
+
+    track, binding := bindForwardTrack(t, opus, publisher, subscriber, webrtc.RTPCodecTypeAudio)
+
+    pkt := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 109, SequenceNumber: 7, Timestamp: 960, SSRC: 1234}, Payload: []byte{1, 2, 3}}
+    if err := pkt.SetExtension(fromLevel, []byte{0x80 | 30}); err != nil {
+        t.Fatal(err)
+    }
+    if err := pkt.SetExtension(fromTWCC, []byte{0, 1}); err != nil {
+        t.Fatal(err)
+    }
+    if err := track.WriteRTP(pkt); err != nil {
+        t.Fatal(err)
+    }
+
+    if len(binding.written) != 1 {
+        t.Fatalf("wrote %d packets, want 1", len(binding.written))
+    }
+    got := binding.written[0]
+    if got.PayloadType != 111 || got.SSRC != 4321 || got.SequenceNumber != 7 || got.Timestamp != 960 {
+        t.Errorf("header = PT %d, SSRC %d, seq %d, ts %d; want PT 111, SSRC 4321, seq 7, ts 960",
+            got.PayloadType, got.SSRC, got.SequenceNumber, got.Timestamp)
+    }
+    if ids := got.GetExtensionIDs(); len(ids) != 1 || ids[0] != toLevel {
+        t.Errorf("extension IDs = %v, want only the audio level as %d", ids, toLevel)
+    }
+    if level := got.GetExtension(toLevel); len(level) != 1 || level[0] != 0x80|30 {
+        t.Errorf("audio level = %x, want %x", level, 0x80|30)
+    }
+
+    // The packet is shared with the publisher's other subscribers.
+    if pkt.PayloadType != 109 || pkt.SSRC != 1234 || pkt.GetExtension(fromLevel) == nil || pkt.GetExtension(fromTWCC) == nil {
+        t.Errorf("source packet was modified: %+v", pkt.Header)
+    }
+}
+
+func TestForwardTrackDropsUnnegotiatedExtensions(t *testing.T) {
+    publisher := negotiate(t, clientEngine{
+        codecs:     []webrtc.RTPCodecParameters{{RTPCodecCapability: opus, PayloadType: 111}},
+        extensions: []string{sdp.AudioLevelURI},
+    }, webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverDirectionSendonly)
+    subscriber := negotiate(t, clientEngine{
+        codecs: []webrtc.RTPCodecParameters{{RTPCodecCapability: opus, PayloadType: 111}},
+    }, webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverDirectionRecvonly)
+
+    track, binding := bindForwardTrack(t, opus, publisher, subscriber, webrtc.RTPCodecTypeAudio)
+
+    pkt := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 111}, Payload: []byte{1}}
+    if err := pkt.SetExtension(extensionID(t, publisher, sdp.AudioLevelURI), []byte{0x80 | 30}); err != nil {
+        t.Fatal(err)
+    }
+    if err := track.WriteRTP(pkt); err != nil {
+        t.Fatal(err)
+    }
+
+    if len(binding.written) != 1 {
+        t.Fatalf("wrote %d packets, want 1", len(binding.written))
+    }
+    if got := binding.written[0]; got.Extension || len(got.Extensions) != 0 {
+        t.Errorf("extensions = %v, want none", got.GetExtensionIDs())
+    }
+}
+
+func TestForwardTrackMapsVideoPayloadTypes(t *testing.T) {
+    publisher := negotiate(t, clientEngine{
+        codecs: []webrtc.RTPCodecParameters{
+            {RTPCodecCapability: vp8, PayloadType: 120},
+            {RTPCodecCapability: h264, PayloadType: 125},
+        },
+    }, webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverDirectionSendonly)
+    subscriber := negotiate(t, clientEngine{
+        codecs: []webrtc.RTPCodecParameters{
+            {RTPCodecCapability: h264, PayloadType: 100},
+            {RTPCodecCapability: vp8, PayloadType: 97},
+        },
+    }, webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverDirectionRecvonly)
+    vp8Only := negotiate(t, clientEngine{
+        codecs: []webrtc.RTPCodecParameters{{RTPCodecCapability: vp8, PayloadType: 97}},
+    }, webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverDirectionRecvonly)
+
+    fromVP8, fromH264 := payloadType(t, publisher, webrtc.MimeTypeVP8), payloadType(t, publisher, webrtc.MimeTypeH264)
+
+    track, binding := bindForwardTrack(t, vp8, publisher, subscriber, webrtc.RTPCodecTypeVideo)
+    for _, pt := range []uint8{fromVP8, fromH264} {
+        if err := track.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: pt}, Payload: []byte{1}}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if len(binding.written) != 2 {
+        t.Fatalf("wrote %d packets, want 2", len(binding.written))
+    }
+    if got := binding.written[0].PayloadType; got != 97 {
+        t.Errorf("VP8 payload type = %d, want 97", got)
+    }
+    if got := binding.written[1].PayloadType; got != 100 {
+        t.Errorf("H.264 payload type = %d, want 100", got)
+    }
+
+    // A subscriber without H.264 never gets packets it can't decode.
+    track, binding = bindForwardTrack(t, vp8, publisher, vp8Only, webrtc.RTPCodecTypeVideo)
+    for _, pt := range []uint8{fromH264, fromVP8} {
+        if err := track.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: pt}, Payload: []byte{1}}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if len(binding.written) != 1 || binding.written[0].PayloadType != 97 {
+        t.Errorf("wrote %d packets, want only the VP8 one as PT 97", len(binding.written))
+    }
+}
+
+func TestForwardTrackBindRequiresCodec(t *testing.T) {
+    publisher := negotiate(t, clientEngine{
+        codecs: []webrtc.RTPCodecParameters{{RTPCodecCapability: h264, PayloadType: 102}},
+    }, webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverDirectionSendonly)
+    subscriber := negotiate(t, clientEngine{
+        codecs: []webrtc.RTPCodecParameters{{RTPCodecCapability: vp8, PayloadType: 96}},
+    }, webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverDirectionRecvonly)
+
+    track := newForwardTrack(h264, publisher, "track", "stream", webrtc.RTPCodecTypeVideo)
+    if _, err := track.Bind(&fakeBinding{params: subscriber}); err != webrtc.ErrUnsupportedCodec {
+        t.Errorf("Bind = %v, want %v", err, webrtc.ErrUnsupportedCodec)
+    }
+    if err := track.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 102}}); err != nil {
+        t.Errorf("WriteRTP on an unbound track = %v, want nil", err)
+    }
+}
+
+func TestHeaderMappingTwoByteExtensions(t *testing.T) {
+    mapping := newHeaderMapping(
+        webrtc.RTPParameters{
+            Codecs:           []webrtc.RTPCodecParameters{{RTPCodecCapability: opus, PayloadType: 111}},
+            HeaderExtensions: []webrtc.RTPHeaderExtensionParameter{{URI: sdp.AudioLevelURI, ID: 1}},
+        },
+        webrtc.RTPParameters{
+            Codecs:           []webrtc.RTPCodecParameters{{RTPCodecCapability: opus, PayloadType: 111}},
+            HeaderExtensions: []webrtc.RTPHeaderExtensionParameter{{URI: sdp.AudioLevelURI, ID: 20}},
+        },
+    )
+
+    header := rtp.Header{Version: 2, PayloadType: 111}
+    if err := header.SetExtension(1, []byte{0x80 | 30}); err != nil {
+        t.Fatal(err)
+    }
+    if _, ok := mapping.rewrite(&header, nil); !ok {
+        t.Fatal("rewrite dropped the packet")
+    }
+    if header.ExtensionProfile != extensionProfileTwoByte {
+        t.Errorf("profile = %#x, want %#x for ID 20", header.ExtensionProfile, extensionProfileTwoByte)
+    }
+    if level := header.GetExtension(20); len(level) != 1 || level[0] != 0x80|30 {
+        t.Errorf("audio level = %x, want %x", level, 0x80|30)
+    }
+}
@@ -0,0 +1,697 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "io"
+    "log"
+    "math"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/pion/rtcp"
+    "github.com/pion/rtp"
+    "github.com/pion/rtp/codecs"
+    "github.com/pion/webrtc/v3"
+    "github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+// WebM recordings mux each publisher's audio and video into one file. Frames
+// are placed on a common timeline using the publisher's RTCP sender reports,
+// which tie each track's RTP clock to the same wall clock, so audio and
+// video stay in sync however they were delayed on the way in.
+const (
+    // webmJitterLatency is how long a frame waits for late or reordered
+    // packets before it is written without them.
+    webmJitterLatency = 200 * time.Millisecond
+
+    // The track list is written once every track has its first frame and
+    // a sender report, or after webmStartTimeout.
+    webmStartTimeout = 3 * time.Second
+
+    // Frames are interleaved by waiting for every track to catch up; a
+    // track that sends nothing for webmStallTimeout is not waited for.
+    webmStallTimeout = time.Second
+
+    // A cluster starts at each video keyframe once the current one spans
+    // webmClusterMin, and at webmClusterMax in any case. Block times are
+    // 16-bit offsets from the cluster's, so it must stay under 32 s.
+    webmClusterMin = 1000
+    webmClusterMax = 5000
+)
+
+// WebM element IDs, from the Matroska specification.
+const (
+    idEBML               = 0x1A45DFA3
+    idEBMLVersion        = 0x4286
+    idEBMLReadVersion    = 0x42F7
+    idEBMLMaxIDLength    = 0x42F2
+    idEBMLMaxSizeLength  = 0x42F3
+    idDocType            = 0x4282
+    idDocTypeVersion     = 0x4287
+    idDocTypeReadVersion = 0x4285
+    idSegment            = 0x18538067
+    idInfo               = 0x1549A966
+    idTimecodeScale      = 0x2AD7B1
+    idMuxingApp          = 0x4D80
+    idWritingApp         = 0x5741
+    idDuration           = 0x4489
+    idDateUTC            = 0x4461
+    idTracks             = 0x1654AE6B
+    idTrackEntry         = 0xAE
+    idTrackNumber        = 0xD7
+    idTrackUID           = 0x73C5
+    idTrackType          = 0x83
+    idFlagLacing         = 0x9C
+    idCodecID            = 0x86
+    idCodecPrivate       = 0x63A2
+    idCodecDelay         = 0x56AA
+    idSeekPreRoll        = 0x56BB
+    idVideo              = 0xE0
+    idPixelWidth         = 0xB0
+    idPixelHeight        = 0xBA
+    idAudio              = 0xE1
+    idSamplingFrequency  = 0xB5
+    idChannels           = 0x9F
+    idCluster            = 0x1F43B675
+    idTimecode           = 0xE7
+    idSimpleBlock        = 0xA3
+)
+
+// webmCodecs maps the lower-case MIME types WebM can hold to their codec
+// IDs. Other codecs fall back to a file of their own.
+var webmCodecs = map[string]string{
+    "video/vp8":  "V_VP8",
+    "video/vp9":  "V_VP9",
+    "audio/opus": "A_OPUS",
+}
+
+// ebmlSize encodes an element size as a variable-length integer.
+func ebmlSize(n uint64) []byte {
+    length := 1
+    for length < 8 && n >= 1<<(7*length)-1 {
+        length++
+    }
+    b := make([]byte, length)
+    for i := length - 1; i >= 0; i-- {
+        b[i] = byte(n)
+        n >>= 8
+    }
+    b[0] |= 0x80 >> (length - 1)
+    return b
+}
+
+// ebmlElement encodes an element. IDs already include their length marker,
+// so they are written as they are, without leading zero bytes.
+func ebmlElement(id uint32, data []byte) []byte {
+    var b []byte
+    for shift := 24; shift >= 0; shift -= 8 {
+        if c := byte(id >> shift); c != 0 || len(b) > 0 {
+            b = append(b, c)
+        }
+    }
+    b = append(b, ebmlSize(uint64(len(data)))...)
+    return append(b, data...)
+}
+
+func ebmlUint(id uint32, v uint64) []byte {
+    b := make([]byte, 8)
+    binary.BigEndian.PutUint64(b, v)
+    for len(b) > 1 && b[0] == 0 {
+        b = b[1:]
+    }
+    return ebmlElement(id, b)
+}
+
+func ebmlFloat(id uint32, v float64) []byte {
+    b := make([]byte, 8)
+    binary.BigEndian.PutUint64(b, math.Float64bits(v))
+    return ebmlElement(id, b)
+}
+
+func ebmlMaster(id uint32, children ...[]byte) []byte {
+    return ebmlElement(id, bytes.Join(children, nil))
+}
+
+// senderReport is the latest RTCP sender report for one layer of a
+// published track: the wall-clock time, on the publisher's clock, of an RTP
+// timestamp, and when we received it.
+type senderReport struct {
+    rtp      uint32
+    ntp      time.Time
+    received time.Time
+}
+
+// ntpTime converts a 64-bit NTP timestamp.
+func ntpTime(ntp uint64) time.Time {
+    const ntpEpochOffset = 2208988800
+    secs := int64(ntp>>32) - ntpEpochOffset
+    nanos := (int64(ntp&0xFFFFFFFF) * int64(time.Second)) >> 32
+    return time.Unix(secs, nanos)
+}
+
+// readSenderReports keeps the latest sender report of one layer of a
+// published track until the layer ends.
+func (pt *PublishedTrack) readSenderReports(layer *simulcastLayer) {
+    for {
+        var pkts []rtcp.Packet
+        var err error
+        if layer.RID != "" {
+            pkts, _, err = pt.Receiver.ReadSimulcastRTCP(layer.RID)
+        } else {
+            pkts, _, err = pt.Receiver.ReadRTCP()
+        }
+        if err != nil {
+            return
+        }
+        for _, pkt := range pkts {
+            if sr, ok := pkt.(*rtcp.SenderReport); ok {
+                layer.senderReport.Store(&senderReport{rtp: sr.RTPTime, ntp: ntpTime(sr.NTPTime), received: time.Now()})
+            }
+        }
+    }
+}
+
+// senderClock maps a publisher's RTP timestamps onto our clock. The offset
+// between the publisher's clock and ours is taken from the first sender
+// report and shared by all the tracks using it, so that they keep the
+// relative timing the publisher gave them.
+type senderClock struct {
+    offset time.Duration
+    synced bool
+}
+
+// at returns the time on our clock that the publisher captured an RTP
+// timestamp of a layer at. Until the layer's first sender report, it counts
+// from base, when baseTS arrived.
+func (c *senderClock) at(layer *simulcastLayer, clockRate uint32, ts uint32, base time.Time, baseTS uint32) time.Time {
+    if sr := layer.senderReport.Load(); sr != nil {
+        if !c.synced {
+            c.offset = sr.received.Sub(sr.ntp)
+            c.synced = true
+        }
+        return sr.ntp.Add(c.offset + rtpDuration(int32(ts-sr.rtp), clockRate))
+    }
+    return base.Add(rtpDuration(int32(ts-baseTS), clockRate))
+}
+
+// rtpDuration converts a difference of RTP timestamps to a duration.
+func rtpDuration(ticks int32, clockRate uint32) time.Duration {
+    return time.Duration(int64(ticks) * int64(time.Second) / int64(clockRate))
+}
+
+// webmTrack is one track of a WebM file. Its sources are the published
+// tracks recorded on it: usually one, but when a publisher renegotiates and
+// replaces a track, the new one carries on where the old one stopped.
+type webmTrack struct {
+    number   uint64
+    kind     webrtc.RTPCodecType
+    codecID  string
+    channels uint16
+    width    uint16
+    height   uint16
+
+    sources int
+    started bool
+
+    // last is the newest frame queued, and arrived when it came in.
+    last    *webmFrame
+    arrived time.Time
+    lastMS  int64
+}
+
+// webmFrame is a complete frame waiting to be interleaved with the other
+// tracks. Its time is worked out when it is written, from the newest sender
+// report.
+type webmFrame struct {
+    src      *webmSource
+    track    *webmTrack
+    ts       uint32
+    data     []byte
+    keyframe bool
+}
+
+// webmMuxer writes one publisher's tracks to a WebM file.
+type webmMuxer struct {
+    mu      sync.Mutex
+    f       *os.File
+    tracks  []*webmTrack
+    frames  []*webmFrame
+    created time.Time
+    closed  bool
+
+    // file is how the muxer appears in the recording's manifest.
+    file    RecordedFile
+    packets atomic.Uint64
+
+    // Once the track list is written, zero is the wall-clock time of the
+    // start of the file.
+    headerWritten bool
+    zero          time.Time
+    segmentStart  int64
+    durationAt    int64
+    duration      int64
+
+    clock senderClock
+
+    cluster     bytes.Buffer
+    clusterOpen bool
+    clusterTime int64
+}
+
+// newWebMMuxer creates a WebM file for a publisher's tracks.
+func newWebMMuxer(path string, file RecordedFile) (*webmMuxer, error) {
+    f, err := os.Create(path)
+    if err != nil {
+        return nil, err
+    }
+    m := &webmMuxer{f: f, created: time.Now(), file: file}
+
+    header := ebmlMaster(idEBML,
+        ebmlUint(idEBMLVersion, 1),
+        ebmlUint(idEBMLReadVersion, 1),
+        ebmlUint(idEBMLMaxIDLength, 4),
+        ebmlUint(idEBMLMaxSizeLength, 8),
+        ebmlElement(idDocType, []byte("webm")),
+        ebmlUint(idDocTypeVersion, 4),
+        ebmlUint(idDocTypeReadVersion, 2),
+    )
+    // The segment's size is filled in on close; until then it is
+    // "unknown", which players accept for a file still being written.
+    segment := []byte{0x18, 0x53, 0x80, 0x67, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+    if _, err := f.Write(append(header, segment...)); err != nil {
+        f.Close()
+        return nil, err
+    }
+    m.segmentStart = int64(len(header) + len(segment))
+    return m, nil
+}
+
+// webmSource is one published track feeding a webmMuxer. It is the
+// media.Writer of that track's recorder, so it is only called from the
+// recorder's goroutine.
+type webmSource struct {
+    m       *webmMuxer
+    track   *webmTrack
+    layer   *simulcastLayer
+    clock   uint32
+    builder *samplebuilder.SampleBuilder
+
+    // Until the publisher's first sender report, frames are timed from
+    // when the first one arrived.
+    base   time.Time
+    baseTS uint32
+    based  bool
+}
+
+// webmFrameInfo is what a frame's first packet says about it.
+type webmFrameInfo struct {
+    keyframe      bool
+    width, height uint16
+}
+
+// attach adds a published track to the file, on the track it replaces if
+// there is one. It reports false if the codec can't go in WebM, or if the
+// track list was already written without room for it.
+func (m *webmMuxer) attach(pt *PublishedTrack, layer *simulcastLayer) (*webmSource, bool) {
+    codec := pt.Remote.Codec()
+    codecID, ok := webmCodecs[strings.ToLower(codec.MimeType)]
+    if !ok || layer == nil {
+        return nil, false
+    }
+
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    if m.closed {
+        return nil, false
+    }
+    var track *webmTrack
+    for _, t := range m.tracks {
+        if t.codecID == codecID && t.sources == 0 {
+            track = t
+            break
+        }
+    }
+    if track == nil {
+        if m.headerWritten {
+            return nil, false
+        }
+        track = &webmTrack{
+            number:   uint64(len(m.tracks) + 1),
+            kind:     pt.Remote.Kind(),
+            codecID:  codecID,
+            channels: max(codec.Channels, 1),
+            width:    640,
+            height:   480,
+        }
+        m.tracks = append(m.tracks, track)
+    }
+    track.sources++
+    m.file.Tracks = append(m.file.Tracks, pt.Key)
+
+    src := &webmSource{m: m, track: track, layer: layer, clock: codec.ClockRate}
+    opts := []samplebuilder.Option{samplebuilder.WithMaxTimeDelay(webmJitterLatency)}
+    var depacketizer rtp.Depacketizer
+    switch codecID {
+    case "V_VP8":
+        depacketizer = &codecs.VP8Packet{}
+    case "V_VP9":
+        depacketizer = &codecs.VP9Packet{}
+        opts = append(opts, samplebuilder.WithPacketHeadHandler(func(head interface{}) interface{} {
+            vp9 := head.(*codecs.VP9Packet)
+            info := webmFrameInfo{keyframe: vp9.B && !vp9.P}
+            if vp9.V && len(vp9.Width) > 0 {
+                info.width, info.height = vp9.Width[len(vp9.Width)-1], vp9.Height[len(vp9.Height)-1]
+            }
+            return info
+        }))
+    default:
+        depacketizer = &codecs.OpusPacket{}
+    }
+    src.builder = samplebuilder.New(512, depacketizer, codec.ClockRate, opts...)
+    return src, true
+}
+
+// WriteRTP adds a packet to the source's jitter buffer and passes on the
+// frames it completes.
+func (s *webmSource) WriteRTP(pkt *rtp.Packet) error {
+    s.m.packets.Add(1)
+    s.builder.Push(keepPacket(pkt))
+
+    for sample := s.builder.Pop(); sample != nil; sample = s.builder.Pop() {
+        frame := &webmFrame{src: s, track: s.track, ts: sample.PacketTimestamp, data: sample.Data, keyframe: true}
+        if s.track.kind == webrtc.RTPCodecTypeVideo {
+            info, _ := sample.Metadata.(webmFrameInfo)
+            frame.keyframe = info.keyframe
+            if s.track.codecID == "V_VP8" {
+                frame.keyframe, info.width, info.height = vp8FrameInfo(sample.Data)
+            }
+            s.m.push(frame, info)
+        } else {
+            s.m.push(frame, webmFrameInfo{})
+        }
+    }
+    return nil
+}
+
+// keepPacket copies a packet for a sample builder, which keeps packets until
+// their frame is complete, while the one it was given goes back to the pool.
+func keepPacket(pkt *rtp.Packet) *rtp.Packet {
+    kept := &rtp.Packet{Header: pkt.Header, Payload: append([]byte(nil), pkt.Payload...)}
+    kept.Extensions = nil
+    kept.CSRC = nil
+    return kept
+}
+
+// Close detaches the source. The file itself stays open for the
+// publisher's other tracks, and for any track replacing this one.
+func (s *webmSource) Close() error {
+    s.m.mu.Lock()
+    defer s.m.mu.Unlock()
+
+    if s.track != nil {
+        s.track.sources--
+        s.track = nil
+        s.m.flush(false)
+    }
+    return nil
+}
+
+// vp8FrameInfo reads whether a VP8 frame is a keyframe and, if it is, the
+// picture size from its header (RFC 6386 section 9.1).
+func vp8FrameInfo(frame []byte) (keyframe bool, width, height uint16) {
+    if len(frame) == 0 || frame[0]&0x01 != 0 {
+        return false, 0, 0
+    }
+    if len(frame) >= 10 && frame[3] == 0x9D && frame[4] == 0x01 && frame[5] == 0x2A {
+        width = binary.LittleEndian.Uint16(frame[6:]) & 0x3FFF
+        height = binary.LittleEndian.Uint16(frame[8:]) & 0x3FFF
+    }
+    return true, width, height
+}
+
+// wallclock returns the time on our clock that the publisher captured an
+// RTP timestamp of src at. Callers must hold m.mu.
+func (m *webmMuxer) wallclock(src *webmSource, ts uint32) time.Time {
+    return m.clock.at(src.layer, src.clock, ts, src.base, src.baseTS)
+}
+
+// push queues a complete frame and writes whatever the other tracks have
+// caught up with.
+func (m *webmMuxer) push(frame *webmFrame, info webmFrameInfo) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    src, track := frame.src, frame.track
+    if m.closed || src.track == nil {
+        return
+    }
+    if !src.based {
+        src.base, src.baseTS, src.based = time.Now(), frame.ts, true
+    }
+    if track.kind == webrtc.RTPCodecTypeVideo && !track.started {
+        // Nothing before the first keyframe can be decoded.
+        if !frame.keyframe {
+            return
+        }
+        if info.width > 0 && info.height > 0 && !m.headerWritten {
+            track.width, track.height = info.width, info.height
+        }
+    }
+    track.started = true
+    track.last = frame
+    track.arrived = time.Now()
+    m.frames = append(m.frames, frame)
+    m.flush(false)
+}
+
+// ready reports whether the track list can be written: every track has
+// started and has a sender report, or we have waited long enough. Callers
+// must hold m.mu.
+func (m *webmMuxer) ready() bool {
+    if time.Since(m.created) >= webmStartTimeout {
+        return true
+    }
+    for _, track := range m.tracks {
+        if !track.started || track.last == nil || track.last.src.layer.senderReport.Load() == nil {
+            return false
+        }
+    }
+    return len(m.tracks) > 0
+}
+
+// flush writes the queued frames in time order, up to the point every
+// active track has reached, or all of them if final is set. Callers must
+// hold m.mu.
+func (m *webmMuxer) flush(final bool) {
+    if !m.headerWritten {
+        if !final && !m.ready() {
+            return
+        }
+        m.writeHeader()
+    }
+
+    times := make(map[*webmFrame]time.Time, len(m.frames))
+    for _, frame := range m.frames {
+        times[frame] = m.wallclock(frame.src, frame.ts)
+    }
+    sort.SliceStable(m.frames, func(i, j int) bool {
+        return times[m.frames[i]].Before(times[m.frames[j]])
+    })
+
+    var horizon time.Time
+    if !final {
+        for _, track := range m.tracks {
+            if track.sources == 0 || track.last == nil || time.Since(track.arrived) > webmStallTimeout {
+                continue
+            }
+            if at := m.wallclock(track.last.src, track.last.ts); horizon.IsZero() || at.Before(horizon) {
+                horizon = at
+            }
+        }
+        if horizon.IsZero() {
+            return
+        }
+    }
+
+    written := 0
+    for _, frame := range m.frames {
+        if !final && times[frame].After(horizon) {
+            break
+        }
+        m.writeFrame(frame, times[frame])
+        written++
+    }
+    m.frames = m.frames[written:]
+}
+
+// writeHeader writes the segment's Info and Tracks, and fixes the start of
+// the timeline at the earliest frame queued. Callers must hold m.mu.
+func (m *webmMuxer) writeHeader() {
+    m.headerWritten = true
+    m.zero = time.Now()
+    for _, frame := range m.frames {
+        if at := m.wallclock(frame.src, frame.ts); at.Before(m.zero) {
+            m.zero = at
+        }
+    }
+
+    info := ebmlMaster(idInfo,
+        ebmlUint(idTimecodeScale, uint64(time.Millisecond)),
+        ebmlElement(idMuxingApp, []byte("simple_sfu")),
+        ebmlElement(idWritingApp, []byte("simple_sfu")),
+        ebmlElement(idDateUTC, binary.BigEndian.AppendUint64(nil, uint64(m.zero.Sub(time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC))))),
+        ebmlFloat(idDuration, 0),
+    )
+    // Duration is the last element of Info; its value is patched on close.
+    m.durationAt = m.segmentStart + int64(len(info)) - 8
+
+    var entries [][]byte
+    for _, track := range m.tracks {
+        entry := [][]byte{
+            ebmlUint(idTrackNumber, track.number),
+            ebmlUint(idTrackUID, track.number),
+            ebmlUint(idFlagLacing, 0),
+            ebmlElement(idCodecID, []byte(track.codecID)),
+        }
+        if track.kind == webrtc.RTPCodecTypeVideo {
+            entry = append(entry,
+                ebmlUint(idTrackType, 1),
+                ebmlMaster(idVideo, ebmlUint(idPixelWidth, uint64(track.width)), ebmlUint(idPixelHeight, uint64(track.height))),
+            )
+        } else {
+            entry = append(entry,
+                ebmlUint(idTrackType, 2),
+                ebmlElement(idCodecPrivate, opusHead(track.channels)),
+                ebmlUint(idCodecDelay, uint64(opusPreSkip*time.Second/48000)),
+                ebmlUint(idSeekPreRoll, uint64(80*time.Millisecond)),
+                ebmlMaster(idAudio, ebmlFloat(idSamplingFrequency, 48000), ebmlUint(idChannels, uint64(track.channels))),
+            )
+        }
+        entries = append(entries, ebmlMaster(idTrackEntry, entry...))
+    }
+
+    if _, err := m.f.Write(append(info, ebmlMaster(idTracks, entries...)...)); err != nil {
+        log.Printf("⚠️ Couldn't write WebM header to %s: %v", m.f.Name(), err)
+    }
+}
+
+// opusPreSkip is the number of samples Opus decoders discard at the start.
+const opusPreSkip = 3840
+
+// opusHead is the identification header Opus tracks carry as their codec
+// private data (RFC 7845 section 5.1).
+func opusHead(channels uint16) []byte {
+    head := []byte("OpusHead")
+    head = append(head, 1, byte(channels))
+    head = binary.LittleEndian.AppendUint16(head, opusPreSkip)
+    head = binary.LittleEndian.AppendUint32(head, 48000)
+    return append(head, 0, 0, 0)
+}
+
+// writeFrame adds a frame to the current cluster, starting a new one at a
+// video keyframe or when the current one gets too long. Callers must hold
+// m.mu.
+func (m *webmMuxer) writeFrame(frame *webmFrame, at time.Time) {
+    track := frame.track
+
+    // Times only go forward within a track, even when a new sender report
+    // moves its clock back a little.
+    ms := max(at.Sub(m.zero).Milliseconds(), track.lastMS)
+    track.lastMS = ms
+
+    if m.clusterOpen {
+        span := ms - m.clusterTime
+        video := track.kind == webrtc.RTPCodecTypeVideo
+        if span >= webmClusterMax || (video && frame.keyframe && span >= webmClusterMin) || span < 0 {
+            m.closeCluster()
+        }
+    }
+    if !m.clusterOpen {
+        m.clusterOpen = true
+        m.clusterTime = ms
+        m.cluster.Write(ebmlUint(idTimecode, uint64(ms)))
+    }
+
+    block := ebmlSize(track.number)
+    block = binary.BigEndian.AppendUint16(block, uint16(int16(ms-m.clusterTime)))
+    flags := byte(0)
+    if frame.keyframe {
+        flags |= 0x80
+    }
+    block = append(block, flags)
+    m.cluster.Write(ebmlElement(idSimpleBlock, append(block, frame.data...)))
+    m.duration = max(m.duration, ms)
+}
+
+// closeCluster writes out the current cluster. Callers must hold m.mu.
+func (m *webmMuxer) closeCluster() {
+    if !m.clusterOpen {
+        return
+    }
+    if _, err := m.f.Write(ebmlElement(idCluster, m.cluster.Bytes())); err != nil {
+        log.Printf("⚠️ Couldn't write WebM cluster to %s: %v", m.f.Name(), err)
+    }
+    m.cluster.Reset()
+    m.clusterOpen = false
+}
+
+// close writes everything still queued and finalizes the file with its
+// size and duration. Sources still attached are ignored from then on.
+func (m *webmMuxer) close() error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    if m.closed {
+        return nil
+    }
+    m.closed = true
+    m.flush(true)
+    m.closeCluster()
+
+    end, err := m.f.Seek(0, io.SeekEnd)
+    if err == nil {
+        size := make([]byte, 8)
+        binary.BigEndian.PutUint64(size, uint64(end-m.segmentStart)|0x01<<56)
+        _, err = m.f.WriteAt(size, m.segmentStart-8)
+    }
+    if err == nil {
+        duration := make([]byte, 8)
+        binary.BigEndian.PutUint64(duration, math.Float64bits(float64(m.duration)))
+        _, err = m.f.WriteAt(duration, m.durationAt)
+    }
+    if closeErr := m.f.Close(); err == nil {
+        err = closeErr
+    }
+    ended := time.Now()
+    m.file.EndedAt = &ended
+    return err
+}
+
+// manifestFile describes the muxer's file for the recording's manifest.
+func (m *webmMuxer) manifestFile() RecordedFile {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    file := m.file
+    file.Tracks = append([]string(nil), m.file.Tracks...)
+    file.Packets = m.packets.Load()
+    kinds := make(map[webrtc.RTPCodecType]bool)
+    for _, track := range m.tracks {
+        kinds[track.kind] = true
+    }
+    switch {
+    case kinds[webrtc.RTPCodecTypeAudio] && kinds[webrtc.RTPCodecTypeVideo]:
+        file.Kind, file.MimeType = "audio+video", "video/webm"
+    case kinds[webrtc.RTPCodecTypeVideo]:
+        file.Kind, file.MimeType = "video", "video/webm"
+    default:
+        file.Kind, file.MimeType = "audio", "audio/webm"
+    }
+    return file
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "math"
+    "math/bits"
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+    "time"
+
+    "github.com/pion/webrtc/v3"
+)
+
+func TestEBMLSize(t *testing.T) {
+    tests := []struct {
+        n    uint64
+        want []byte
+    }{
+        {0, []byte{0x80}},
+        {1, []byte{0x81}},
+        {126, []byte{0xFE}},
+        // All ones is reserved for an unknown size.
+        {127, []byte{0x40, 0x7F}},
+        {16382, []byte{0x7F, 0xFE}},
+        {16383, []byte{0x20, 0x3F, 0xFF}},
+        {1<<21 - 2, []byte{0x3F, 0xFF, 0xFE}},
+        {1<<21 - 1, []byte{0x10, 0x1F, 0xFF, 0xFF}},
+        {1<<56 - 2, []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFE}},
+    }
+    for _, tt := range tests {
+        if got := ebmlSize(tt.n); !bytes.Equal(got, tt.want) {
+            t.Errorf("ebmlSize(%d) = % x, want % x", tt.n, got, tt.want)
+        }
+    }
+}
+
+// ebmlNode is one element read back from a WebM file.
+type ebmlNode struct {
+    id   uint32
+    data []byte
+}
+
+// readEBMLVint reads a variable-length integer, keeping its length marker
+// for IDs and masking it off for sizes.
+func readEBMLVint(b []byte, keepMarker bool) (uint64, int) {
+    if len(b) == 0 || b[0] == 0 {
+        return 0, 0
+    }
+    length := bits.LeadingZeros8(b[0]) + 1
+    if len(b) < length {
+        return 0, 0
+    }
+    v := uint64(b[0])
+    if !keepMarker {
+        v &^= 0x80 >> (length - 1)
+    }
+    for _, c := range b[1:length] {
+        v = v<<8 | uint64(c)
+    }
+    return v, length
+}
+
+// readEBML splits data into the elements it holds.
+func readEBML(t *testing.T, data []byte) []ebmlNode {
+    t.Helper()
+
+    var nodes []ebmlNode
+    for len(data) > 0 {
+        id, n := readEBMLVint(data, true)
+        size, m := readEBMLVint(data[n:], false)
+        if n == 0 || m == 0 || uint64(len(data)-n-m) < size {
+            t.Fatalf("malformed element at % x", data[:min(len(data), 16)])
+        }
+        data = data[n+m:]
+        nodes = append(nodes, ebmlNode{id: uint32(id), data: data[:size]})
+        data = data[size:]
+    }
+    return nodes
+}
+
+// webmBlock is what a SimpleBlock says about its frame.
+type webmBlock struct {
+    track    uint64
+    ms       int64
+    keyframe bool
+}
+
+func TestWebMMuxer(t *testing.T) {
+    // pushed is a frame given to the muxer, on the video track (VP8 at
+    // 90 kHz) or the audio track (Opus at 48 kHz).
+    type pushed struct {
+        video    bool
+        ts       uint32
+        keyframe bool
+    }
+    video := func(ts uint32, keyframe bool) pushed { return pushed{video: true, ts: ts, keyframe: keyframe} }
+    audio := func(ts uint32) pushed { return pushed{ts: ts, keyframe: true} }
+
+    tests := []struct {
+        name string
+
+        // The sender reports tie these RTP timestamps of each track to
+        // the same instant.
+        videoSR, audioSR uint32
+
+        frames   []pushed
+        clusters []int64
+        blocks   []webmBlock
+    }{
+        {
+            name:     "interleaved by capture time",
+            frames:   []pushed{video(0, true), video(3000, false), audio(0), audio(960), audio(1920)},
+            clusters: []int64{0},
+            blocks:   []webmBlock{{1, 0, true}, {2, 0, true}, {2, 20, true}, {1, 33, false}, {2, 40, true}},
+        },
+        {
+            name:     "aligned by sender reports",
+            videoSR:  90000,
+            audioSR:  10000,
+            frames:   []pushed{audio(10000), video(90000, true), audio(10960), video(93000, false)},
+            clusters: []int64{0},
+            blocks:   []webmBlock{{2, 0, true}, {1, 0, true}, {2, 20, true}, {1, 33, false}},
+        },
+        {
+            name:     "video before the first keyframe dropped",
+            frames:   []pushed{video(0, false), video(2700, true), audio(2880), video(5400, false)},
+            clusters: []int64{0},
+            blocks:   []webmBlock{{1, 0, true}, {2, 30, true}, {1, 30, false}},
+        },
+        {
+            name:     "cluster at keyframe",
+            frames:   []pushed{video(0, true), video(45000, false), video(90000, false), video(99000, true), video(108000, true)},
+            clusters: []int64{0, 1100},
+            blocks:   []webmBlock{{1, 0, true}, {1, 500, false}, {1, 1000, false}, {1, 1100, true}, {1, 1200, true}},
+        },
+        {
+            name:     "cluster at most webmClusterMax long",
+            frames:   []pushed{video(0, true), video(webmClusterMax*90-90, false), video(webmClusterMax*90, false)},
+            clusters: []int64{0, webmClusterMax},
+            blocks:   []webmBlock{{1, 0, true}, {1, webmClusterMax - 1, false}, {1, webmClusterMax, false}},
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            path := filepath.Join(t.TempDir(), "recording.webm")
+            m, err := newWebMMuxer(path, RecordedFile{})
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            // Every frame was captured a while ago, as they would have been
+            // by the time they reach the muxer.
+            captured := time.Now().Add(-time.Minute)
+            source := func(number uint64, kind webrtc.RTPCodecType, codecID string, clock, sr uint32) *webmSource {
+                track := &webmTrack{number: number, kind: kind, codecID: codecID, channels: 1, width: 640, height: 480, sources: 1}
+                m.tracks = append(m.tracks, track)
+                layer := &simulcastLayer{}
+                layer.senderReport.Store(&senderReport{rtp: sr, ntp: captured, received: captured})
+                return &webmSource{m: m, track: track, layer: layer, clock: clock}
+            }
+            videoSrc := source(1, webrtc.RTPCodecTypeVideo, "V_VP8", 90000, tt.videoSR)
+            audioSrc := source(2, webrtc.RTPCodecTypeAudio, "A_OPUS", 48000, tt.audioSR)
+
+            for i, f := range tt.frames {
+                src := audioSrc
+                if f.video {
+                    src = videoSrc
+                }
+                m.push(&webmFrame{src: src, track: src.track, ts: f.ts, data: []byte{byte(i)}, keyframe: f.keyframe}, webmFrameInfo{keyframe: f.keyframe})
+            }
+            if err := m.close(); err != nil {
+                t.Fatal(err)
+            }
+
+            data, err := os.ReadFile(path)
+            if err != nil {
+                t.Fatal(err)
+            }
+            top := readEBML(t, data)
+            if len(top) != 2 || top[0].id != idEBML || top[1].id != idSegment {
+                t.Fatalf("file holds %d top-level elements, want the EBML header and one segment", len(top))
+            }
+            for _, node := range readEBML(t, top[0].data) {
+                if node.id == idDocType && string(node.data) != "webm" {
+                    t.Errorf("DocType = %q, want webm", node.data)
+                }
+            }
+
+            var clusters []int64
+            var blocks []webmBlock
+            var duration float64
+            var entries int
+            for _, node := range readEBML(t, top[1].data) {
+                switch node.id {
+                case idInfo:
+                    for _, info := range readEBML(t, node.data) {
+                        if info.id == idDuration {
+                            duration = math.Float64frombits(binary.BigEndian.Uint64(info.data))
+                        }
+                    }
+                case idTracks:
+                    entries = len(readEBML(t, node.data))
+                case idCluster:
+                    var clusterTime int64
+                    for _, child := range readEBML(t, node.data) {
+                        switch child.id {
+                        case idTimecode:
+                            var v uint64
+                            for _, c := range child.data {
+                                v = v<<8 | uint64(c)
+                            }
+                            clusterTime = int64(v)
+                            clusters = append(clusters, clusterTime)
+                        case idSimpleBlock:
+                            track, n := readEBMLVint(child.data, false)
+                            offset := int16(binary.BigEndian.Uint16(child.data[n:]))
+                            keyframe := child.data[n+2]&0x80 != 0
+                            blocks = append(blocks, webmBlock{track: track, ms: clusterTime + int64(offset), keyframe: keyframe})
+                        }
+                    }
+                }
+            }
+
+            if entries != 2 {
+                t.Errorf("Tracks holds %d entries, want 2", entries)
+            }
+            if !reflect.DeepEqual(clusters, tt.clusters) {
+                t.Errorf("cluster times = %v, want %v", clusters, tt.clusters)
+            }
+            if !reflect.DeepEqual(blocks, tt.blocks) {
+                t.Errorf("blocks = %v, want %v", blocks, tt.blocks)
+            }
+            if want := float64(tt.blocks[len(tt.blocks)-1].ms); duration != want {
+                t.Errorf("Duration = %v, want %v", duration, want)
+            }
+        })
+    }
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "path"
+    "sort"
+
+    "github.com/pion/webrtc/v3"
+)
+
+// WHEP (the egress counterpart of WHIP) lets players pull a room, or one
+// publisher in it, without our JSON signaling. The player's offer has an
+// m-line for each track it wants to receive; the answer attaches as many
+// of the published tracks as fit, since no offer can add more later. The
+// session URL in the Location header takes PATCH and DELETE like a WHIP
+// session's.
+
+var (
+    errNotWHEPSession = errors.New("not a WHEP session")
+    errNothingToView  = errors.New("no tracks to view")
+)
+
+// whepHeaders lets browser players on other origins use the WHEP routes.
+func whepHeaders(w http.ResponseWriter) {
+    w.Header().Set("Access-Control-Allow-Origin", "*")
+    w.Header().Set("Access-Control-Expose-Headers", "Location, ETag, Link, WWW-Authenticate")
+}
+
+// whepPreflightHandler answers CORS preflight requests on the WHEP routes.
+func whepPreflightHandler(w http.ResponseWriter, r *http.Request) {
+    whepHeaders(w)
+    w.Header().Set("Access-Control-Allow-Methods", "POST, PATCH, DELETE, OPTIONS")
+    w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match")
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// whepHandler creates a subscriber from a WHEP offer, receiving the
+// tracks of the {publisher} path value or, without one, of the whole room.
+func whepHandler(w http.ResponseWriter, r *http.Request) {
+    whepHeaders(w)
+    claims, ok := authorize(w, r)
+    if !ok {
+        return
+    }
+    if !claims.permits(RoleSubscriber) {
+        http.Error(w, errRoleNotAllowed.Error(), http.StatusForbidden)
+        return
+    }
+    if !hasContentType(r, "application/sdp") {
+        http.Error(w, "Expected application/sdp", http.StatusUnsupportedMediaType)
+        return
+    }
+    body, err := io.ReadAll(r.Body)
+    if err != nil {
+        http.Error(w, "Invalid SDP", http.StatusBadRequest)
+        return
+    }
+    room := rooms.get(roomID(r))
+    if room == nil {
+        http.Error(w, "Room not found", http.StatusNotFound)
+        return
+    }
+    publisherID := r.PathValue("publisher")
+    if publisherID != "" && room.Peer(publisherID) == nil {
+        http.Error(w, "Publisher not found", http.StatusNotFound)
+        return
+    }
+
+    offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(body)}
+    tracks, err := room.viewableTracks(publisherID, offer)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusNotFound)
+        return
+    }
+
+    // The tracks are attached before the offer is applied so that they
+    // take the player's recvonly m-lines.
+    peer, err := newPeer(room.ID, RoleSubscriber, offer, func(p *Peer) {
+        p.offerless = true
+        for _, pt := range tracks {
+            if err := p.forward(pt); err != nil {
+                log.Printf("⚠️ Couldn't forward %s to %s: %v", pt.Key, p.ID, err)
+            }
+        }
+    })
+    if errors.Is(err, errNoAllowedCodec) || errors.Is(err, errSubscriberSends) {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    peer.Identity = claims.identity()
+    peer.requestNegotiatedKeyframes()
+    peer.awaitCandidates(webrtc.GatheringCompletePromise(peer.PC))
+    peer.Room.join(peer)
+    log.Printf("📺 [%s] Viewing %d tracks in room %s over WHEP", peer.ID, len(tracks), peer.Room.ID)
+
+    answer := peer.PC.LocalDescription()
+    w.Header().Set("Content-Type", "application/sdp")
+    w.Header().Set("Location", path.Join(r.URL.Path, peer.secret))
+    w.Header().Set("ETag", peer.iceETag())
+    for _, server := range iceServers {
+        for _, url := range server.URLs {
+            w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"ice-server\"", url))
+        }
+    }
+    w.WriteHeader(http.StatusCreated)
+    io.WriteString(w, answer.SDP)
+}
+
+// whepSessionHandler handles PATCH and DELETE on a WHEP session.
+func whepSessionHandler(w http.ResponseWriter, r *http.Request) {
+    whepHeaders(w)
+    peer := lookupResource(w, r)
+    if peer == nil {
+        return
+    }
+    if peer.publishes() {
+        http.Error(w, errNotWHEPSession.Error(), http.StatusNotFound)
+        return
+    }
+    iceSessionHandler(w, r, peer)
+}
+
+// viewableTracks picks the tracks a WHEP offer can receive, from one
+// publisher's or, if publisherID is empty, from the whole room with the
+// current speaker first. Each track needs an m-line of its kind that the
+// player receives on and that lists the track's codec.
+func (room *Room) viewableTracks(publisherID string, offer webrtc.SessionDescription) ([]*PublishedTrack, error) {
+    parsed, err := offer.Unmarshal()
+    if err != nil {
+        return nil, err
+    }
+    slots := map[string]int{}
+    for _, md := range parsed.MediaDescriptions {
+        if md.MediaName.Port.Value == 0 {
+            continue
+        }
+        _, sendonly := md.Attribute(webrtc.RTPTransceiverDirectionSendonly.String())
+        _, inactive := md.Attribute(webrtc.RTPTransceiverDirectionInactive.String())
+        if !sendonly && !inactive {
+            slots[md.MediaName.Media]++
+        }
+    }
+
+    room.mu.RLock()
+    published := room.publishedTracks()
+    room.mu.RUnlock()
+
+    speaker := room.Speaker().SpeakerID
+    sort.Slice(published, func(i, j int) bool {
+        a, b := published[i], published[j]
+        if (a.Publisher.ID == speaker) != (b.Publisher.ID == speaker) {
+            return a.Publisher.ID == speaker
+        }
+        return a.Key < b.Key
+    })
+
+    var tracks []*PublishedTrack
+    for _, pt := range published {
+        if publisherID != "" && pt.Publisher.ID != publisherID {
+            continue
+        }
+        kind := pt.Remote.Kind().String()
+        if slots[kind] == 0 || pt.ended.Load() || !describesCodec(&offer, pt.Remote.Codec()) {
+            continue
+        }
+        slots[kind]--
+        tracks = append(tracks, pt)
+    }
+    if len(tracks) == 0 {
+        return nil, errNothingToView
+    }
+    return tracks, nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "mime"
+    "net/http"
+    "path"
+    "strings"
+    "time"
+
+    "github.com/pion/sdp/v3"
+    "github.com/pion/webrtc/v3"
+)
+
+// WHIP (RFC 9725) lets encoders like OBS and GStreamer publish without our
+// JSON signaling: they POST an SDP offer and get the answer back with the
+// URL of their session, named by the peer's secret, which they PATCH to
+// trickle candidates or restart ICE and DELETE to stop. There is no way to
+// send them offers, so WHIP peers join as publishers; their tracks are
+// forwarded like any other peer's.
+
+// whipGatherTimeout bounds how long an answer waits for the server's
+// candidates, which WHIP clients can only learn from it.
+const whipGatherTimeout = 5 * time.Second
+
+var errNotWHIPSession = errors.New("not a WHIP session")
+
+// hasContentType reports whether a request's body has the given media type.
+func hasContentType(r *http.Request, mediaType string) bool {
+    t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+    return err == nil && t == mediaType
+}
+
+// whipHandler creates a publish-only peer from a WHIP offer.
+func whipHandler(w http.ResponseWriter, r *http.Request) {
+    claims, ok := authorize(w, r)
+    if !ok {
+        return
+    }
+    if !claims.permits(RolePublisher) {
+        http.Error(w, errRoleNotAllowed.Error(), http.StatusForbidden)
+        return
+    }
+    if !hasContentType(r, "application/sdp") {
+        http.Error(w, "Expected application/sdp", http.StatusUnsupportedMediaType)
+        return
+    }
+    body, err := io.ReadAll(r.Body)
+    if err != nil {
+        http.Error(w, "Invalid SDP", http.StatusBadRequest)
+        return
+    }
+
+    offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(body)}
+    peer, err := newPeer(roomID(r), RolePublisher, offer, func(p *Peer) {
+        p.offerless = true
+    })
+    if errors.Is(err, errNoAllowedCodec) {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    peer.Identity = claims.identity()
+    peer.awaitCandidates(webrtc.GatheringCompletePromise(peer.PC))
+    peer.Room.join(peer)
+    log.Printf("🔗 [%s] Joined room %s over WHIP", peer.ID, peer.Room.ID)
+
+    answer := peer.PC.LocalDescription()
+    w.Header().Set("Content-Type", "application/sdp")
+    w.Header().Set("Location", path.Join(r.URL.Path, peer.secret))
+    w.Header().Set("ETag", peer.iceETag())
+    for _, server := range iceServers {
+        for _, url := range server.URLs {
+            w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"ice-server\"", url))
+        }
+    }
+    w.WriteHeader(http.StatusCreated)
+    io.WriteString(w, answer.SDP)
+}
+
+// whipSessionHandler handles PATCH and DELETE on a WHIP session.
+func whipSessionHandler(w http.ResponseWriter, r *http.Request) {
+    peer := lookupResource(w, r)
+    if peer == nil {
+        return
+    }
+    if peer.subscribes() {
+        http.Error(w, errNotWHIPSession.Error(), http.StatusNotFound)
+        return
+    }
+    iceSessionHandler(w, r, peer)
+}
+
+// iceSessionHandler applies a PATCH with trickled candidates or an ICE
+// restart to a peer signaled over WHIP, or tears it down on DELETE.
+func iceSessionHandler(w http.ResponseWriter, r *http.Request, peer *Peer) {
+    if r.Method == http.MethodDelete {
+        peer.close()
+        w.WriteHeader(http.StatusOK)
+        return
+    }
+
+    if !hasContentType(r, "application/trickle-ice-sdpfrag") {
+        http.Error(w, "Expected application/trickle-ice-sdpfrag", http.StatusUnsupportedMediaType)
+        return
+    }
+    if match := r.Header.Get("If-Match"); match != "" && match != "*" && match != peer.iceETag() {
+        http.Error(w, "ICE session has changed", http.StatusPreconditionFailed)
+        return
+    }
+    body, err := io.ReadAll(r.Body)
+    if err != nil {
+        http.Error(w, "Invalid SDP fragment", http.StatusBadRequest)
+        return
+    }
+    frag := parseICEFragment(string(body))
+
+    if frag.ufrag == "" || frag.ufrag == peer.remoteUfrag() {
+        for _, candidate := range frag.candidates {
+            if err := peer.addRemoteCandidate(candidate); err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+            }
+        }
+        w.WriteHeader(http.StatusNoContent)
+        return
+    }
+
+    answer, err := peer.restartICE(frag)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    log.Printf("🔄 [%s] ICE restarted", peer.ID)
+    w.Header().Set("Content-Type", "application/trickle-ice-sdpfrag")
+    w.Header().Set("ETag", peer.iceETag())
+    w.WriteHeader(http.StatusOK)
+    io.WriteString(w, answer)
+}
+
+// iceFragment is the content of a trickle ICE SDP fragment (RFC 8840).
+type iceFragment struct {
+    ufrag, pwd string
+    candidates []webrtc.ICECandidateInit
+}
+
+func parseICEFragment(body string) iceFragment {
+    var frag iceFragment
+    mid := ""
+    mline := -1
+    for _, line := range strings.Split(body, "\n") {
+        line = strings.TrimSpace(line)
+        switch {
+        case strings.HasPrefix(line, "a=ice-ufrag:"):
+            frag.ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+        case strings.HasPrefix(line, "a=ice-pwd:"):
+            frag.pwd = strings.TrimPrefix(line, "a=ice-pwd:")
+        case strings.HasPrefix(line, "m="):
+            mline++
+            mid = ""
+        case strings.HasPrefix(line, "a=mid:"):
+            mid = strings.TrimPrefix(line, "a=mid:")
+        case strings.HasPrefix(line, "a=candidate:"):
+            candidate := webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a=")}
+            if mid != "" {
+                candidate.SDPMid = &mid
+            }
+            if mline >= 0 {
+                index := uint16(mline)
+                candidate.SDPMLineIndex = &index
+            }
+            frag.candidates = append(frag.candidates, candidate)
+        }
+    }
+    return frag
+}
+
+// awaitCandidates waits for the server's candidates to be gathered into its
+// local description, for clients that can't have them trickled.
+func (p *Peer) awaitCandidates(gathered <-chan struct{}) {
+    select {
+    case <-gathered:
+    case <-time.After(whipGatherTimeout):
+        log.Printf("⚠️ [%s] Answering before ICE gathering completed", p.ID)
+    }
+}
+
+// iceCredentials reads the ICE username fragment and password of a session
+// description, from its first media section if not at session level.
+func iceCredentials(desc *webrtc.SessionDescription) (ufrag, pwd string) {
+    if desc == nil {
+        return "", ""
+    }
+    parsed, err := desc.Unmarshal()
+    if err != nil {
+        return "", ""
+    }
+    ufrag, _ = parsed.Attribute("ice-ufrag")
+    pwd, _ = parsed.Attribute("ice-pwd")
+    if ufrag == "" && len(parsed.MediaDescriptions) > 0 {
+        ufrag, _ = parsed.MediaDescriptions[0].Attribute("ice-ufrag")
+        pwd, _ = parsed.MediaDescriptions[0].Attribute("ice-pwd")
+    }
+    return ufrag, pwd
+}
+
+func (p *Peer) remoteUfrag() string {
+    ufrag, _ := iceCredentials(p.PC.RemoteDescription())
+    return ufrag
+}
+
+// iceETag identifies the peer's current ICE session, which changes with
+// each restart.
+func (p *Peer) iceETag() string {
+    ufrag, _ := iceCredentials(p.PC.LocalDescription())
+    return `"` + ufrag + `"`
+}
+
+// restartICE restarts ICE with the client's new credentials, by applying
+// its last offer again with them, and returns the fragment with the
+// server's new credentials and candidates.
+func (p *Peer) restartICE(frag iceFragment) (string, error) {
+    p.negotiationMu.Lock()
+    defer p.negotiationMu.Unlock()
+
+    remote := p.PC.RemoteDescription()
+    if remote == nil || remote.Type != webrtc.SDPTypeOffer {
+        return "", errors.New("no offer to restart ICE for")
+    }
+    parsed, err := remote.Unmarshal()
+    if err != nil {
+        return "", err
+    }
+    setICECredentials(parsed, frag.ufrag, frag.pwd)
+    raw, err := parsed.Marshal()
+    if err != nil {
+        return "", err
+    }
+
+    if err := p.PC.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(raw)}); err != nil {
+        return "", err
+    }
+    for _, candidate := range frag.candidates {
+        if err := p.PC.AddICECandidate(candidate); err != nil {
+            log.Printf("⚠️ [%s] Couldn't add candidate: %v", p.ID, err)
+        }
+    }
+    answer, err := p.PC.CreateAnswer(nil)
+    if err != nil {
+        return "", err
+    }
+    gathered := webrtc.GatheringCompletePromise(p.PC)
+    if err := p.PC.SetLocalDescription(answer); err != nil {
+        return "", err
+    }
+    p.awaitCandidates(gathered)
+    return localICEFragment(p.PC.LocalDescription())
+}
+
+// setICECredentials replaces the ICE credentials of a session description
+// wherever they appear.
+func setICECredentials(desc *sdp.SessionDescription, ufrag, pwd string) {
+    set := func(attrs []sdp.Attribute) []sdp.Attribute {
+        for i := range attrs {
+            switch attrs[i].Key {
+            case "ice-ufrag":
+                attrs[i].Value = ufrag
+            case "ice-pwd":
+                attrs[i].Value = pwd
+            }
+        }
+        return attrs
+    }
+    desc.Attributes = set(desc.Attributes)
+    for _, media := range desc.MediaDescriptions {
+        media.Attributes = set(media.Attributes)
+    }
+}
+
+// localICEFragment describes the ICE session of a local description as an
+// SDP fragment: its credentials, and the candidates of the first media
+// section, which every other one is bundled on.
+func localICEFragment(desc *webrtc.SessionDescription) (string, error) {
+    parsed, err := desc.Unmarshal()
+    if err != nil {
+        return "", err
+    }
+    if len(parsed.MediaDescriptions) == 0 {
+        return "", errors.New("no media to restart ICE for")
+    }
+    ufrag, pwd := iceCredentials(desc)
+    media := parsed.MediaDescriptions[0]
+
+    var b strings.Builder
+    fmt.Fprintf(&b, "a=ice-ufrag:%s\r\na=ice-pwd:%s\r\n", ufrag, pwd)
+    fmt.Fprintf(&b, "m=%s %d %s %s\r\n", media.MediaName.Media, media.MediaName.Port.Value, strings.Join(media.MediaName.Protos, "/"), strings.Join(media.MediaName.Formats, " "))
+    if mid, ok := media.Attribute("mid"); ok {
+        fmt.Fprintf(&b, "a=mid:%s\r\n", mid)
+    }
+    for _, attr := range media.Attributes {
+        if attr.Key == "candidate" {
+            fmt.Fprintf(&b, "a=candidate:%s\r\n", attr.Value)
+        }
+    }
+    b.WriteString("a=end-of-candidates\r\n")
+    return b.String(), nil
+}